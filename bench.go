@@ -0,0 +1,206 @@
+package macaco
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// BenchmarkTime is the default minimum time used
+	// for running each benchmark.
+	BenchmarkTime = time.Second
+
+	benchPrefix = "__bench"
+	maxBenchN   = 1e9
+)
+
+// Benchmark contains the results of running a benchmark function, a global
+// function with its name starting with __bench. Allocations are measured
+// in the Go runtime, so they include the ones made by the interpreter.
+type Benchmark struct {
+	Name string
+	// N is the number of times the function was called.
+	N int
+	// T is the total time spent in the N calls.
+	T time.Duration
+	// Allocs and Bytes are the total number of allocations
+	// and the total allocated bytes in the N calls.
+	Allocs uint64
+	Bytes  uint64
+	// HTTPRequests is the total number of HTTP requests sent
+	// in the N calls, excluding the ones served from the cache.
+	HTTPRequests int
+	// Error is non-nil if the function threw an exception,
+	// in which case the rest of the fields are not valid.
+	Error *ScriptError
+}
+
+// NsPerOp returns the nanoseconds spent in each call.
+func (b *Benchmark) NsPerOp() int64 {
+	if b.N <= 0 {
+		return 0
+	}
+	return b.T.Nanoseconds() / int64(b.N)
+}
+
+// AllocsPerOp returns the number of allocations in each call.
+func (b *Benchmark) AllocsPerOp() int64 {
+	if b.N <= 0 {
+		return 0
+	}
+	return int64(b.Allocs) / int64(b.N)
+}
+
+// AllocedBytesPerOp returns the allocated bytes in each call.
+func (b *Benchmark) AllocedBytesPerOp() int64 {
+	if b.N <= 0 {
+		return 0
+	}
+	return int64(b.Bytes) / int64(b.N)
+}
+
+// HTTPRequestsPerOp returns the number of HTTP requests sent in each call.
+func (b *Benchmark) HTTPRequestsPerOp() float64 {
+	if b.N <= 0 {
+		return 0
+	}
+	return float64(b.HTTPRequests) / float64(b.N)
+}
+
+// String returns the benchmark results formatted like the
+// Go benchmarks, so they can be processed by the same tools.
+func (b *Benchmark) String() string {
+	if b.Error != nil {
+		return fmt.Sprintf("--- FAIL: Benchmark%s\n\t%s", b.Name, b.Error)
+	}
+	return fmt.Sprintf("Benchmark%s\t%8d\t%10d ns/op\t%8d B/op\t%8d allocs/op\t%8.2f requests/op",
+		b.Name, b.N, b.NsPerOp(), b.AllocedBytesPerOp(), b.AllocsPerOp(), b.HTTPRequestsPerOp())
+}
+
+// RunBenchmarks runs the benchmark functions with names matching re (after
+// removing the __bench prefix), or all of them if re is nil. Each function
+// is called repeatedly, with the number of calls calibrated to take at least
+// d, or BenchmarkTime if d is zero. The results are printed to the Context's
+// standard output (or standard error for failures), while the standard
+// output of the functions is discarded.
+func (c *Context) RunBenchmarks(re *regexp.Regexp, d time.Duration) ([]*Benchmark, error) {
+	if d <= 0 {
+		d = BenchmarkTime
+	}
+	stdout, stderr := c.Stdout, c.Stderr
+	defer func() {
+		c.Stdout = stdout
+	}()
+	c.Stdout = ioutil.Discard
+	var benchmarks []*Benchmark
+	for _, name := range c.Globals() {
+		if !strings.HasPrefix(name, benchPrefix) {
+			continue
+		}
+		bname := strings.TrimPrefix(name, benchPrefix)
+		if re != nil && !re.MatchString(bname) {
+			continue
+		}
+		val, err := c.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if !val.IsFunction() {
+			continue
+		}
+		if c.verbose {
+			fmt.Fprintln(stdout, "BENCH:", bname)
+		}
+		b, err := c.runBenchmark(bname, val, d)
+		if err != nil {
+			return nil, err
+		}
+		benchmarks = append(benchmarks, b)
+		if b.Error != nil {
+			fmt.Fprintln(stderr, b)
+		} else {
+			fmt.Fprintln(stdout, b)
+		}
+	}
+	return benchmarks, nil
+}
+
+func (c *Context) runBenchmark(name string, fn *Value, d time.Duration) (*Benchmark, error) {
+	// Run once to warm up and to check for errors
+	b, err := c.runBenchmarkN(name, fn, 1)
+	if err != nil || b.Error != nil {
+		return b, err
+	}
+	for n := 1; b.T < d && n < maxBenchN; {
+		last := n
+		// Predict the iterations required for d, like the
+		// Go testing package does.
+		prev := b.T.Nanoseconds()
+		if prev <= 0 {
+			prev = 1
+		}
+		n = int(d.Nanoseconds() * int64(last) / prev)
+		n += n / 5
+		if n > 100*last {
+			n = 100 * last
+		}
+		if n <= last {
+			n = last + 1
+		}
+		if n = roundUp(n); n > maxBenchN {
+			n = maxBenchN
+		}
+		if b, err = c.runBenchmarkN(name, fn, n); err != nil || b.Error != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (c *Context) runBenchmarkN(name string, fn *Value, n int) (*Benchmark, error) {
+	b := &Benchmark{Name: name, N: n}
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	requests := c.httpRequests
+	start := time.Now()
+	for ii := 0; ii < n; ii++ {
+		if _, err := fn.Call(nil); err != nil {
+			se, ok := err.(*ScriptError)
+			if !ok {
+				return nil, err
+			}
+			b.Error = se
+			return b, nil
+		}
+	}
+	b.T = time.Since(start)
+	runtime.ReadMemStats(&after)
+	b.Allocs = after.Mallocs - before.Mallocs
+	b.Bytes = after.TotalAlloc - before.TotalAlloc
+	b.HTTPRequests = c.httpRequests - requests
+	return b, nil
+}
+
+// roundUp rounds n up to a number of the form [1eX, 2eX, 3eX, 5eX].
+func roundUp(n int) int {
+	base := 1
+	for base*10 <= n {
+		base *= 10
+	}
+	switch {
+	case n <= base:
+		return base
+	case n <= 2*base:
+		return 2 * base
+	case n <= 3*base:
+		return 3 * base
+	case n <= 5*base:
+		return 5 * base
+	}
+	return 10 * base
+}
@@ -0,0 +1,60 @@
+package macaco
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunBenchmarks(t *testing.T) {
+	ctx := newTestingContext(t)
+	if err := ctx.LoadScript("bench.js", `var calls = 0;
+function __bench_concat() { calls++; return ['a', 'b'].join(''); }
+function __bench_fail() { throw new Error('boom'); }
+function __bench_skipped() { calls += 1000000; }`); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	ctx.Stdout = &stdout
+	ctx.Stderr = &stderr
+	benchmarks, err := ctx.RunBenchmarks(regexp.MustCompile("concat|fail"), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(benchmarks) != 2 {
+		t.Fatalf("expecting 2 benchmarks, got %d", len(benchmarks))
+	}
+	concat, fail := benchmarks[0], benchmarks[1]
+	if concat.Name != "_concat" || concat.Error != nil || concat.N < 2 || concat.T < 20*time.Millisecond {
+		t.Errorf("unexpected benchmark results %+v", concat)
+	}
+	calls, err := ctx.Get("calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := calls.ToInteger(); n < int64(concat.N) || n >= 1000000 {
+		t.Errorf("expecting at least %d calls, got %d", concat.N, n)
+	}
+	if s := concat.String(); !strings.HasPrefix(s, "Benchmark_concat\t") || !strings.Contains(s, " ns/op\t") {
+		t.Errorf("unexpected benchmark output %q", s)
+	}
+	if fail.Error == nil || !strings.Contains(fail.Error.Message, "boom") {
+		t.Errorf("expecting error from failing benchmark, got %+v", fail)
+	}
+	if out := stdout.String(); !strings.Contains(out, concat.String()+"\n") || strings.Contains(out, "FAIL") {
+		t.Errorf("unexpected standard output %q", out)
+	}
+	if out := stderr.String(); out != fail.String()+"\n" || !strings.Contains(out, "--- FAIL: Benchmark_fail") {
+		t.Errorf("unexpected standard error %q", out)
+	}
+}
+
+func TestRoundUp(t *testing.T) {
+	for n, expected := range map[int]int{1: 1, 2: 2, 4: 5, 6: 10, 11: 20, 250: 300, 301: 500, 5000: 5000} {
+		if r := roundUp(n); r != expected {
+			t.Errorf("roundUp(%d) = %d, want %d", n, r, expected)
+		}
+	}
+}
@@ -35,6 +35,12 @@ type scriptEntry struct {
 type cache struct {
 	sync.RWMutex
 	scripts map[string]*scriptEntry
+	// maxAge, when non-zero, limits the expiration
+	// of cached entries.
+	maxAge time.Duration
+	// maxEntrySize, when non-zero, is the maximum size
+	// of the responses cached on disk.
+	maxEntrySize int64
 }
 
 func newCache() *cache {
@@ -79,6 +85,11 @@ func (c *cache) parseExpiration(headers http.Header) time.Time {
 		// Check Expires header
 		expires, _ = time.Parse(time.RFC1123, headers.Get("Expires"))
 	}
+	if c.maxAge > 0 && !expires.IsZero() {
+		if limit := time.Now().Add(c.maxAge); expires.After(limit) {
+			expires = limit
+		}
+	}
 	return expires
 }
 
@@ -87,6 +98,9 @@ func (c *cache) cacheData(url string, body []byte, resp *http.Response) error {
 	if expires.IsZero() {
 		return nil
 	}
+	if c.maxEntrySize > 0 && int64(len(body)) > c.maxEntrySize {
+		return nil
+	}
 	p, err := c.cachePath(url)
 	if err != nil {
 		return err
@@ -140,12 +154,14 @@ func (c *cache) cacheScript(url string, data []byte, resp *http.Response, script
 		// Not cacheable
 		return nil
 	}
-	c.Lock()
-	c.scripts[url] = &scriptEntry{
-		script:  script,
-		expires: expires,
+	if script != nil {
+		c.Lock()
+		c.scripts[url] = &scriptEntry{
+			script:  script,
+			expires: expires,
+		}
+		c.Unlock()
 	}
-	c.Unlock()
 	if entry == nil {
 		return c.cacheData(url, data, resp)
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseRunArgs converts the command line arguments to the values
+// passed to a function. Arguments are interpreted as follows:
+//
+//   - `-`: JSON read from the standard input.
+//   - `@file.json`: JSON read from the given file.
+//   - `--name=value`: added as the name field to an object which is
+//     passed as the last argument. `--name` is equivalent to `--name=true`.
+//   - anything else: a JSON value when jsonArgs is true. Otherwise, a
+//     number if it can be parsed as such or a string.
+//
+// Values in --name=value follow the same rules as positional arguments.
+func parseRunArgs(args []string, jsonArgs bool, stdin io.Reader) ([]interface{}, error) {
+	var values []interface{}
+	var named map[string]interface{}
+	usedStdin := false
+	for _, v := range args {
+		if strings.HasPrefix(v, "--") && len(v) > 2 {
+			name := v[2:]
+			// --name is a shorthand for --name=true
+			var val interface{} = true
+			if eq := strings.IndexByte(name, '='); eq >= 0 {
+				var err error
+				if val, err = parseRunArg(name[eq+1:], jsonArgs); err != nil {
+					return nil, fmt.Errorf("invalid value for argument %s: %s", name[:eq], err)
+				}
+				name = name[:eq]
+			}
+			if name == "" {
+				return nil, fmt.Errorf("invalid named argument %q", v)
+			}
+			if named == nil {
+				named = make(map[string]interface{})
+			}
+			named[name] = val
+			continue
+		}
+		var val interface{}
+		var err error
+		switch {
+		case v == "-":
+			if usedStdin {
+				return nil, errors.New("standard input can only be used once as an argument")
+			}
+			usedStdin = true
+			val, err = decodeJSONArg(stdin)
+			if err != nil {
+				err = fmt.Errorf("error decoding JSON from standard input: %s", err)
+			}
+		case strings.HasPrefix(v, "@") && len(v) > 1:
+			var f *os.File
+			if f, err = os.Open(v[1:]); err == nil {
+				val, err = decodeJSONArg(f)
+				f.Close()
+				if err != nil {
+					err = fmt.Errorf("error decoding JSON from %s: %s", v[1:], err)
+				}
+			}
+		default:
+			val, err = parseRunArg(v, jsonArgs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+	}
+	if named != nil {
+		values = append(values, named)
+	}
+	return values, nil
+}
+
+func parseRunArg(v string, jsonArgs bool) (interface{}, error) {
+	if jsonArgs {
+		var val interface{}
+		if err := json.Unmarshal([]byte(v), &val); err != nil {
+			return nil, fmt.Errorf("invalid JSON %q: %s", v, err)
+		}
+		return val, nil
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n, nil
+	}
+	return v, nil
+}
+
+func decodeJSONArg(r io.Reader) (interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
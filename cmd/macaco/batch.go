@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
+)
+
+var (
+	batchCmd = &command.Cmd{
+		Name:    "batch",
+		Help:    "call a program function once for every line in a JSON lines input file",
+		Usage:   "[-in inputs.jsonl] [-out results.jsonl] [-concurrency N] [-resume] <program-path> <function-name>",
+		Func:    batchCommand,
+		Options: &batchOptions{In: "-", Concurrency: 1},
+	}
+)
+
+type batchOptions struct {
+	In          string `help:"Input file with one JSON value per line, - for standard input"`
+	Out         string `help:"Output file with one JSON result per line. If empty, results are written to standard output"`
+	Concurrency int    `help:"Number of concurrent function calls"`
+	Spread      bool   `help:"Pass the elements of input arrays as separate arguments rather than a single array"`
+	Resume      bool   `help:"Skip inputs which already have a result in the output file, appending the new results"`
+}
+
+// batchResult is written as JSON for every input line. Line
+// numbers start at 1.
+type batchResult struct {
+	Line   int         `json:"line"`
+	Input  interface{} `json:"input"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type batchInput struct {
+	line  int
+	value interface{}
+}
+
+// readBatchResults returns the lines which have a result in the given
+// output file. Lines which can't be decoded (e.g. the last line when the
+// previous run was interrupted) are ignored. It also returns whether the
+// file ends with a newline.
+func readBatchResults(filename string) (map[int]bool, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	defer f.Close()
+	done := make(map[int]bool)
+	r := bufio.NewReader(f)
+	endsWithNewline := true
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			endsWithNewline = line[len(line)-1] == '\n'
+			var res batchResult
+			if json.Unmarshal(line, &res) == nil && res.Line > 0 {
+				done[res.Line] = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return done, endsWithNewline, nil
+}
+
+func batchCommand(args []string, opts *batchOptions) error {
+	if len(args) != 2 {
+		return errors.New("batch requires a program and a function name")
+	}
+	if opts.Concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d, must be at least 1", opts.Concurrency)
+	}
+	if opts.Resume && opts.Out == "" {
+		return errors.New("-resume requires -out")
+	}
+	fn := args[1]
+	if _, err := loadMacacoProgram(args); err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if opts.In != "-" {
+		f, err := os.Open(opts.In)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var out io.Writer = os.Stdout
+	var done map[int]bool
+	if opts.Out != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		endsWithNewline := true
+		if opts.Resume {
+			var err error
+			if done, endsWithNewline, err = readBatchResults(opts.Out); err != nil {
+				return err
+			}
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(opts.Out, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if !endsWithNewline {
+			// Don't append to a truncated line
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+		}
+		out = f
+	}
+	// Copy the contexts before starting the workers, so
+	// the base Context is only used from this goroutine.
+	contexts := make([]*macaco.Context, opts.Concurrency)
+	for ii := range contexts {
+		contexts[ii] = mc.Context()
+	}
+	inputs := make(chan *batchInput)
+	results := make(chan *batchResult)
+	var wg sync.WaitGroup
+	for _, ctx := range contexts {
+		wg.Add(1)
+		go func(ctx *macaco.Context) {
+			defer wg.Done()
+			for input := range inputs {
+				results <- batchCall(ctx, fn, input, opts.Spread)
+			}
+		}(ctx)
+	}
+	readErr := make(chan error, 1)
+	skipped := 0
+	go func() {
+		defer close(inputs)
+		s := bufio.NewScanner(in)
+		// Allow inputs up to 16MB
+		s.Buffer(nil, 16*1024*1024)
+		for line := 1; s.Scan(); line++ {
+			data := s.Bytes()
+			if len(data) == 0 {
+				continue
+			}
+			if done[line] {
+				skipped++
+				continue
+			}
+			input := &batchInput{line: line}
+			if err := json.Unmarshal(data, &input.value); err != nil {
+				results <- &batchResult{Line: line, Input: string(data), Error: fmt.Sprintf("invalid JSON input: %s", err)}
+				continue
+			}
+			inputs <- input
+		}
+		readErr <- s.Err()
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	enc := json.NewEncoder(out)
+	processed := 0
+	failed := 0
+	var writeErr error
+	for res := range results {
+		processed++
+		if res.Error != "" {
+			failed++
+		}
+		if writeErr == nil {
+			writeErr = enc.Encode(res)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d inputs processed, %d failed, %d skipped\n", processed, failed, skipped)
+	if err := <-readErr; err != nil {
+		return fmt.Errorf("error reading inputs: %s", err)
+	}
+	return writeErr
+}
+
+func batchCall(ctx *macaco.Context, fn string, input *batchInput, spread bool) *batchResult {
+	res := &batchResult{Line: input.line, Input: input.value}
+	funcArgs := []interface{}{input.value}
+	if items, ok := input.value.([]interface{}); ok && spread {
+		funcArgs = items
+	}
+	val, err := ctx.Call(fn, nil, funcArgs...)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Result = val.Interface()
+	// Make sure the result can be encoded, otherwise the
+	// whole line would be lost.
+	if _, err := json.Marshal(res.Result); err != nil {
+		res.Result = nil
+		res.Error = fmt.Sprintf("can't encode result as JSON: %s", err)
+	}
+	return res
+}
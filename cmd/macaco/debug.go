@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.net/websocket"
+	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
+)
+
+const (
+	debugListContext = 5
+	debugHelp        = `Commands:
+  b, break [file:]line    set a breakpoint
+  clear [file:]line       remove a breakpoint
+  bl, breakpoints         list breakpoints
+  c, continue             continue until the next breakpoint
+  s, step                 step into the next statement
+  n, next                 step over function calls
+  o, out                  step out of the current function
+  p, print <expr>         evaluate an expression in the current scope
+  locals                  print the local and closure variables
+  globals                 print the global variables
+  bt, backtrace           print the stack
+  l, list [[file:]line]   list the source around the current line
+  q, quit                 stop debugging
+  h, help                 show this help
+An empty line repeats the previous command.`
+)
+
+var (
+	debugCmd = &command.Cmd{
+		Name:    "debug",
+		Help:    "call a program function under the debugger",
+		Usage:   "[-break file:line,...] [-listen addr] [-json] <program-path> <function-name> [args...]",
+		Func:    debugCommand,
+		Options: &debugOptions{},
+	}
+	errDebugQuit = errors.New("quit")
+)
+
+type debugOptions struct {
+	Break  string `help:"Comma separated breakpoints to set before starting, as file:line. If empty, the program pauses at its first statement"`
+	Listen string `help:"Serve the debugger using a WebSocket JSON protocol at the given address (e.g. localhost:9229) rather than using the terminal. If the host is omitted, only loopback connections are accepted"`
+	JSON   bool   `help:"Parse function arguments as JSON values"`
+}
+
+type debugResult struct {
+	val *macaco.Value
+	err error
+}
+
+func debugCommand(args []string, opts *debugOptions) error {
+	if len(args) < 2 {
+		return errors.New("debug requires a program and a function name")
+	}
+	fn := args[1]
+	funcArgs, err := parseRunArgs(args[2:], opts.JSON, os.Stdin)
+	if err != nil {
+		return err
+	}
+	mopts.Instrument = true
+	if _, err := loadMacacoProgram(args); err != nil {
+		return err
+	}
+	ctx := mc.Context()
+	d := ctx.Debugger()
+	if opts.Break != "" {
+		for _, v := range strings.Split(opts.Break, ",") {
+			file, line, err := parseDebugLocation(strings.TrimSpace(v), nil)
+			if err != nil {
+				return err
+			}
+			if _, err := d.SetBreakpoint(file, line); err != nil {
+				return err
+			}
+		}
+	} else {
+		d.Pause()
+	}
+	if opts.Listen != "" {
+		return serveDebugger(opts.Listen, ctx, d, fn, funcArgs)
+	}
+	return debugTerminal(d, startDebugCall(ctx, fn, funcArgs))
+}
+
+func startDebugCall(ctx *macaco.Context, fn string, args []interface{}) <-chan *debugResult {
+	done := make(chan *debugResult, 1)
+	go func() {
+		val, err := ctx.Call(fn, nil, args...)
+		done <- &debugResult{val, err}
+	}()
+	return done
+}
+
+// parseDebugLocation parses a location in the form [file:]line. If
+// the file is omitted, the file from the pause is used.
+func parseDebugLocation(s string, cur *macaco.Pause) (string, int, error) {
+	var file string
+	if sep := strings.LastIndex(s, ":"); sep >= 0 {
+		file, s = s[:sep], s[sep+1:]
+	} else if cur != nil {
+		file = cur.File
+	} else {
+		return "", 0, fmt.Errorf("location %q must include the file", s)
+	}
+	line, err := strconv.Atoi(s)
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("invalid line %q", s)
+	}
+	return file, line, nil
+}
+
+func debugTerminal(d *macaco.Debugger, done <-chan *debugResult) error {
+	in := bufio.NewScanner(os.Stdin)
+	var prev string
+	for {
+		var cur *macaco.Pause
+		select {
+		case res := <-done:
+			if res.err != nil {
+				return fmt.Errorf("error: %s", errorDetails(res.err))
+			}
+			return printResult(res.val, "text")
+		case cur = <-d.Paused():
+		}
+		fmt.Printf("paused at %s:%d:%d", cur.File, cur.Line, cur.Column)
+		if cur.Function != "" {
+			fmt.Printf(" in %s", cur.Function)
+		}
+		fmt.Printf(" (%s)\n", cur.Reason)
+		printDebugSource(d, cur, cur.File, cur.Line, 0)
+		for resumed := false; !resumed; {
+			fmt.Print("(macaco) ")
+			if !in.Scan() {
+				fmt.Println()
+				return in.Err()
+			}
+			line := strings.TrimSpace(in.Text())
+			if line == "" {
+				line = prev
+			}
+			prev = line
+			var err error
+			if resumed, err = debugTerminalCommand(d, cur, line); err != nil {
+				if err == errDebugQuit {
+					return nil
+				}
+				fmt.Println("error:", err)
+			}
+		}
+	}
+}
+
+// debugTerminalCommand runs a command from the terminal, returning
+// true when the script has been resumed.
+func debugTerminalCommand(d *macaco.Debugger, cur *macaco.Pause, line string) (bool, error) {
+	if line == "" {
+		return false, nil
+	}
+	cmd, arg := line, ""
+	if sp := strings.IndexAny(line, " \t"); sp >= 0 {
+		cmd, arg = line[:sp], strings.TrimSpace(line[sp+1:])
+	}
+	switch cmd {
+	case "b", "break":
+		file, line, err := parseDebugLocation(arg, cur)
+		if err != nil {
+			return false, err
+		}
+		bp, err := d.SetBreakpoint(file, line)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("breakpoint set at %s:%d\n", bp.File, bp.Line)
+	case "clear":
+		file, line, err := parseDebugLocation(arg, cur)
+		if err != nil {
+			return false, err
+		}
+		return false, d.ClearBreakpoint(file, line)
+	case "bl", "breakpoints":
+		for _, v := range d.Breakpoints() {
+			fmt.Printf("%s:%d\n", v.File, v.Line)
+		}
+	case "c", "continue":
+		return true, d.Continue()
+	case "s", "step":
+		return true, d.StepIn()
+	case "n", "next":
+		return true, d.StepOver()
+	case "o", "out":
+		return true, d.StepOut()
+	case "p", "print":
+		if arg == "" {
+			return false, errors.New("print requires an expression")
+		}
+		v, err := d.Eval(arg)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("%s (%s)\n", v.Value, v.Type)
+	case "locals", "globals":
+		scopes, err := d.Scopes()
+		if err != nil {
+			return false, err
+		}
+		for _, s := range scopes {
+			if (s.Name == "global") != (cmd == "globals") {
+				continue
+			}
+			if s.Function != "" {
+				fmt.Printf("%s (%s):\n", s.Name, s.Function)
+			} else {
+				fmt.Printf("%s:\n", s.Name)
+			}
+			for _, v := range s.Variables {
+				fmt.Printf("  %s = %s (%s)\n", v.Name, v.Value, v.Type)
+			}
+		}
+	case "bt", "backtrace":
+		for ii, v := range cur.Stack {
+			fmt.Printf("#%d %s\n", ii, v)
+		}
+	case "l", "list":
+		file, line := cur.File, cur.Line
+		if arg != "" {
+			var err error
+			if file, line, err = parseDebugLocation(arg, cur); err != nil {
+				return false, err
+			}
+		}
+		printDebugSource(d, cur, file, line, debugListContext)
+	case "q", "quit":
+		return false, errDebugQuit
+	case "h", "help":
+		fmt.Println(debugHelp)
+	default:
+		return false, fmt.Errorf("unknown command %q, type h for help", cmd)
+	}
+	return false, nil
+}
+
+// printDebugSource prints the lines around line, marking the
+// current one with => and the ones with breakpoints with *.
+func printDebugSource(d *macaco.Debugger, cur *macaco.Pause, file string, line int, context int) {
+	src := d.Source(file)
+	if src == nil {
+		fmt.Printf("source for %s not available\n", file)
+		return
+	}
+	bps := make(map[int]bool)
+	for _, v := range d.Breakpoints() {
+		if v.File == file || strings.HasSuffix(v.File, "/"+file) {
+			bps[v.Line] = true
+		}
+	}
+	lines := bytes.Split(src, []byte{'\n'})
+	for ii := line - context; ii <= line+context; ii++ {
+		if ii < 1 || ii > len(lines) {
+			continue
+		}
+		mark := "  "
+		if ii == cur.Line && (file == cur.File || strings.HasSuffix(cur.File, "/"+file)) {
+			mark = "=>"
+		}
+		bp := " "
+		if bps[ii] {
+			bp = "*"
+		}
+		fmt.Printf("%s%s%4d  %s\n", bp, mark, ii, lines[ii-1])
+	}
+}
+
+// debugRequest is sent by WebSocket clients. Command is one of
+// setBreakpoint, clearBreakpoint, breakpoints, continue, stepIn,
+// stepOver, stepOut, pause, eval, scopes, files and source.
+type debugRequest struct {
+	ID         int    `json:"id"`
+	Command    string `json:"command"`
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// debugMessage is sent to WebSocket clients, either as a response
+// to a request (with the same ID) or as an event (paused or finished).
+type debugMessage struct {
+	ID     int         `json:"id,omitempty"`
+	Event  string      `json:"event,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// debugListenAddr returns the address the debugger listens at,
+// defaulting to the loopback interface when addr omits the host.
+func debugListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+// debugToken returns a random token used as part of the debugger
+// URL, so only whoever can read the startup message can attach.
+func debugToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// debugHandshake rejects requests coming from web browsers, which
+// always send an Origin header, so web pages can't drive the debugger.
+func debugHandshake(config *websocket.Config, r *http.Request) error {
+	if r.Header.Get("Origin") != "" {
+		return errors.New("debugger connections from web pages are not allowed")
+	}
+	return nil
+}
+
+func serveDebugger(addr string, ctx *macaco.Context, d *macaco.Debugger, fn string, args []interface{}) error {
+	token, err := debugToken()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", debugListenAddr(addr))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	p := "/debug/" + token
+	fmt.Fprintf(os.Stderr, "waiting for debugger at ws://%s%s\n", ln.Addr(), p)
+	finished := make(chan error, 1)
+	var mu sync.Mutex
+	attached := false
+	mux := http.NewServeMux()
+	mux.Handle(p, websocket.Server{
+		Handshake: debugHandshake,
+		Handler: func(ws *websocket.Conn) {
+			mu.Lock()
+			first := !attached
+			attached = true
+			mu.Unlock()
+			if !first {
+				websocket.JSON.Send(ws, &debugMessage{Error: "a debugger is already attached"})
+				return
+			}
+			// The program starts when the debugger attaches
+			finished <- debugSession(ws, d, startDebugCall(ctx, fn, args))
+		},
+	})
+	go http.Serve(ln, mux)
+	return <-finished
+}
+
+func debugSession(ws *websocket.Conn, d *macaco.Debugger, done <-chan *debugResult) error {
+	var mu sync.Mutex
+	send := func(msg *debugMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return websocket.JSON.Send(ws, msg)
+	}
+	go func() {
+		for {
+			var req debugRequest
+			if err := websocket.JSON.Receive(ws, &req); err != nil {
+				return
+			}
+			res, err := debugProtocolCommand(d, &req)
+			msg := &debugMessage{ID: req.ID, Result: res}
+			if err != nil {
+				msg.Error = err.Error()
+			}
+			if send(msg) != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case res := <-done:
+			msg := &debugMessage{Event: "finished"}
+			if res.err != nil {
+				msg.Error = errorDetails(res.err)
+			} else {
+				msg.Result = res.val.Interface()
+			}
+			return send(msg)
+		case pause := <-d.Paused():
+			if err := send(&debugMessage{Event: "paused", Result: pause}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func debugProtocolCommand(d *macaco.Debugger, req *debugRequest) (interface{}, error) {
+	switch req.Command {
+	case "setBreakpoint":
+		return d.SetBreakpoint(req.File, req.Line)
+	case "clearBreakpoint":
+		return nil, d.ClearBreakpoint(req.File, req.Line)
+	case "breakpoints":
+		return d.Breakpoints(), nil
+	case "continue":
+		return nil, d.Continue()
+	case "stepIn":
+		return nil, d.StepIn()
+	case "stepOver":
+		return nil, d.StepOver()
+	case "stepOut":
+		return nil, d.StepOut()
+	case "pause":
+		d.Pause()
+		return nil, nil
+	case "eval":
+		return d.Eval(req.Expression)
+	case "scopes":
+		return d.Scopes()
+	case "files":
+		return d.Files(), nil
+	case "source":
+		src := d.Source(req.File)
+		if src == nil {
+			return nil, fmt.Errorf("unknown file %s", req.File)
+		}
+		return string(src), nil
+	}
+	return nil, fmt.Errorf("unknown command %q", req.Command)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
+)
+
+var (
+	initCmd = &command.Cmd{
+		Name:    "init",
+		Help:    "create a new program in a directory with the given name",
+		Usage:   "[-template program] <name>",
+		Func:    initCommand,
+		Options: &initOptions{},
+	}
+)
+
+type initOptions struct {
+	Template string `help:"Generate the program from the given template program, which must define a __template(name) function returning an object with file names as keys and their contents as values"`
+}
+
+// manifest is written to macaco.json when initializing a program
+type manifest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+const (
+	manifestFile  = "macaco.json"
+	starterScript = `// %[1]s entry point. Run it with:
+//
+//	macaco run %[1]s hello [who]
+function hello(who) {
+    return 'Hello, ' + (who || 'world') + '!';
+}
+`
+	starterTest = `// Functions starting with __test are run by:
+//
+//	macaco test %[1]s
+//
+// A test fails when it throws an exception or writes to stderr.
+function __testHello() {
+    var got = hello('macaco');
+    if (got !== 'Hello, macaco!') {
+        console.error('unexpected greeting: ' + got);
+    }
+}
+`
+	starterIgnore = `# Patterns for files which are not loaded nor uploaded, one per line.
+# Patterns ending with / match only directories.
+node_modules/
+`
+)
+
+func starterFiles(name string) (map[string]string, error) {
+	m := &manifest{Name: name, Version: "0.1.0"}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"main.js":         fmt.Sprintf(starterScript, name),
+		"main_test.js":    fmt.Sprintf(starterTest, name),
+		manifestFile:      string(data) + "\n",
+		macaco.IgnoreFile: starterIgnore,
+	}, nil
+}
+
+func templateFiles(name string, template string) (map[string]string, error) {
+	m, err := macaco.New(mopts)
+	if err != nil {
+		return nil, err
+	}
+	ctx := m.Context()
+	if err := ctx.Load(template); err != nil {
+		return nil, fmt.Errorf("error loading template %s: %s", template, err)
+	}
+	val, err := ctx.Call("__template", nil, name)
+	if err != nil {
+		return nil, fmt.Errorf("error calling __template in %s: %s", template, err)
+	}
+	obj, ok := val.Interface().(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("__template in %s must return an object, got %v", template, val)
+	}
+	files := make(map[string]string, len(obj))
+	for k, v := range obj {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("contents of %s returned by %s must be a string", k, template)
+		}
+		files[k] = s
+	}
+	return files, nil
+}
+
+func initCommand(args []string, opts *initOptions) error {
+	if len(args) != 1 {
+		return errors.New("init requires exactly one program name")
+	}
+	name := args[0]
+	if !macaco.ProgramNameIsValid(name) {
+		return fmt.Errorf("program name %q is not valid, it must start with a letter or number and contain only letters, numbers and -", name)
+	}
+	if _, err := os.Stat(name); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+	var files map[string]string
+	var err error
+	if opts.Template != "" {
+		files, err = templateFiles(name, opts.Template)
+	} else {
+		files, err = starterFiles(name)
+	}
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for k := range files {
+		p := filepath.Clean(filepath.FromSlash(k))
+		if filepath.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name %q", k)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		p := filepath.Join(name, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(files[k]), 0644); err != nil {
+			return err
+		}
+		fmt.Println("created", p)
+	}
+	return nil
+}
@@ -10,25 +10,29 @@ import (
 )
 
 var (
-	mc *macaco.Macaco
+	mc    *macaco.Macaco
+	mopts *macaco.Options
+	// logPrefix is true when log messages should be
+	// prefixed with the program name.
+	logPrefix bool
 )
 
 type globalOptions struct {
-	Token   string `name:"t" help:"Access token for the macaco.io service"`
+	Token   string `name:"t" help:"Access token or token name for the macaco.io service"`
 	Bare    bool   `help:"Use a bare macaco runtime"`
 	Runtime string `name:"rt" help:"Macaco runtime to use"`
 	Verbose bool   `name:"v" help:"Verbose output"`
+	LogJSON bool   `name:"logjson" help:"Write log messages as JSON lines"`
+	Prefix  bool   `help:"Prefix log messages with the program name"`
 }
 
-func newMacaco(opts *macaco.Options) *macaco.Macaco {
-	m, err := macaco.New(opts)
-	if err != nil {
-		panic(err)
-	}
-	return m
+func loadMacacoProgram(args []string) (string, error) {
+	return setupMacacoProgram(args, nil)
 }
 
-func loadMacacoProgram(args []string) (string, error) {
+// setupMacacoProgram works like loadMacacoProgram, but calls setup
+// with a copy of the root Context before loading the program.
+func setupMacacoProgram(args []string, setup func(ctx *macaco.Context)) (string, error) {
 	var prog, name string
 	if len(args) > 0 {
 		prog = args[0]
@@ -41,6 +45,16 @@ func loadMacacoProgram(args []string) (string, error) {
 			name = filepath.Base(abs)
 		}
 	}
+	if logPrefix {
+		mopts.LogPrefix = name
+	}
+	var err error
+	if mc, err = macaco.New(mopts); err != nil {
+		return "", fmt.Errorf("error initializing macaco: %s", err)
+	}
+	if setup != nil {
+		setup(mc.Context())
+	}
 	if err := mc.Load(prog); err != nil {
 		return "", fmt.Errorf("error loading program %s: %s", prog, err)
 	}
@@ -52,17 +66,40 @@ func main() {
 		runCmd,
 		uploadCmd,
 		testCmd,
+		registryServerCmd,
+		loginCmd,
+		logoutCmd,
+		tokensCmd,
+		initCmd,
+		batchCmd,
+		debugCmd,
+	}
+	// Configuration files and environment provide the defaults,
+	// which can be overridden by the global flags.
+	var err error
+	if mopts, err = macaco.LoadOptions(); err != nil {
+		command.Exit(fmt.Errorf("error loading configuration: %s", err))
+		return
+	}
+	gopts := &globalOptions{
+		Token:   mopts.Token,
+		Bare:    mopts.Bare,
+		Runtime: mopts.Runtime,
+		Verbose: mopts.Verbose,
+		LogJSON: mopts.LogJSON,
 	}
 	opts := &command.Options{
-		Options: &globalOptions{},
+		Options: gopts,
 		Func: func(opts *globalOptions) {
-			mopts := &macaco.Options{
-				Bare:    opts.Bare,
-				Runtime: opts.Runtime,
-				Token:   opts.Token,
-				Verbose: opts.Verbose,
-			}
-			mc = newMacaco(mopts)
+			// Macaco is initialized lazily by loadMacacoProgram, so
+			// commands which don't run programs don't need to load
+			// the runtime.
+			mopts.Bare = opts.Bare
+			mopts.Runtime = opts.Runtime
+			mopts.Token = opts.Token
+			mopts.Verbose = opts.Verbose
+			mopts.LogJSON = opts.LogJSON
+			logPrefix = opts.Prefix
 		},
 	}
 	command.Exit(command.RunOpts(nil, opts, commands))
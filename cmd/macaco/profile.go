@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"macaco.io/macaco"
+)
+
+// startProfile starts profiling the given Context, returning
+// nil if filename is empty.
+func startProfile(ctx *macaco.Context, filename string) *macaco.Profile {
+	if filename == "" {
+		return nil
+	}
+	return ctx.StartProfile()
+}
+
+// finishProfile stops the profile, printing its summary to the
+// standard error and writing it in pprof format to filename.
+func finishProfile(prof *macaco.Profile, filename string) error {
+	if prof == nil {
+		return nil
+	}
+	prof.Stop()
+	fmt.Fprintln(os.Stderr)
+	if err := prof.WriteSummary(os.Stderr); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := prof.WritePprof(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing profile: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\nprofile written to %s, use go tool pprof %s to analyze it\n", filename, filename)
+	return nil
+}
+
+// finishCoverage stops recording coverage, printing its summary
+// and writing the reports requested in opts.
+func finishCoverage(cov *macaco.Coverage, opts *testOptions) error {
+	cov.Stop()
+	fmt.Println("coverage:")
+	if err := cov.WriteSummary(os.Stdout); err != nil {
+		return err
+	}
+	reports := []struct {
+		filename string
+		write    func(io.Writer) error
+	}{
+		{opts.CoverHTML, cov.WriteHTML},
+		{opts.CoverLcov, cov.WriteLcov},
+	}
+	for _, v := range reports {
+		if v.filename == "" {
+			continue
+		}
+		f, err := os.Create(v.filename)
+		if err != nil {
+			return err
+		}
+		if err := v.write(f); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing coverage to %s: %s", v.filename, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("coverage written to %s\n", v.filename)
+	}
+	return nil
+}
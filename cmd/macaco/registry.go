@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
+)
+
+var (
+	registryServerCmd = &command.Cmd{
+		Name:    "registry-server",
+		Help:    "serve a local program registry implementing the macaco.io API",
+		Usage:   "[-addr address] [-dir directory] -tokens user:token,...",
+		Func:    registryServerCommand,
+		Options: &registryServerOptions{Addr: "localhost:8080", Dir: "registry"},
+	}
+)
+
+type registryServerOptions struct {
+	Addr   string `help:"Address to listen on"`
+	Dir    string `help:"Directory where programs are stored"`
+	Tokens string `help:"Comma separated list of user:token pairs which are allowed to upload programs"`
+}
+
+func parseRegistryTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		sep := strings.IndexByte(v, ':')
+		if sep <= 0 || sep == len(v)-1 {
+			return nil, fmt.Errorf("invalid user:token pair %q", v)
+		}
+		tokens[v[sep+1:]] = v[:sep]
+	}
+	return tokens, nil
+}
+
+func registryServerCommand(args []string, opts *registryServerOptions) error {
+	tokens, err := parseRegistryTokens(opts.Tokens)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		fmt.Fprintln(os.Stderr, "warning: no tokens provided, uploads will be rejected")
+	}
+	fmt.Printf("serving registry from %s at http://%s - set MACACO_API=http://%s to use it\n", opts.Dir, opts.Addr, opts.Addr)
+	return http.ListenAndServe(opts.Addr, macaco.NewRegistry(opts.Dir, tokens))
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"gopkgs.com/command.v1"
 
@@ -13,18 +13,49 @@ import (
 
 var (
 	runCmd = &command.Cmd{
-		Name:  "run",
-		Help:  "run the specified program name",
-		Usage: "<program-path> [function-name] [args...]",
-		Func:  runCommand,
+		Name:    "run",
+		Help:    "run the specified program name",
+		Usage:   "[-json] [-o text|json] <program-path> [function-name] [args... | @file.json | - | --name=value...]",
+		Func:    runCommand,
+		Options: &runOptions{},
 	}
 )
 
-func runCommand(args []string) error {
+type runOptions struct {
+	Watch   bool   `help:"Watch the program files and run again every time they change"`
+	JSON    bool   `help:"Parse function arguments as JSON values"`
+	Output  string `name:"o" help:"Result output format, either text or json"`
+	Profile string `help:"Profile the function call, writing a pprof profile to the given file and printing a summary"`
+}
+
+func runCommand(args []string, opts *runOptions) error {
+	if opts.Output != "" && opts.Output != "text" && opts.Output != "json" {
+		return fmt.Errorf("invalid output format %q, must be text or json", opts.Output)
+	}
+	if opts.Watch {
+		var extra []string
+		if len(args) > 1 && filepath.Ext(args[1]) == ".js" {
+			extra = append(extra, args[1])
+		}
+		// loadMacacoProgram creates a new Macaco on every call,
+		// so each run starts with a fresh runtime.
+		return watch(programPath(args), extra, func() error {
+			return runProgram(args, opts)
+		})
+	}
+	return runProgram(args, opts)
+}
+
+func runProgram(args []string, opts *runOptions) error {
+	if opts.Profile != "" {
+		mopts.Instrument = true
+	}
 	if _, err := loadMacacoProgram(args); err != nil {
 		return err
 	}
 	if len(args) > 1 {
+		ctx := mc.Context()
+		prof := startProfile(ctx, opts.Profile)
 		call := args[1]
 		var funcArgs []interface{}
 		var val *macaco.Value
@@ -32,30 +63,51 @@ func runCommand(args []string) error {
 		file := false
 		if filepath.Ext(call) == ".js" {
 			file = true
-			f, err := os.Open(call)
-			if err != nil {
-				panic(err)
+			var f *os.File
+			if f, err = os.Open(call); err != nil {
+				return err
 			}
 			defer f.Close()
-			val, err = mc.Context().Run(f)
+			val, err = ctx.Run(f)
 		} else {
-			for ii := 2; ii < len(args); ii++ {
-				v := args[ii]
-				if n, err := strconv.ParseFloat(v, 64); err == nil {
-					funcArgs = append(funcArgs, n)
-				} else {
-					funcArgs = append(funcArgs, v)
-				}
+			funcArgs, err = parseRunArgs(args[2:], opts.JSON, os.Stdin)
+			if err != nil {
+				return err
 			}
-			val, err = mc.Context().Call(call, nil, funcArgs...)
+			val, err = ctx.Call(call, nil, funcArgs...)
+		}
+		if perr := finishProfile(prof, opts.Profile); perr != nil {
+			return perr
 		}
 		if err != nil {
 			if file {
-				return fmt.Errorf("error running %s: %s", call, err)
+				return fmt.Errorf("error running %s: %s", call, errorDetails(err))
 			}
-			return fmt.Errorf("error calling %s with arguments %v: %s", call, funcArgs, err)
+			return fmt.Errorf("error calling %s with arguments %v: %s", call, funcArgs, errorDetails(err))
+		}
+		return printResult(val, opts.Output)
+	}
+	return nil
+}
+
+func printResult(val *macaco.Value, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(val.Interface(), "", "    ")
+		if err != nil {
+			return fmt.Errorf("error encoding result as JSON: %s", err)
 		}
-		fmt.Printf("result %v\n", val.Interface())
+		fmt.Println(string(data))
+		return nil
 	}
+	fmt.Printf("result %v\n", val.Interface())
 	return nil
 }
+
+// errorDetails returns the error message including
+// the stack trace for errors thrown by scripts.
+func errorDetails(err error) string {
+	if se, ok := err.(*macaco.ScriptError); ok && len(se.Stack) > 0 {
+		return se.String()
+	}
+	return err.Error()
+}
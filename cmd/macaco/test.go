@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"sort"
 
 	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
 )
 
 var (
@@ -18,13 +21,20 @@ var (
 )
 
 type testOptions struct {
-	Run string `help:"Only run tests with names matching the given pattern"`
+	Run       string `help:"Only run tests with names matching the given pattern"`
+	Watch     bool   `help:"Watch the program files and run the tests again every time they change"`
+	Bench     string `help:"Run the benchmarks (functions starting with __bench) with names matching the given pattern after the tests"`
+	Profile   string `help:"Profile the tests, writing a pprof profile to the given file and printing a summary"`
+	Cover     bool   `help:"Print the line coverage of the program files, excluding the ones ending with _test.js"`
+	CoverHTML string `name:"coverhtml" help:"Write an HTML coverage report to the given file. Implies -cover"`
+	CoverLcov string `name:"coverlcov" help:"Write the coverage in lcov format to the given file. Implies -cover"`
+}
+
+func (o *testOptions) cover() bool {
+	return o.Cover || o.CoverHTML != "" || o.CoverLcov != ""
 }
 
 func testCommand(args []string, opts *testOptions) error {
-	if _, err := loadMacacoProgram(args); err != nil {
-		return err
-	}
 	var re *regexp.Regexp
 	var err error
 	if opts.Run != "" {
@@ -33,9 +43,58 @@ func testCommand(args []string, opts *testOptions) error {
 			return fmt.Errorf("invalid pattern %q: %s", opts.Run, err)
 		}
 	}
-	results, err := mc.Context().RunTests(re)
+	if opts.Bench != "" {
+		if _, err := regexp.Compile(opts.Bench); err != nil {
+			return fmt.Errorf("invalid benchmark pattern %q: %s", opts.Bench, err)
+		}
+	}
+	if opts.Watch {
+		var prev []*macaco.Test
+		return watch(programPath(args), nil, func() error {
+			results, err := runTests(args, re, opts)
+			if err != nil {
+				return err
+			}
+			if prev != nil {
+				printTestsDiff(prev, results)
+			}
+			prev = results
+			return nil
+		})
+	}
+	_, err = runTests(args, re, opts)
+	return err
+}
+
+func runTests(args []string, re *regexp.Regexp, opts *testOptions) ([]*macaco.Test, error) {
+	if opts.Profile != "" || opts.cover() {
+		mopts.Instrument = true
+	}
+	var cov *macaco.Coverage
+	setup := func(ctx *macaco.Context) {
+		if opts.cover() {
+			cov = ctx.StartCoverage()
+		}
+	}
+	if _, err := setupMacacoProgram(args, setup); err != nil {
+		return nil, err
+	}
+	ctx := mc.Context()
+	prof := startProfile(ctx, opts.Profile)
+	results, err := ctx.RunTests(re)
+	if err == nil && opts.Bench != "" {
+		_, err = ctx.RunBenchmarks(regexp.MustCompile(opts.Bench), 0)
+	}
+	if perr := finishProfile(prof, opts.Profile); perr != nil {
+		return nil, perr
+	}
+	if cov != nil {
+		if cerr := finishCoverage(cov, opts); cerr != nil {
+			return nil, cerr
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("error running tests: %v", err)
+		return nil, fmt.Errorf("error running tests: %v", err)
 	}
 	passed := 0
 	failed := 0
@@ -51,5 +110,43 @@ func testCommand(args []string, opts *testOptions) error {
 		fmt.Print(" - run with -v for more details")
 	}
 	fmt.Print("\n")
-	return nil
+	return results, nil
+}
+
+// printTestsDiff prints the tests which changed their
+// status, were added or were removed between two runs.
+func printTestsDiff(prev []*macaco.Test, cur []*macaco.Test) {
+	before := make(map[string]bool, len(prev))
+	for _, v := range prev {
+		before[v.Name] = v.Passed()
+	}
+	var changes []string
+	seen := make(map[string]bool, len(cur))
+	for _, v := range cur {
+		seen[v.Name] = true
+		passed, ok := before[v.Name]
+		switch {
+		case !ok && v.Passed():
+			changes = append(changes, "new, passing: "+v.Name)
+		case !ok:
+			changes = append(changes, "new, failing: "+v.Name)
+		case passed && !v.Passed():
+			changes = append(changes, "now failing: "+v.Name)
+		case !passed && v.Passed():
+			changes = append(changes, "now passing: "+v.Name)
+		}
+	}
+	for _, v := range prev {
+		if !seen[v.Name] {
+			changes = append(changes, "removed: "+v.Name)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("no changes in test results")
+		return
+	}
+	sort.Strings(changes)
+	for _, v := range changes {
+		fmt.Println("\t" + v)
+	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkgs.com/command.v1"
+
+	"macaco.io/macaco"
+)
+
+var (
+	loginCmd = &command.Cmd{
+		Name:    "login",
+		Help:    "store a named macaco.io access token in ~/.macaco/tokens",
+		Usage:   "<name> [token]",
+		Func:    loginCommand,
+		Options: &loginOptions{},
+	}
+	logoutCmd = &command.Cmd{
+		Name:  "logout",
+		Help:  "remove a named access token from ~/.macaco/tokens",
+		Usage: "<name>",
+		Func:  logoutCommand,
+	}
+	tokensCmd = &command.Cmd{
+		Name:  "tokens",
+		Help:  "list the stored access tokens",
+		Usage: "",
+		Func:  tokensCommand,
+	}
+)
+
+type loginOptions struct {
+	Default bool `help:"Make this token the default one"`
+}
+
+func loginCommand(args []string, opts *loginOptions) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("login requires a token name and, optionally, the token")
+	}
+	name := args[0]
+	var token string
+	if len(args) > 1 {
+		token = args[1]
+	} else {
+		fmt.Printf("token for %s: ", name)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("error reading token: %s", err)
+		}
+		token = strings.TrimSpace(line)
+	}
+	tokens, err := macaco.LoadTokens()
+	if err != nil {
+		return err
+	}
+	if err := tokens.Set(name, token); err != nil {
+		return err
+	}
+	if opts.Default || tokens.Default == "" {
+		tokens.Default = name
+	}
+	return tokens.Save()
+}
+
+func logoutCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("logout requires a token name")
+	}
+	tokens, err := macaco.LoadTokens()
+	if err != nil {
+		return err
+	}
+	if !tokens.Remove(args[0]) {
+		return fmt.Errorf("no token named %s", args[0])
+	}
+	return tokens.Save()
+}
+
+func maskToken(tok string) string {
+	if len(tok) <= 4 {
+		return strings.Repeat("*", len(tok))
+	}
+	return strings.Repeat("*", len(tok)-4) + tok[len(tok)-4:]
+}
+
+func tokensCommand(args []string) error {
+	tokens, err := macaco.LoadTokens()
+	if err != nil {
+		return err
+	}
+	for _, name := range tokens.Names() {
+		tok, _ := tokens.Get(name)
+		marker := " "
+		if name == tokens.Default {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\t%s\n", marker, name, maskToken(tok))
+	}
+	if env := os.Getenv(macaco.TokenEnvVar); env != "" {
+		fmt.Printf("%s is set and overrides the default token\n", macaco.TokenEnvVar)
+	}
+	return nil
+}
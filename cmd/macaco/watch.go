@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"macaco.io/macaco"
+)
+
+const (
+	// watchInterval is the interval between checks for changes
+	watchInterval = 300 * time.Millisecond
+	// watchDebounce is the time without further changes we wait
+	// for before reloading, so editors writing several files (or
+	// the same file several times) only trigger a single reload.
+	watchDebounce = 200 * time.Millisecond
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// programPath returns the local path for the program given
+// in the command arguments.
+func programPath(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return "."
+}
+
+func snapshotFiles(prog string, extra []string) map[string]fileStamp {
+	files, _ := macaco.ListProgramFiles(prog)
+	files = append(files, extra...)
+	stamps := make(map[string]fileStamp, len(files))
+	for _, v := range files {
+		if st, err := os.Stat(v); err == nil {
+			stamps[v] = fileStamp{st.ModTime(), st.Size()}
+		}
+	}
+	return stamps
+}
+
+func stampsEqual(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForChanges blocks until the files in the program or the given extra
+// files change, added or removed and then stay unchanged for watchDebounce.
+func waitForChanges(prog string, extra []string) {
+	prev := snapshotFiles(prog, extra)
+	for {
+		time.Sleep(watchInterval)
+		cur := snapshotFiles(prog, extra)
+		if stampsEqual(prev, cur) {
+			continue
+		}
+		for {
+			time.Sleep(watchDebounce)
+			next := snapshotFiles(prog, extra)
+			if stampsEqual(cur, next) {
+				return
+			}
+			cur = next
+		}
+	}
+}
+
+// watch calls f and then calls it again every time the local program
+// at prog or the extra files change. Errors returned by f are printed,
+// but don't stop watching.
+func watch(prog string, extra []string, f func() error) error {
+	if _, err := os.Stat(prog); err != nil {
+		return fmt.Errorf("can't watch %s, -watch requires a local program: %s", prog, err)
+	}
+	for {
+		if err := f(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "watching %s for changes...\n", prog)
+		waitForChanges(prog, extra)
+		fmt.Fprintf(os.Stderr, "\nchanges detected, reloading %s at %s\n", prog, time.Now().Format("15:04:05"))
+	}
+}
@@ -0,0 +1,141 @@
+package macaco
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// APIEnvVar is the environment variable which overrides
+	// the API URL.
+	APIEnvVar = "MACACO_API"
+)
+
+// LoadOptions returns the Options specified by the configuration files
+// and the environment. Options are read, in increasing order of priority,
+// from ~/.macaco/config, the .macaco/config file found in the current
+// directory or its closest parent and the MACACO_API and MACACO_TOKEN
+// environment variables. If no configuration is found, the returned
+// Options are empty, which makes New use its defaults.
+//
+// Configuration files contain one key = value pair per line. Empty lines
+// and lines starting with # are ignored. Recognized keys are:
+//
+//	api                    URL of the program API
+//	token                  token or token name, see Options.Token
+//	runtime                runtime loaded by default, see Options.Runtime
+//	bare                   true to not load any runtime
+//	verbose                true to enable verbose output
+//	proxy                  URL of the proxy used for HTTP requests
+//	user_agent             User-Agent header sent in HTTP requests
+//	log_json               true to write log messages as JSON lines
+//	cache_max_age          maximum time responses are cached (e.g. 1h30m)
+//	cache_max_entry_size   maximum size in bytes of cached responses
+func LoadOptions() (*Options, error) {
+	opts := new(Options)
+	var files []string
+	if dir, err := macacoDir(); err == nil {
+		files = append(files, filepath.Join(dir, "config"))
+	}
+	if p := projectConfigPath(); p != "" && (len(files) == 0 || p != files[0]) {
+		files = append(files, p)
+	}
+	for _, v := range files {
+		if err := loadOptionsFile(v, opts); err != nil {
+			return nil, err
+		}
+	}
+	if api := os.Getenv(APIEnvVar); api != "" {
+		opts.API = api
+	}
+	if tok := os.Getenv(TokenEnvVar); tok != "" {
+		opts.Token = tok
+	}
+	return opts, nil
+}
+
+// projectConfigPath returns the path of the .macaco/config
+// file closest to the current directory or an empty string
+// if there's none.
+func projectConfigPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, ".macaco", "config")
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func loadOptionsFile(filename string, opts *Options) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		sep := strings.IndexByte(line, '=')
+		if sep < 0 {
+			return fmt.Errorf("%s:%d: invalid line %q, must be key = value", filename, lineno, line)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+		if err := setOption(opts, key, value); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineno, err)
+		}
+	}
+	return s.Err()
+}
+
+func setOption(opts *Options, key string, value string) error {
+	var err error
+	switch key {
+	case "api":
+		opts.API = value
+	case "token":
+		opts.Token = value
+	case "runtime":
+		opts.Runtime = value
+	case "bare":
+		opts.Bare, err = strconv.ParseBool(value)
+	case "verbose":
+		opts.Verbose, err = strconv.ParseBool(value)
+	case "proxy":
+		opts.Proxy = value
+	case "user_agent":
+		opts.UserAgent = value
+	case "log_json":
+		opts.LogJSON, err = strconv.ParseBool(value)
+	case "cache_max_age":
+		opts.CacheMaxAge, err = time.ParseDuration(value)
+	case "cache_max_entry_size":
+		opts.CacheMaxEntrySize, err = strconv.ParseInt(value, 10, 64)
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", value, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package macaco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadOptionsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macaco-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "config")
+	const config = `
+# comment
+api = http://localhost:8080
+runtime=my/runtime
+verbose = true
+user_agent = bot/1.0 (+http://example.com)
+cache_max_age = 1h30m
+cache_max_entry_size = 1024
+`
+	if err := ioutil.WriteFile(p, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Token: "tok"}
+	if err := loadOptionsFile(p, opts); err != nil {
+		t.Fatal(err)
+	}
+	expect := Options{
+		Token:             "tok",
+		Runtime:           "my/runtime",
+		Verbose:           true,
+		API:               "http://localhost:8080",
+		UserAgent:         "bot/1.0 (+http://example.com)",
+		CacheMaxAge:       90 * time.Minute,
+		CacheMaxEntrySize: 1024,
+	}
+	if !reflect.DeepEqual(*opts, expect) {
+		t.Errorf("expecting options %+v, got %+v", expect, *opts)
+	}
+	if err := ioutil.WriteFile(p, []byte("bare = maybe\n"), 0644); err == nil {
+		if err := loadOptionsFile(p, opts); err == nil {
+			t.Error("expecting an error with an invalid boolean")
+		}
+	}
+	if err := ioutil.WriteFile(p, []byte("foo = bar\n"), 0644); err == nil {
+		if err := loadOptionsFile(p, opts); err == nil {
+			t.Error("expecting an error with an unknown option")
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package macaco
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rainycape/otto"
+)
+
+const (
+	// consoleDepth is the maximum depth used when
+	// formatting nested objects and arrays.
+	consoleDepth     = 2
+	consoleIndent    = "  "
+	consoleDefault   = "default"
+	consoleTraceFile = "<console>"
+)
+
+var (
+	consoleIdentifierRe = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+	consoleFunctionRe   = regexp.MustCompile(`^function\s+([A-Za-z_$][A-Za-z0-9_$]*)`)
+)
+
+// console implements the browser console API. Its
+// state is not shared between Context copies.
+type console struct {
+	c      *Context
+	groups int
+	counts map[string]int
+	timers map[string]time.Time
+}
+
+func (c *Context) loadConsole() {
+	cons := &console{
+		c:      c,
+		counts: make(map[string]int),
+		timers: make(map[string]time.Time),
+	}
+	obj, err := c.vm.Object("this.console = this.console || new Object()")
+	if err != nil {
+		panic(err)
+	}
+	obj.Set("log", cons.logger(LogInfo))
+	obj.Set("info", cons.logger(LogInfo))
+	obj.Set("debug", cons.logger(LogDebug))
+	obj.Set("warn", cons.logger(LogWarn))
+	obj.Set("error", cons.logger(LogError))
+	obj.Set("dirxml", cons.logger(LogInfo))
+	obj.Set("dir", cons.dir)
+	obj.Set("trace", cons.trace)
+	obj.Set("assert", cons.assert)
+	obj.Set("count", cons.count)
+	obj.Set("countReset", cons.countReset)
+	obj.Set("time", cons.time)
+	obj.Set("timeLog", cons.timeLog)
+	obj.Set("timeEnd", cons.timeEnd)
+	obj.Set("group", cons.group)
+	obj.Set("groupCollapsed", cons.group)
+	obj.Set("groupEnd", cons.groupEnd)
+	obj.Set("table", cons.table)
+	for _, v := range []string{"clear", "profile", "profileEnd", "timeStamp"} {
+		obj.Set(v, func(call otto.FunctionCall) otto.Value { return otto.UndefinedValue() })
+	}
+	// Go style formatting, kept for compatibility
+	obj.Set("debugf", c.Debugf)
+	obj.Set("logf", c.Logf)
+	obj.Set("errorf", c.Errorf)
+}
+
+// print logs text, indenting every line by the current group depth.
+func (cons *console) print(level LogLevel, text string) {
+	if cons.groups > 0 {
+		indent := strings.Repeat(consoleIndent, cons.groups)
+		text = indent + strings.Replace(text, "\n", "\n"+indent, -1)
+	}
+	cons.c.log(level, text+"\n", nil)
+}
+
+func (cons *console) logger(level LogLevel) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		cons.print(level, cons.format(call.ArgumentList))
+		return otto.UndefinedValue()
+	}
+}
+
+// format formats the arguments like browsers do: if the first argument
+// is a string, it might contain substitutions (%s, %d, %i, %f, %o, %O
+// and %c) which consume the following arguments. The rest of arguments
+// are appended, separated by spaces.
+func (cons *console) format(args []otto.Value) string {
+	var buf bytes.Buffer
+	if len(args) > 0 && args[0].IsString() {
+		f := args[0].String()
+		args = args[1:]
+		for ii := 0; ii < len(f); ii++ {
+			if f[ii] != '%' || ii == len(f)-1 {
+				buf.WriteByte(f[ii])
+				continue
+			}
+			verb := f[ii+1]
+			if verb == '%' {
+				buf.WriteByte('%')
+				ii++
+				continue
+			}
+			if len(args) == 0 || strings.IndexByte("sdifoOc", verb) < 0 {
+				buf.WriteByte('%')
+				continue
+			}
+			arg := args[0]
+			args = args[1:]
+			ii++
+			switch verb {
+			case 's':
+				if arg.IsString() {
+					buf.WriteString(arg.String())
+				} else {
+					buf.WriteString(cons.inspect(arg, 1, false))
+				}
+			case 'd', 'i':
+				buf.WriteString(formatConsoleNumber(arg, true))
+			case 'f':
+				buf.WriteString(formatConsoleNumber(arg, false))
+			case 'o', 'O':
+				buf.WriteString(cons.inspect(arg, 0, true))
+			case 'c':
+				// CSS, ignored
+			}
+		}
+		if len(args) > 0 {
+			buf.WriteByte(' ')
+		}
+	}
+	for ii, v := range args {
+		if ii > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(cons.inspect(v, 0, false))
+	}
+	return buf.String()
+}
+
+func formatConsoleNumber(v otto.Value, integer bool) string {
+	if !v.IsNumber() && !v.IsString() {
+		return "NaN"
+	}
+	f, err := v.ToFloat()
+	if err != nil || math.IsNaN(f) {
+		return "NaN"
+	}
+	if math.IsInf(f, 0) {
+		if f > 0 {
+			return "Infinity"
+		}
+		return "-Infinity"
+	}
+	if integer {
+		f = math.Trunc(f)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// inspect returns a human readable representation of v. Strings
+// are quoted when they're nested inside other values or quote
+// is true.
+func (cons *console) inspect(v otto.Value, depth int, quote bool) string {
+	switch {
+	case v.IsString():
+		if depth > 0 || quote {
+			s := strings.Replace(v.String(), `\`, `\\`, -1)
+			return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+		}
+		return v.String()
+	case v.IsFunction():
+		name := ""
+		if n, err := v.Object().Get("name"); err == nil && n.IsString() {
+			name = n.String()
+		} else if m := consoleFunctionRe.FindStringSubmatch(v.String()); m != nil {
+			name = m[1]
+		}
+		if name == "" {
+			return "[Function (anonymous)]"
+		}
+		return "[Function: " + name + "]"
+	case !v.IsObject():
+		return v.String()
+	}
+	obj := v.Object()
+	switch obj.Class() {
+	case "Array":
+		if depth > consoleDepth {
+			return "[Array]"
+		}
+		length, _ := obj.Get("length")
+		n, _ := length.ToInteger()
+		if n == 0 {
+			return "[]"
+		}
+		items := make([]string, n)
+		for ii := range items {
+			item, _ := obj.Get(strconv.Itoa(ii))
+			items[ii] = cons.inspect(item, depth+1, true)
+		}
+		return "[ " + strings.Join(items, ", ") + " ]"
+	case "Error":
+		if depth > 0 {
+			return "[" + v.String() + "]"
+		}
+		return v.String()
+	case "Date":
+		if s, err := obj.Call("toISOString"); err == nil {
+			return s.String()
+		}
+		return v.String()
+	case "RegExp", "Boolean", "Number", "String":
+		return v.String()
+	}
+	if depth > consoleDepth {
+		return "[Object]"
+	}
+	keys := obj.Keys()
+	if len(keys) == 0 {
+		return "{}"
+	}
+	items := make([]string, len(keys))
+	for ii, k := range keys {
+		val, _ := obj.Get(k)
+		if !consoleIdentifierRe.MatchString(k) {
+			k = "'" + k + "'"
+		}
+		items[ii] = k + ": " + cons.inspect(val, depth+1, true)
+	}
+	return "{ " + strings.Join(items, ", ") + " }"
+}
+
+func (cons *console) label(call otto.FunctionCall) string {
+	if arg := call.Argument(0); !arg.IsUndefined() {
+		return arg.String()
+	}
+	return consoleDefault
+}
+
+func (cons *console) dir(call otto.FunctionCall) otto.Value {
+	cons.print(LogInfo, cons.inspect(call.Argument(0), 0, true))
+	return otto.UndefinedValue()
+}
+
+func (cons *console) trace(call otto.FunctionCall) otto.Value {
+	var buf bytes.Buffer
+	buf.WriteString("Trace")
+	if msg := cons.format(call.ArgumentList); msg != "" {
+		buf.WriteString(": ")
+		buf.WriteString(msg)
+	}
+	// Throw an error to capture the current stack
+	if script, err := cons.c.vm.Compile(consoleTraceFile, "throw new Error()"); err == nil {
+		if _, err := cons.c.vm.Run(script); err != nil {
+			se := cons.c.scriptError(err)
+			stack := se.Stack
+			// Skip the thrown error and this function
+			for len(stack) > 0 && (stack[0].Native || stack[0].File == consoleTraceFile) {
+				stack = stack[1:]
+			}
+			for _, v := range stack {
+				buf.WriteString("\n    at ")
+				buf.WriteString(v.location())
+			}
+		}
+	}
+	cons.print(LogInfo, buf.String())
+	return otto.UndefinedValue()
+}
+
+func (cons *console) assert(call otto.FunctionCall) otto.Value {
+	if ok, _ := call.Argument(0).ToBoolean(); ok {
+		return otto.UndefinedValue()
+	}
+	msg := "Assertion failed"
+	if args := call.ArgumentList; len(args) > 1 {
+		sep := " "
+		if args[1].IsString() {
+			sep = ": "
+		}
+		msg += sep + cons.format(args[1:])
+	}
+	cons.print(LogError, msg)
+	return otto.UndefinedValue()
+}
+
+func (cons *console) count(call otto.FunctionCall) otto.Value {
+	label := cons.label(call)
+	cons.counts[label]++
+	cons.print(LogInfo, fmt.Sprintf("%s: %d", label, cons.counts[label]))
+	return otto.UndefinedValue()
+}
+
+func (cons *console) countReset(call otto.FunctionCall) otto.Value {
+	label := cons.label(call)
+	if _, ok := cons.counts[label]; !ok {
+		cons.print(LogWarn, fmt.Sprintf("Count for '%s' does not exist", label))
+	}
+	delete(cons.counts, label)
+	return otto.UndefinedValue()
+}
+
+func (cons *console) time(call otto.FunctionCall) otto.Value {
+	label := cons.label(call)
+	if _, ok := cons.timers[label]; ok {
+		cons.print(LogWarn, fmt.Sprintf("Timer '%s' already exists", label))
+		return otto.UndefinedValue()
+	}
+	cons.timers[label] = time.Now()
+	return otto.UndefinedValue()
+}
+
+// elapsed logs the time elapsed for the timer in the first
+// argument, returning false if the timer does not exist.
+func (cons *console) elapsed(call otto.FunctionCall, extra bool) bool {
+	label := cons.label(call)
+	started, ok := cons.timers[label]
+	if !ok {
+		cons.print(LogWarn, fmt.Sprintf("Timer '%s' does not exist", label))
+		return false
+	}
+	msg := fmt.Sprintf("%s: %s", label, formatConsoleDuration(time.Since(started)))
+	if extra && len(call.ArgumentList) > 1 {
+		msg += " " + cons.format(call.ArgumentList[1:])
+	}
+	cons.print(LogInfo, msg)
+	return true
+}
+
+func (cons *console) timeLog(call otto.FunctionCall) otto.Value {
+	cons.elapsed(call, true)
+	return otto.UndefinedValue()
+}
+
+func (cons *console) timeEnd(call otto.FunctionCall) otto.Value {
+	if cons.elapsed(call, false) {
+		delete(cons.timers, cons.label(call))
+	}
+	return otto.UndefinedValue()
+}
+
+func formatConsoleDuration(d time.Duration) string {
+	if d >= time.Second {
+		return fmt.Sprintf("%.3fs", d.Seconds())
+	}
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+func (cons *console) group(call otto.FunctionCall) otto.Value {
+	if len(call.ArgumentList) > 0 {
+		cons.print(LogInfo, cons.format(call.ArgumentList))
+	}
+	cons.groups++
+	return otto.UndefinedValue()
+}
+
+func (cons *console) groupEnd(call otto.FunctionCall) otto.Value {
+	if cons.groups > 0 {
+		cons.groups--
+	}
+	return otto.UndefinedValue()
+}
+
+// table prints the properties of the first argument as a table, with
+// a row for each property. If the values are objects, their properties
+// become the columns, optionally restricted to the ones in the second
+// argument. Otherwise, they're printed in a Values column.
+func (cons *console) table(call otto.FunctionCall) otto.Value {
+	data := call.Argument(0)
+	if !data.IsObject() || data.IsFunction() {
+		cons.print(LogInfo, cons.format(call.ArgumentList))
+		return otto.UndefinedValue()
+	}
+	const indexColumn, valuesColumn = "(index)", "Values"
+	var filter []string
+	if cols := call.Argument(1); cols.IsObject() {
+		if v, err := cols.Export(); err == nil {
+			if list, ok := v.([]interface{}); ok {
+				for _, c := range list {
+					filter = append(filter, fmt.Sprint(c))
+				}
+			} else if list, ok := v.([]string); ok {
+				filter = list
+			}
+		}
+	}
+	columns := filter
+	seen := make(map[string]bool)
+	hasValues := false
+	obj := data.Object()
+	keys := obj.Keys()
+	rows := make([]map[string]string, len(keys))
+	for ii, k := range keys {
+		rows[ii] = map[string]string{indexColumn: k}
+		val, _ := obj.Get(k)
+		if !val.IsObject() || val.IsFunction() {
+			rows[ii][valuesColumn] = cons.inspect(val, 1, true)
+			hasValues = true
+			continue
+		}
+		row := val.Object()
+		for _, rk := range row.Keys() {
+			if filter == nil && !seen[rk] {
+				seen[rk] = true
+				columns = append(columns, rk)
+			}
+			rv, _ := row.Get(rk)
+			rows[ii][rk] = cons.inspect(rv, 1, true)
+		}
+	}
+	columns = append([]string{indexColumn}, columns...)
+	if hasValues {
+		columns = append(columns, valuesColumn)
+	}
+	widths := make([]int, len(columns))
+	for ii, c := range columns {
+		widths[ii] = utf8.RuneCountInString(c) + 2
+		for _, r := range rows {
+			if w := utf8.RuneCountInString(r[c]) + 2; w > widths[ii] {
+				widths[ii] = w
+			}
+		}
+	}
+	var buf bytes.Buffer
+	line := func(left, mid, right string) {
+		buf.WriteString(left)
+		for ii, w := range widths {
+			if ii > 0 {
+				buf.WriteString(mid)
+			}
+			buf.WriteString(strings.Repeat("─", w))
+		}
+		buf.WriteString(right)
+		buf.WriteByte('\n')
+	}
+	row := func(values func(c string) string) {
+		buf.WriteString("│")
+		for ii, c := range columns {
+			if ii > 0 {
+				buf.WriteString("│")
+			}
+			s := values(c)
+			pad := widths[ii] - utf8.RuneCountInString(s)
+			buf.WriteString(strings.Repeat(" ", pad/2))
+			buf.WriteString(s)
+			buf.WriteString(strings.Repeat(" ", pad-pad/2))
+		}
+		buf.WriteString("│\n")
+	}
+	line("┌", "┬", "┐")
+	row(func(c string) string { return c })
+	line("├", "┼", "┤")
+	for _, r := range rows {
+		row(func(c string) string { return r[c] })
+	}
+	line("└", "┴", "┘")
+	cons.print(LogInfo, strings.TrimSuffix(buf.String(), "\n"))
+	return otto.UndefinedValue()
+}
@@ -0,0 +1,64 @@
+package macaco
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConsole(t *testing.T) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	ctx := newTestingContext(t)
+	ctx.Stdout = &stdout
+	ctx.Stderr = &stderr
+	if err := ctx.LoadScript("console.js", `function run() {
+    console.log('%s has %d items costing %f%%', 'cart', 3.7, 1.5, {a: [1, 'b']});
+    console.info('%o', 'quoted', 'extra');
+    console.warn('careful');
+    console.group('outer');
+    console.log('inner');
+    console.groupEnd();
+    console.count(); console.count(); console.count('x');
+    console.assert(true, 'not shown');
+    console.assert(false, 'broken %s', 'thing');
+    console.dir({f: function named() {}, n: null});
+    console.time('t');
+    console.timeEnd('t');
+    console.timeEnd('t');
+    console.table([{a: 1, b: 'Y'}, {a: 'Z'}]);
+    console.trace('here');
+}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Call("run", nil); err != nil {
+		t.Fatal(err)
+	}
+	out := stdout.String()
+	for _, v := range []string{
+		"cart has 3 items costing 1.5% { a: [ 1, 'b' ] }\n",
+		"'quoted' extra\n",
+		"outer\n  inner\n",
+		"default: 1\ndefault: 2\nx: 1\n",
+		"{ f: [Function: named], n: null }\n",
+		"│ (index) │  a  │  b  │\n",
+		"│    1    │ 'Z' │     │\n",
+		"Trace: here\n    at run (console.js:16:5)",
+	} {
+		if !strings.Contains(out, v) {
+			t.Errorf("stdout does not contain %q:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "not shown") {
+		t.Error("passing assertion was printed")
+	}
+	if !strings.Contains(out, "t: ") || !strings.Contains(out, "ms\n") {
+		t.Errorf("stdout does not contain timer:\n%s", out)
+	}
+	errs := stderr.String()
+	for _, v := range []string{"careful\n", "Assertion failed: broken thing\n", "Timer 't' does not exist\n"} {
+		if !strings.Contains(errs, v) {
+			t.Errorf("stderr does not contain %q:\n%s", v, errs)
+		}
+	}
+}
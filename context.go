@@ -16,19 +16,58 @@ import (
 	"github.com/rainycape/otto"
 )
 
+// Error is the Go counterpart of M.Error. Go functions exposed to JS
+// (see Context.Function) might return an *Error to throw an M.Error
+// with the given code.
 type Error struct {
 	Message string
 	Code    int
 }
 
+func (e *Error) Error() string {
+	return e.Message
+}
+
 type Context struct {
 	Stdout     io.Writer
 	Stderr     io.Writer
 	HTTPClient *http.Client
-	verbose    bool
-	token      string
-	vm         *otto.Otto
-	cache      *cache
+	// UserAgent, if non-empty, is sent as the User-Agent
+	// header in every HTTP request.
+	UserAgent string
+	// Logger receives the messages logged by the scripts and by the
+	// Context. If nil, the messages are written to Stdout (debug and
+	// info) or Stderr (warn and error), with debug messages only
+	// written in verbose mode.
+	Logger Logger
+	// LogJSON makes the messages written when Logger is nil use
+	// JSON lines, with the keys time, level, message, prefix
+	// (if any) and fields (if any).
+	LogJSON bool
+	// LogPrefix is included in every message logged by this Context,
+	// usually to identify the program.
+	LogPrefix string
+	api       string
+	verbose   bool
+	token     string
+	vm        *otto.Otto
+	cache     *cache
+	// sourceMaps is shared by all the Context copies
+	sourceMaps *sourceMaps
+	// instr is nil unless Instrument has been called,
+	// also shared by all the copies.
+	instr *instrumentation
+	// httpRequests is the number of HTTP requests sent,
+	// excluding the ones served from the cache.
+	httpRequests int
+	// modules are installed again into each copy
+	modules []Module
+	// functions registered directly with Register,
+	// also registered again into each copy
+	functions []registeredFunction
+	// installing is true while installing modules, so
+	// their functions aren't added to functions
+	installing bool
 }
 
 func NewContext() (*Context, error) {
@@ -47,6 +86,7 @@ func newContext(c *cache) (*Context, error) {
 		c = newCache()
 	}
 	ctx.cache = c
+	ctx.sourceMaps = newSourceMaps()
 	if err := ctx.loadRuntime(); err != nil {
 		return nil, err
 	}
@@ -54,19 +94,35 @@ func newContext(c *cache) (*Context, error) {
 }
 
 func (c *Context) loadRuntime() error {
+	if err := c.loadCallHelper(); err != nil {
+		return err
+	}
+	if err := c.loadHooks(); err != nil {
+		return err
+	}
 	obj, err := c.vm.Object("M = macaco = (this.macaco || {})")
 	if err != nil {
 		return err
 	}
+	if err := c.loadErrors(obj); err != nil {
+		return err
+	}
 	c.loadLogging(obj)
 	c.loadHTTP(obj)
 	c.loadHTML(obj)
 	c.loadJSON()
+	c.loadNDJSON(obj)
+	c.loadCSV(obj)
+	c.loadXML(obj)
+	c.loadFeed(obj)
 	c.loadFmt(obj)
 	c.loadImage(obj)
-	obj.Set("load", c.Load)
-	obj.Set("load_script", c.LoadScript)
-	return nil
+	obj.Set("load", c.mustFunction(c.Load))
+	obj.Set("load_script", c.mustFunction(c.LoadScript))
+	if err := c.registerFunctions(); err != nil {
+		return err
+	}
+	return c.installModules()
 }
 
 func (c *Context) newMacacoObject(name string) *otto.Object {
@@ -87,39 +143,61 @@ func (c *Context) Copy() *Context {
 	// Reload the runtime so the closures and method values
 	// point to the right *Context. Don't reload the js runtime,
 	// since that part does not have closures.
-	// This error should never happen, but just in case...
+	// This error should never happen, since the modules were
+	// already installed without errors, but just in case...
 	if err := cpy.loadRuntime(); err != nil {
 		panic(err)
 	}
 	return &cpy
 }
 
+// Run runs the given source. If the script fails to compile
+// or throws an exception, the returned error is a *ScriptError.
 func (c *Context) Run(src interface{}) (*Value, error) {
 	v, err := c.vm.Run(src)
 	if err != nil {
-		return nil, err
+		return nil, c.scriptError(err)
 	}
-	return &Value{v, c.vm}, nil
+	return &Value{v, c}, nil
 }
 
+// Call evaluates src, which must result in a function, and calls
+// it with the given this and arguments. If src starts with "new ",
+// the function is called as a constructor. If the function throws an
+// exception, the returned error is a *ScriptError.
 func (c *Context) Call(src string, this interface{}, args ...interface{}) (*Value, error) {
-	thisVal, err := c.vm.ToValue(this)
+	thisVal, err := c.ottoValue(this)
 	if err != nil {
 		return nil, err
 	}
 	argValues := make([]interface{}, len(args))
 	for ii, v := range args {
-		argVal, err := c.vm.ToValue(v)
+		argVal, err := c.ottoValue(v)
 		if err != nil {
 			return nil, err
 		}
 		argValues[ii] = argVal
 	}
-	v, err := c.vm.Call(src, thisVal, argValues...)
+	var v otto.Value
+	if strings.HasPrefix(src, "new ") {
+		v, err = c.vm.Call(src, thisVal, argValues...)
+		if err != nil {
+			err = c.scriptError(err)
+		}
+	} else {
+		var fn otto.Value
+		if fn, err = c.vm.Run(src); err != nil {
+			return nil, c.scriptError(err)
+		}
+		if !fn.IsFunction() {
+			return nil, fmt.Errorf("%s is not a function", src)
+		}
+		v, err = c.callFunction(fn, thisVal, argValues)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Value{v, c.vm}, nil
+	return &Value{v, c}, nil
 }
 
 func (c *Context) Load(prog string) error {
@@ -133,16 +211,17 @@ func (c *Context) Load(prog string) error {
 		if c.token != "" {
 			values.Set("access_token", c.token)
 		}
-		p = apiURL("/load?" + values.Encode())
+		p = c.apiURL("/load?" + values.Encode())
 	}
-	entry, script := c.cache.getCachedScript(p)
-	if script != nil {
+	key := scriptKey(p)
+	entry, script := c.cache.getCachedScript(key)
+	if script != nil && c.instr == nil {
 		if _, err := c.vm.Run(script); err == nil {
 			return nil
 		}
 	}
 	if entry != nil && len(entry.Data) > 0 {
-		if c.loadData(p, entry.Data, nil, entry) == nil {
+		if c.loadData(key, entry.Data, nil, entry) == nil {
 			return nil
 		}
 	}
@@ -150,8 +229,8 @@ func (c *Context) Load(prog string) error {
 	if err != nil {
 		return err
 	}
-	c.Debugf("GET %s\n", p)
-	resp, err := c.httpClient().Do(req)
+	c.Debugf("GET %s\n", key)
+	resp, err := c.doHTTPRequest(req)
 	if err != nil {
 		return err
 	}
@@ -163,30 +242,67 @@ func (c *Context) Load(prog string) error {
 	if err != nil {
 		return err
 	}
-	return c.loadData(p, data, resp, nil)
+	return c.loadData(key, data, resp, nil)
+}
+
+// scriptKey returns the URL u without its access token, which is
+// used for naming and caching the script, since the name appears
+// in errors and in the debugger, profile and coverage output.
+func scriptKey(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	values := parsed.Query()
+	if _, ok := values["access_token"]; !ok {
+		return u
+	}
+	values.Del("access_token")
+	parsed.RawQuery = values.Encode()
+	return parsed.String()
 }
 
 func (c *Context) LoadScript(filename string, data string) error {
-	_, err := c.loadScript(filename, []byte(data))
+	_, err := c.loadScript(filename, "", []byte(data))
 	return err
 }
 
-func (c *Context) loadScript(filename string, data []byte) (*otto.Script, error) {
-	script, err := c.vm.Compile(filename, data)
+// loadScript compiles and runs the given script. If the script references
+// a source map, it's loaded and used for mapping error positions. base
+// is used to resolve relative source map URLs, see readSourceMap.
+func (c *Context) loadScript(filename string, base string, data []byte) (*otto.Script, error) {
+	c.loadSourceMap(filename, base, data)
+	src := data
+	if c.instr != nil {
+		var err error
+		if src, err = c.instr.instrument(filename, data); err != nil {
+			return nil, c.scriptError(err)
+		}
+	}
+	script, err := c.vm.Compile(filename, src)
 	if err != nil {
-		return nil, err
+		return nil, c.scriptError(err)
 	}
 	if _, err := c.vm.Run(script); err != nil {
-		return nil, err
+		return nil, c.scriptError(err)
 	}
 	return script, nil
 }
 
 func (c *Context) loadData(url string, data []byte, resp *http.Response, entry *diskEntry) error {
-	script, err := c.loadScript(path.Base(url), data)
+	// Compile with the full URL, so scripts with the same base
+	// name don't share their source maps, but display the base
+	// name in errors.
+	c.sourceMaps.setName(url, path.Base(url))
+	script, err := c.loadScript(url, url, data)
 	if err != nil {
 		return err
 	}
+	if c.instr != nil {
+		// Don't cache the instrumented script, since the cache
+		// might be used by non-instrumented contexts.
+		script = nil
+	}
 	if err := c.cache.cacheScript(url, data, resp, script, entry); err != nil {
 		c.Debugf("error caching script %s: %s\n", url, err)
 	}
@@ -212,7 +328,7 @@ func (c *Context) Get(name string) (*Value, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Value{v, c.vm}, nil
+	return &Value{v, c}, nil
 }
 
 func (c *Context) RunTests(re *regexp.Regexp) ([]*Test, error) {
@@ -253,11 +369,17 @@ func (c *Context) RunTests(re *regexp.Regexp) ([]*Test, error) {
 			t.Started = time.Now()
 			_, err := val.Call(nil)
 			if err != nil {
-				oe, ok := err.(*otto.Error)
+				se, ok := err.(*ScriptError)
 				if !ok {
 					return nil, err
 				}
-				t.Errors = append(t.Errors, &TestError{Message: oe.String(), Timestamp: time.Now()})
+				t.Errors = append(t.Errors, &TestError{
+					Message:   se.String(),
+					File:      se.File,
+					Line:      se.Line,
+					Column:    se.Column,
+					Timestamp: time.Now(),
+				})
 			}
 			t.Finished = time.Now()
 			t.Stdout = testStdout.String()
@@ -270,7 +392,11 @@ func (c *Context) RunTests(re *regexp.Regexp) ([]*Test, error) {
 			} else {
 				fmt.Fprintf(stderr, "FAIL: %s (%s)\n", t.Name, t.Elapsed())
 				for _, v := range t.Errors {
-					fmt.Fprintf(stderr, "\terror: %s (at %s)\n", v.Message, v.Timestamp.Sub(t.Started))
+					if v.File != "" {
+						fmt.Fprintf(stderr, "\t%s: error: %s (at %s)\n", v.Location(), v.Message, v.Timestamp.Sub(t.Started))
+					} else {
+						fmt.Fprintf(stderr, "\terror: %s (at %s)\n", v.Message, v.Timestamp.Sub(t.Started))
+					}
 				}
 			}
 		}
@@ -2,8 +2,13 @@ package macaco
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -24,6 +29,28 @@ func newTestingContext(t testing.TB) *Context {
 	return ctx
 }
 
+// jsCase is a JS expression and the expected
+// string value of its result.
+type jsCase struct {
+	src      string
+	expected string
+}
+
+// runJSCases runs the given cases in ctx, reporting an error
+// for every case which fails or returns an unexpected result.
+func runJSCases(t *testing.T, ctx *Context, cases []jsCase) {
+	for _, v := range cases {
+		val, err := ctx.Run(v.src)
+		if err != nil {
+			t.Errorf("error running %s: %s", v.src, err)
+			continue
+		}
+		if s := val.String(); s != v.expected {
+			t.Errorf("expecting %s = %q, got %q", v.src, v.expected, s)
+		}
+	}
+}
+
 func TestLogging(t *testing.T) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -41,6 +68,63 @@ func TestLogging(t *testing.T) {
 	}
 }
 
+type testLogger struct {
+	entries []*LogEntry
+}
+
+func (l *testLogger) Log(e *LogEntry) {
+	l.entries = append(l.entries, e)
+}
+
+func TestLeveledLogging(t *testing.T) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	ctx := newTestingContext(t)
+	ctx.Stdout = &stdout
+	ctx.Stderr = &stderr
+	ctx.LogPrefix = "prog"
+	if _, err := ctx.Run("M.log.info('fetched', {url: 'http://example.com', n: 2}); M.log.warn('slow')"); err != nil {
+		t.Fatal(err)
+	}
+	if s := stdout.String(); s != "prog: fetched n=2 url=http://example.com\n" {
+		t.Errorf("unexpected stdout %q", s)
+	}
+	if s := stderr.String(); s != "prog: slow\n" {
+		t.Errorf("unexpected stderr %q", s)
+	}
+	stdout.Reset()
+	ctx.LogJSON = true
+	if _, err := ctx.Run("M.log.info('a', 'b', {c: true})"); err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["message"] != "a b" || entry["level"] != "info" || entry["prefix"] != "prog" {
+		t.Errorf("unexpected JSON entry %v", entry)
+	}
+	if fields, ok := entry["fields"].(map[string]interface{}); !ok || fields["c"] != true {
+		t.Errorf("unexpected JSON entry fields %v", entry["fields"])
+	}
+	logger := new(testLogger)
+	ctx.Logger = logger
+	if _, err := ctx.Run("M.log.debug('x'); M.log('y'); M.errorf('%d', 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.entries) != 3 {
+		t.Fatalf("expecting 3 entries, got %d", len(logger.entries))
+	}
+	for ii, v := range []struct {
+		level LogLevel
+		msg   string
+	}{{LogDebug, "x"}, {LogInfo, "y"}, {LogError, "3"}} {
+		if e := logger.entries[ii]; e.Level != v.level || e.Message != v.msg {
+			t.Errorf("expecting entry %d = %s %q, got %s %q", ii, v.level, v.msg, e.Level, e.Message)
+		}
+	}
+}
+
 func TestJSON(t *testing.T) {
 	ctx := newTestingContext(t)
 	// Make number float64, so its type is not altered.
@@ -60,6 +144,29 @@ func TestJSON(t *testing.T) {
 	}
 }
 
+func TestJSONSpec(t *testing.T) {
+	ctx := newTestingContext(t)
+	cases := []jsCase{
+		{`JSON.stringify({b: 1, a: [1, 'x', null, undefined, function() {}], c: undefined})`, `{"b":1,"a":[1,"x",null,null,null]}`},
+		{`JSON.stringify({a: {b: 1}, c: []}, null, 2)`, "{\n  \"a\": {\n    \"b\": 1\n  },\n  \"c\": []\n}"},
+		{`JSON.stringify({a: 1, b: 2, c: 3}, ['c', 'a'], '\t')`, "{\n\t\"c\": 3,\n\t\"a\": 1\n}"},
+		{`JSON.stringify({a: 1, b: 'x'}, function(k, v) { return typeof v === 'number' ? v * 2 : v; })`, `{"a":2,"b":"x"}`},
+		{`JSON.stringify({t: {toJSON: function(k) { return 'key ' + k; }}, d: new Date(0)})`, `{"t":"key t","d":"1970-01-01T00:00:00.000Z"}`},
+		{`JSON.stringify('<"\u0001\n>')`, `"<\"\u0001\n>"`},
+		{`JSON.stringify([NaN, Infinity, new Number(3), new String('s'), new Boolean(false)])`, `[null,null,3,"s",false]`},
+		{`JSON.stringify(undefined) === undefined`, `true`},
+		{`Object.keys(JSON.parse('{"z": 1, "a": {"y": [1, 2.5, true, null]}, "m": "s"}')).join(',')`, `z,a,m`},
+		{`JSON.stringify(JSON.parse('{"z": 1, "a": {"y": [1, 2.5, true, null]}}'))`, `{"z":1,"a":{"y":[1,2.5,true,null]}}`},
+		{`JSON.stringify(JSON.parse('{"a": 1, "b": [1, 2]}', function(k, v) { return k === 'a' ? undefined : (typeof v === 'number' ? v + 1 : v); }))`, `{"b":[2,3]}`},
+		{`JSON.parse(' "x" ')`, `x`},
+		{`[JSON.parse('1e400'), JSON.parse('-1e400'), JSON.parse('1e-400')].join()`, `Infinity,-Infinity,0`},
+		{`try { JSON.parse('{"a": }') } catch (e) { e.name }`, `SyntaxError`},
+		{`try { JSON.parse('1 2') } catch (e) { e.name }`, `SyntaxError`},
+		{`try { JSON.parse('') } catch (e) { e.name }`, `SyntaxError`},
+		{`var o = {}; o.o = o; try { JSON.stringify(o) } catch (e) { e.name }`, `TypeError`},
+	}
+	runJSCases(t, ctx, cases)
+}
 func testResponseURL(t *testing.T, res *Value, expected string) {
 	url, err := res.Get("url")
 	if err != nil {
@@ -238,6 +345,35 @@ func TestLoadCache(t *testing.T) {
 	}
 }
 
+func TestLoadToken(t *testing.T) {
+	const token = "s3cret"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") != token {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "function answer() { return 42; }")
+	}))
+	defer srv.Close()
+	defer os.Setenv("MACACO_API", os.Getenv("MACACO_API"))
+	os.Setenv("MACACO_API", srv.URL)
+	ctx := newTestingContext(t)
+	ctx.token = token
+	ctx.Instrument()
+	if err := ctx.Load("token-test"); err != nil {
+		t.Fatal(err)
+	}
+	files := ctx.Debugger().Files()
+	if len(files) == 0 {
+		t.Fatal("no files loaded")
+	}
+	for _, v := range files {
+		if strings.Contains(v, token) {
+			t.Errorf("file name %q contains the access token", v)
+		}
+	}
+}
+
 func TestTests(t *testing.T) {
 	ctx := newTestingContext(t)
 	_, err := ctx.Run(`
@@ -293,3 +429,55 @@ func TestSprintf(t *testing.T) {
 		t.Errorf("expecting %q, got %q instead", expect, res.String())
 	}
 }
+
+func TestScriptError(t *testing.T) {
+	ctx := newTestingContext(t)
+	if err := ctx.LoadScript("thrower.js", `function thrower(n) {
+    if (n > 0) {
+        return thrower(n - 1);
+    }
+    throw new TypeError('bad ' + n);
+}
+function throwValue() {
+    throw {code: 42};
+}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ctx.Call("thrower", nil, 2)
+	se, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+	}
+	if se.Name != "TypeError" || se.Message != "bad 0" {
+		t.Errorf("expecting TypeError: bad 0, got %s: %s", se.Name, se.Message)
+	}
+	if se.File != "thrower.js" || se.Line != 5 {
+		t.Errorf("expecting error at thrower.js:5, got %s:%d", se.File, se.Line)
+	}
+	if len(se.Stack) != 3 {
+		t.Errorf("expecting 3 stack frames, got %d: %s", len(se.Stack), se.String())
+	}
+	if se.Value == nil || !se.Value.IsObject() {
+		t.Errorf("expecting error value, got %v", se.Value)
+	}
+	_, err = ctx.Call("throwValue", nil)
+	se, ok = err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+	}
+	code, err := se.Value.Get("code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := code.ToInteger(); n != 42 {
+		t.Errorf("expecting thrown value code = 42, got %v", code)
+	}
+	err = ctx.LoadScript("syntax.js", "function {")
+	se, ok = err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+	}
+	if se.Name != "SyntaxError" || se.File != "syntax.js" || se.Line != 1 {
+		t.Errorf("expecting SyntaxError at syntax.js:1, got %s at %s:%d", se.Name, se.File, se.Line)
+	}
+}
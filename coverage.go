@@ -0,0 +1,309 @@
+package macaco
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// TestFileSuffix is the suffix of the files which contain
+// tests. They're excluded from the coverage reports.
+const TestFileSuffix = "_test.js"
+
+// LineCoverage contains the number of times a line
+// was executed.
+type LineCoverage struct {
+	Line int
+	Hits int
+}
+
+// FunctionCoverage contains the number of times a
+// function was called.
+type FunctionCoverage struct {
+	Name string
+	Line int
+	Hits int
+}
+
+// FileCoverage contains the coverage for a file. Only the lines
+// with statements are included.
+type FileCoverage struct {
+	File      string
+	Lines     []*LineCoverage
+	Functions []*FunctionCoverage
+	source    []byte
+}
+
+// Covered returns the number of lines which were executed.
+func (f *FileCoverage) Covered() int {
+	covered := 0
+	for _, v := range f.Lines {
+		if v.Hits > 0 {
+			covered++
+		}
+	}
+	return covered
+}
+
+// Percent returns the percentage of lines which were executed.
+func (f *FileCoverage) Percent() float64 {
+	if len(f.Lines) == 0 {
+		return 100
+	}
+	return 100 * float64(f.Covered()) / float64(len(f.Lines))
+}
+
+// Coverage records which statements and functions are executed in the
+// instrumented scripts, see Context.Instrument. Use Context.StartCoverage
+// to start recording coverage.
+type Coverage struct {
+	in        *instrumentation
+	mu        sync.Mutex
+	stopped   bool
+	probes    map[int]int
+	functions map[int]int
+}
+
+// StartCoverage starts recording coverage in this Context and its copies,
+// instrumenting it if required. Only the scripts loaded after instrumenting
+// the Context are covered. If the Context is already recording coverage,
+// its current Coverage is returned.
+func (c *Context) StartCoverage() *Coverage {
+	c.Instrument()
+	c.instr.Lock()
+	defer c.instr.Unlock()
+	if c.instr.coverage == nil {
+		c.instr.coverage = &Coverage{
+			in:        c.instr,
+			probes:    make(map[int]int),
+			functions: make(map[int]int),
+		}
+	}
+	return c.instr.coverage
+}
+
+// Stop stops recording coverage. Calling it multiple
+// times has no effect.
+func (cv *Coverage) Stop() {
+	cv.in.Lock()
+	if cv.in.coverage == cv {
+		cv.in.coverage = nil
+	}
+	cv.in.Unlock()
+	cv.mu.Lock()
+	cv.stopped = true
+	cv.mu.Unlock()
+}
+
+func (cv *Coverage) statement(c *Context, id int) bool {
+	cv.mu.Lock()
+	if !cv.stopped {
+		cv.probes[id]++
+	}
+	cv.mu.Unlock()
+	return false
+}
+
+func (cv *Coverage) enter(c *Context, fn int) {
+	cv.mu.Lock()
+	if !cv.stopped {
+		cv.functions[fn]++
+	}
+	cv.mu.Unlock()
+}
+
+func (cv *Coverage) exit(c *Context, fn int) {
+}
+
+// Files returns the coverage for every instrumented file, excluding
+// the ones with the TestFileSuffix, in load order.
+func (cv *Coverage) Files() []*FileCoverage {
+	cv.in.RLock()
+	defer cv.in.RUnlock()
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	byFile := make(map[string]*FileCoverage)
+	lines := make(map[string]map[int]*LineCoverage)
+	var files []*FileCoverage
+	for _, v := range cv.in.files {
+		if strings.HasSuffix(v, TestFileSuffix) {
+			continue
+		}
+		fc := &FileCoverage{File: v, source: cv.in.sources[v]}
+		byFile[v] = fc
+		lines[v] = make(map[int]*LineCoverage)
+		files = append(files, fc)
+	}
+	for ii, v := range cv.in.probes {
+		fc := byFile[v.file]
+		if fc == nil {
+			continue
+		}
+		lc := lines[v.file][v.line]
+		if lc == nil {
+			lc = &LineCoverage{Line: v.line}
+			lines[v.file][v.line] = lc
+			fc.Lines = append(fc.Lines, lc)
+		}
+		// A line is covered when any of its statements
+		// is executed.
+		if hits := cv.probes[ii]; hits > lc.Hits {
+			lc.Hits = hits
+		}
+	}
+	for ii, v := range cv.in.functions {
+		if fc := byFile[v.file]; fc != nil {
+			name := v.name
+			if name == "" {
+				name = fmt.Sprintf("(anonymous):%d", v.line)
+			}
+			fc.Functions = append(fc.Functions, &FunctionCoverage{Name: name, Line: v.line, Hits: cv.functions[ii]})
+		}
+	}
+	for _, v := range files {
+		sort.Sort(linesByNumber(v.Lines))
+	}
+	return files
+}
+
+// WriteSummary writes the percentage of covered lines
+// in each file and in total.
+func (cv *Coverage) WriteSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	covered, total := 0, 0
+	for _, v := range cv.Files() {
+		covered += v.Covered()
+		total += len(v.Lines)
+		fmt.Fprintf(tw, "%s\t%d/%d lines\t%.1f%%\n", v.File, v.Covered(), len(v.Lines), v.Percent())
+	}
+	pct := 100.0
+	if total > 0 {
+		pct = 100 * float64(covered) / float64(total)
+	}
+	fmt.Fprintf(tw, "total\t%d/%d lines\t%.1f%%\n", covered, total, pct)
+	return tw.Flush()
+}
+
+// WriteLcov writes the coverage in the lcov tracefile format
+// (see geninfo(1)), with absolute file paths.
+func (cv *Coverage) WriteLcov(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, v := range cv.Files() {
+		name := v.File
+		if abs, err := filepath.Abs(name); err == nil && !looksLikeURL(name) {
+			name = abs
+		}
+		fmt.Fprintf(&buf, "TN:\nSF:%s\n", name)
+		hit := 0
+		for _, fn := range v.Functions {
+			fmt.Fprintf(&buf, "FN:%d,%s\n", fn.Line, fn.Name)
+		}
+		for _, fn := range v.Functions {
+			fmt.Fprintf(&buf, "FNDA:%d,%s\n", fn.Hits, fn.Name)
+			if fn.Hits > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(&buf, "FNF:%d\nFNH:%d\n", len(v.Functions), hit)
+		for _, l := range v.Lines {
+			fmt.Fprintf(&buf, "DA:%d,%d\n", l.Line, l.Hits)
+		}
+		fmt.Fprintf(&buf, "LF:%d\nLH:%d\nend_of_record\n", len(v.Lines), v.Covered())
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+type coverageHTMLLine struct {
+	Number int
+	Text   string
+	Class  string
+	Hits   string
+}
+
+type coverageHTMLFile struct {
+	*FileCoverage
+	Lines []*coverageHTMLLine
+}
+
+// WriteHTML writes a self contained HTML page which shows the
+// source of the covered files, highlighting the executed lines.
+func (cv *Coverage) WriteHTML(w io.Writer) error {
+	var files []*coverageHTMLFile
+	for _, v := range cv.Files() {
+		hits := make(map[int]int, len(v.Lines))
+		for _, l := range v.Lines {
+			hits[l.Line] = l.Hits
+		}
+		hf := &coverageHTMLFile{FileCoverage: v}
+		for ii, text := range strings.Split(string(v.source), "\n") {
+			line := &coverageHTMLLine{Number: ii + 1, Text: strings.TrimRight(text, "\r")}
+			if h, ok := hits[line.Number]; ok {
+				line.Hits = fmt.Sprintf("%dx", h)
+				line.Class = "miss"
+				if h > 0 {
+					line.Class = "hit"
+				}
+			}
+			hf.Lines = append(hf.Lines, line)
+		}
+		files = append(files, hf)
+	}
+	return coverageTemplate.Execute(w, files)
+}
+
+type linesByNumber []*LineCoverage
+
+func (l linesByNumber) Len() int           { return len(l) }
+func (l linesByNumber) Less(i, j int) bool { return l[i].Line < l[j].Line }
+func (l linesByNumber) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage report</title>
+<style>
+body { margin: 0; font-family: sans-serif; font-size: 14px; }
+#header { position: fixed; top: 0; left: 0; right: 0; padding: 8px; background: #333; color: #fff; }
+#files { margin-top: 44px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0 8px; font-family: monospace; white-space: pre; vertical-align: top; }
+td.n, td.h { color: #999; text-align: right; width: 1%; user-select: none; }
+tr.hit td.c { background: #dfd; }
+tr.miss td.c { background: #fdd; }
+</style>
+</head>
+<body>
+<div id="header">
+<select id="select" onchange="show(this.value)">
+{{range $ii, $f := .}}<option value="{{$ii}}">{{$f.File}} ({{printf "%.1f" $f.Percent}}%)</option>
+{{end}}</select>
+</div>
+<div id="files">
+{{range $ii, $f := .}}<table id="file{{$ii}}" style="display: none">
+{{range $f.Lines}}<tr class="{{.Class}}"><td class="n">{{.Number}}</td><td class="h">{{.Hits}}</td><td class="c">{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}</div>
+<script>
+var current = null;
+function show(ii) {
+	if (current) {
+		current.style.display = 'none';
+	}
+	current = document.getElementById('file' + ii);
+	if (current) {
+		current.style.display = 'table';
+	}
+}
+show(0);
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,62 @@
+package macaco
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	ctx := newTestingContext(t)
+	cov := ctx.StartCoverage()
+	if err := ctx.LoadScript("cover.js", `var calls = 0;
+function sign(x) {
+    calls++;
+    if (x < 0) {
+        return -1;
+    }
+    return 1;
+}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.LoadScript("cover_test.js", `function __test_sign() { sign(1); }`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Call("__test_sign", nil); err != nil {
+		t.Fatal(err)
+	}
+	cov.Stop()
+	files := cov.Files()
+	if len(files) != 1 || files[0].File != "cover.js" {
+		t.Fatalf("expecting coverage for cover.js, got %v", files)
+	}
+	hits := make(map[int]int)
+	for _, v := range files[0].Lines {
+		hits[v.Line] = v.Hits
+	}
+	expected := map[int]int{1: 1, 3: 1, 4: 1, 5: 0, 7: 1}
+	for k, v := range expected {
+		if h, ok := hits[k]; !ok || h != v {
+			t.Errorf("expecting %d hits in line %d, got %d (%v)", v, k, h, ok)
+		}
+	}
+	if len(hits) != len(expected) {
+		t.Errorf("expecting %d lines, got %v", len(expected), hits)
+	}
+	var lcov bytes.Buffer
+	if err := cov.WriteLcov(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"FNDA:1,sign\n", "DA:5,0\n", "LF:5\nLH:4\n"} {
+		if !strings.Contains(lcov.String(), v) {
+			t.Errorf("lcov output does not contain %q:\n%s", v, lcov.String())
+		}
+	}
+	var html bytes.Buffer
+	if err := cov.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html.String(), `<td class="c">    if (x &lt; 0) {</td>`) {
+		t.Errorf("HTML report does not contain escaped source:\n%s", html.String())
+	}
+}
@@ -0,0 +1,268 @@
+package macaco
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rainycape/otto"
+)
+
+// csvOptions are the options accepted by the M.csv functions
+// as an object in their last argument.
+type csvOptions struct {
+	// delimiter is the field delimiter, defaults to a comma.
+	delimiter rune
+	// comment, if non-zero, marks the lines to ignore when
+	// they start with it.
+	comment rune
+	// headers indicates if the first row contains the field
+	// names. Defaults to true.
+	headers bool
+	// columns overrides the field names.
+	columns []string
+	// trim removes the leading spaces from the fields.
+	trim bool
+}
+
+func parseCSVOptions(val otto.Value) (*csvOptions, error) {
+	opts := &csvOptions{delimiter: ',', headers: true}
+	if !val.IsObject() {
+		return opts, nil
+	}
+	obj := val.Object()
+	char := func(key string) (rune, error) {
+		v, _ := obj.Get(key)
+		if v.IsUndefined() || v.IsNull() {
+			return 0, nil
+		}
+		s := v.String()
+		if utf8.RuneCountInString(s) != 1 {
+			return 0, fmt.Errorf("%s must be a single character, not %q", key, s)
+		}
+		r, _ := utf8.DecodeRuneInString(s)
+		return r, nil
+	}
+	var err error
+	if opts.comment, err = char("comment"); err != nil {
+		return nil, err
+	}
+	if d, err := char("delimiter"); err != nil {
+		return nil, err
+	} else if d != 0 {
+		opts.delimiter = d
+	}
+	if v, _ := obj.Get("headers"); v.IsDefined() {
+		opts.headers, _ = v.ToBoolean()
+	}
+	if v, _ := obj.Get("trim"); v.IsDefined() {
+		opts.trim, _ = v.ToBoolean()
+	}
+	if v, _ := obj.Get("columns"); v.IsObject() {
+		exported, err := v.Export()
+		if err != nil {
+			return nil, err
+		}
+		switch x := exported.(type) {
+		case []string:
+			opts.columns = x
+		case []interface{}:
+			for _, c := range x {
+				opts.columns = append(opts.columns, fmt.Sprint(c))
+			}
+		default:
+			return nil, fmt.Errorf("columns must be an array, not %T", exported)
+		}
+	}
+	return opts, nil
+}
+
+// csvReader reads CSV records, returning them as objects keyed by
+// the column names when there are column names or as arrays otherwise.
+type csvReader struct {
+	c       *Context
+	r       *csv.Reader
+	opts    *csvOptions
+	columns []string
+	started bool
+}
+
+func (r *csvReader) next() (otto.Value, error) {
+	if !r.started {
+		r.started = true
+		r.columns = r.opts.columns
+		if r.opts.headers && r.columns == nil {
+			header, err := r.r.Read()
+			if err == io.EOF {
+				return otto.UndefinedValue(), nil
+			}
+			if err != nil {
+				return otto.Value{}, err
+			}
+			r.columns = header
+		}
+	}
+	record, err := r.r.Read()
+	if err == io.EOF {
+		return otto.UndefinedValue(), nil
+	}
+	if err != nil {
+		return otto.Value{}, err
+	}
+	if r.columns == nil {
+		items := make([]interface{}, len(record))
+		for ii, v := range record {
+			items[ii] = v
+		}
+		return r.c.newArray(items)
+	}
+	obj, err := r.c.vm.Object("({})")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	for ii, v := range record {
+		if ii < len(r.columns) {
+			obj.Set(r.columns[ii], v)
+		}
+	}
+	return obj.Value(), nil
+}
+
+func (c *Context) newCSVReader(call otto.FunctionCall) (*csvReader, error) {
+	opts, err := parseCSVOptions(call.Argument(1))
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(strings.NewReader(call.Argument(0).String()))
+	r.Comma = opts.delimiter
+	r.Comment = opts.comment
+	r.TrimLeadingSpace = opts.trim
+	r.FieldsPerRecord = -1
+	return &csvReader{c: c, r: r, opts: opts}, nil
+}
+
+func (c *Context) csvReader(call otto.FunctionCall) (otto.Value, error) {
+	r, err := c.newCSVReader(call)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	return c.newReader(r.next), nil
+}
+
+func (c *Context) csvParse(call otto.FunctionCall) (otto.Value, error) {
+	r, err := c.newCSVReader(call)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	var records []interface{}
+	for {
+		val, err := r.next()
+		if err != nil {
+			return otto.Value{}, err
+		}
+		if val.IsUndefined() {
+			break
+		}
+		records = append(records, val)
+	}
+	return c.newArray(records)
+}
+
+func csvField(v otto.Value) string {
+	if v.IsUndefined() || v.IsNull() {
+		return ""
+	}
+	return v.String()
+}
+
+// csvStringify encodes an array of arrays or objects as CSV. For
+// objects, the columns are the keys in order of appearance unless
+// columns is provided, and a header row is written unless headers
+// is false.
+func (c *Context) csvStringify(call otto.FunctionCall) (otto.Value, error) {
+	arg := call.Argument(0)
+	if !arg.IsObject() {
+		return otto.Value{}, fmt.Errorf("M.csv.stringify requires an array, not %s", arg)
+	}
+	opts, err := parseCSVOptions(call.Argument(1))
+	if err != nil {
+		return otto.Value{}, err
+	}
+	rows := arg.Object()
+	length, err := rows.Get("length")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	n, _ := length.ToInteger()
+	values := make([]*otto.Object, n)
+	objects := false
+	columns := opts.columns
+	seen := make(map[string]bool)
+	for ii := range values {
+		v, err := rows.Get(fmt.Sprint(ii))
+		if err != nil {
+			return otto.Value{}, err
+		}
+		if !v.IsObject() {
+			return otto.Value{}, fmt.Errorf("row %d must be an array or an object, not %s", ii, v)
+		}
+		values[ii] = v.Object()
+		if values[ii].Class() != "Array" {
+			objects = true
+			if opts.columns == nil {
+				for _, k := range values[ii].Keys() {
+					if !seen[k] {
+						seen[k] = true
+						columns = append(columns, k)
+					}
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = opts.delimiter
+	if objects && opts.headers {
+		if err := w.Write(columns); err != nil {
+			return otto.Value{}, err
+		}
+	}
+	for ii, row := range values {
+		var record []string
+		if row.Class() == "Array" {
+			length, _ := row.Get("length")
+			n, _ := length.ToInteger()
+			record = make([]string, n)
+			for jj := range record {
+				v, _ := row.Get(fmt.Sprint(jj))
+				record[jj] = csvField(v)
+			}
+		} else {
+			record = make([]string, len(columns))
+			for jj, k := range columns {
+				v, _ := row.Get(k)
+				record[jj] = csvField(v)
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return otto.Value{}, fmt.Errorf("row %d: %s", ii, err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return otto.Value{}, err
+	}
+	return c.vm.ToValue(buf.String())
+}
+
+func (c *Context) loadCSV(obj *otto.Object) {
+	csvObj := c.newMacacoObject("csv")
+	reader := c.throwingFunc("SyntaxError", c.csvReader)
+	csvObj.Set("parse", c.throwingFunc("SyntaxError", c.csvParse))
+	csvObj.Set("stringify", c.throwingFunc("TypeError", c.csvStringify))
+	csvObj.Set("reader", reader)
+	csvObj.Set("each", c.eachFunc(reader))
+}
@@ -0,0 +1,21 @@
+package macaco
+
+import (
+	"testing"
+)
+
+func TestCSV(t *testing.T) {
+	ctx := newTestingContext(t)
+	cases := []jsCase{
+		{`JSON.stringify(M.csv.parse('name,age\nAnn,30\n"Smith, J","4""2"\n'))`, `[{"name":"Ann","age":"30"},{"name":"Smith, J","age":"4\"2"}]`},
+		{`JSON.stringify(M.csv.parse('a;b\n# comment\n1; 2', {delimiter: ';', comment: '#', trim: true, headers: false}))`, `[["a","b"],["1","2"]]`},
+		{`JSON.stringify(M.csv.parse('1,2\n3,4', {columns: ['x', 'y']}))`, `[{"x":"1","y":"2"},{"x":"3","y":"4"}]`},
+		{`M.csv.stringify([{a: 1, b: 'x,y'}, {b: 'z', c: null}])`, "a,b,c\n1,\"x,y\",\n,z,\n"},
+		{`M.csv.stringify([['a', 'b'], [1, '"q"']], {delimiter: '\t'})`, "a\tb\n1\t\"\"\"q\"\"\"\n"},
+		{`M.csv.stringify([{a: 1, b: 2}], {columns: ['b'], headers: false})`, "2\n"},
+		{`var n = 0; M.csv.each('a\n1\n2\n3', function(row) { n += +row.a; }); n`, `6`},
+		{`try { M.csv.parse('a\n"b') } catch (e) { e.name }`, `SyntaxError`},
+		{`try { M.csv.parse('a', {delimiter: ';;'}) } catch (e) { e.name }`, `SyntaxError`},
+	}
+	runJSCases(t, ctx, cases)
+}
@@ -0,0 +1,519 @@
+package macaco
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/rainycape/otto"
+)
+
+const (
+	// Pause reasons
+	PauseBreakpoint = "breakpoint"
+	PauseStep       = "step"
+	PauseDebugger   = "debugger"
+	PauseRequested  = "pause"
+
+	maxVariableLength = 200
+)
+
+// ErrNotPaused is returned by the Debugger methods which
+// require the script to be paused.
+var ErrNotPaused = errors.New("debugger is not paused")
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+// Breakpoint is a line where the debugger pauses.
+type Breakpoint struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// Pause describes the statement where a script is paused.
+type Pause struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Function string `json:"function,omitempty"`
+	// Reason is one of PauseBreakpoint, PauseStep,
+	// PauseDebugger or PauseRequested.
+	Reason string `json:"reason"`
+	// Stack contains the instrumented functions being
+	// executed, innermost first.
+	Stack []*StackFrame `json:"stack"`
+}
+
+// Variable is a JS value formatted for display.
+type Variable struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Scope is a set of variables visible from the paused statement.
+type Scope struct {
+	// Name is either "local", "closure" or "global".
+	Name string `json:"name"`
+	// Function is the function which declares the variables,
+	// empty for the global scope.
+	Function  string      `json:"function,omitempty"`
+	Variables []*Variable `json:"variables"`
+}
+
+type debugFrame struct {
+	fn    int
+	probe int
+}
+
+type debugCommand struct {
+	step  stepMode
+	eval  string
+	scope bool
+	reply chan *debugReply
+}
+
+type debugReply struct {
+	variable *Variable
+	scopes   []*Scope
+	err      error
+}
+
+// Debugger allows pausing instrumented scripts at breakpoints and
+// stepping through them, inspecting their variables. It's shared by
+// all the copies of a Context, but only one of them should be running
+// at any given time while debugging.
+//
+// When the script pauses, a *Pause is sent to the channel returned by
+// Paused and the script remains stopped until Continue or any of the
+// Step methods are called. While paused, Eval and Scopes might be used
+// to inspect the program state.
+type Debugger struct {
+	in        *instrumentation
+	mu        sync.Mutex
+	bps       map[Breakpoint]bool
+	bpLines   map[int][]string
+	step      stepMode
+	depth     int
+	request   bool
+	frames    []debugFrame
+	last      *probe
+	lastDepth int
+	paused    bool
+	pauses    chan *Pause
+	commands  chan *debugCommand
+}
+
+// Debugger returns the debugger for this Context, instrumenting it if
+// required. Note that only scripts loaded after instrumenting the Context
+// can be debugged, see Instrument.
+func (c *Context) Debugger() *Debugger {
+	c.Instrument()
+	c.instr.Lock()
+	defer c.instr.Unlock()
+	if c.instr.debugger == nil {
+		c.instr.debugger = &Debugger{
+			in:       c.instr,
+			bps:      make(map[Breakpoint]bool),
+			bpLines:  make(map[int][]string),
+			pauses:   make(chan *Pause, 1),
+			commands: make(chan *debugCommand),
+		}
+	}
+	return c.instr.debugger
+}
+
+// Files returns the instrumented files, in load order.
+func (d *Debugger) Files() []string {
+	d.in.RLock()
+	defer d.in.RUnlock()
+	return append([]string(nil), d.in.files...)
+}
+
+// Source returns the source for the given instrumented file, which
+// might also be specified by its base name. If the file is not
+// found, nil is returned.
+func (d *Debugger) Source(file string) []byte {
+	if f := d.resolveFile(file); f != "" {
+		return d.in.source(f)
+	}
+	return nil
+}
+
+func (d *Debugger) resolveFile(file string) string {
+	files := d.Files()
+	for _, v := range files {
+		if v == file {
+			return v
+		}
+	}
+	slashed := filepath.ToSlash(file)
+	for _, v := range files {
+		if strings.HasSuffix(filepath.ToSlash(v), "/"+slashed) {
+			return v
+		}
+	}
+	return ""
+}
+
+// SetBreakpoint sets a breakpoint at the given file and line. If the line
+// contains no statements, the breakpoint is set at the next line with a
+// statement. The file might be specified by its suffix (e.g. its base
+// name). The returned Breakpoint contains the resolved file and line.
+func (d *Debugger) SetBreakpoint(file string, line int) (*Breakpoint, error) {
+	f := d.resolveFile(file)
+	if f == "" {
+		return nil, fmt.Errorf("unknown file %s", file)
+	}
+	resolved := 0
+	d.in.RLock()
+	for _, v := range d.in.probes {
+		if v.file == f && v.line >= line && (resolved == 0 || v.line < resolved) {
+			resolved = v.line
+		}
+	}
+	d.in.RUnlock()
+	if resolved == 0 {
+		return nil, fmt.Errorf("no statements at or after %s:%d", file, line)
+	}
+	bp := Breakpoint{File: f, Line: resolved}
+	d.mu.Lock()
+	if !d.bps[bp] {
+		d.bps[bp] = true
+		d.bpLines[bp.Line] = append(d.bpLines[bp.Line], bp.File)
+	}
+	d.mu.Unlock()
+	return &bp, nil
+}
+
+// ClearBreakpoint removes the breakpoint at the given file and line.
+func (d *Debugger) ClearBreakpoint(file string, line int) error {
+	bp := Breakpoint{File: d.resolveFile(file), Line: line}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.bps[bp] {
+		return fmt.Errorf("no breakpoint at %s:%d", file, line)
+	}
+	delete(d.bps, bp)
+	files := d.bpLines[line]
+	for ii, v := range files {
+		if v == bp.File {
+			files = append(files[:ii], files[ii+1:]...)
+			break
+		}
+	}
+	if len(files) == 0 {
+		delete(d.bpLines, line)
+	} else {
+		d.bpLines[line] = files
+	}
+	return nil
+}
+
+// Breakpoints returns the breakpoints, sorted by file and line.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var bps []*Breakpoint
+	for k := range d.bps {
+		bp := k
+		bps = append(bps, &bp)
+	}
+	sort.Sort(breakpointsByPosition(bps))
+	return bps
+}
+
+// Paused returns the channel where a *Pause is sent every
+// time the script pauses. It must be read from while the
+// debugged script runs, otherwise it would block.
+func (d *Debugger) Paused() <-chan *Pause {
+	return d.pauses
+}
+
+// IsPaused returns true iff the script is paused.
+func (d *Debugger) IsPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// Pause makes the script pause at the next statement.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	d.request = true
+	d.mu.Unlock()
+}
+
+// Continue resumes the script until a breakpoint is found.
+func (d *Debugger) Continue() error {
+	return d.resume(stepNone)
+}
+
+// StepIn resumes the script, pausing at the next statement.
+func (d *Debugger) StepIn() error {
+	return d.resume(stepIn)
+}
+
+// StepOver resumes the script, pausing at the next statement
+// in the same function or in its caller.
+func (d *Debugger) StepOver() error {
+	return d.resume(stepOver)
+}
+
+// StepOut resumes the script, pausing at the next statement
+// after the current function returns.
+func (d *Debugger) StepOut() error {
+	return d.resume(stepOut)
+}
+
+func (d *Debugger) resume(step stepMode) error {
+	d.mu.Lock()
+	if !d.paused {
+		d.mu.Unlock()
+		return ErrNotPaused
+	}
+	d.paused = false
+	d.mu.Unlock()
+	d.commands <- &debugCommand{step: step}
+	return nil
+}
+
+func (d *Debugger) send(cmd *debugCommand) (*debugReply, error) {
+	if !d.IsPaused() {
+		return nil, ErrNotPaused
+	}
+	cmd.reply = make(chan *debugReply, 1)
+	d.commands <- cmd
+	return <-cmd.reply, nil
+}
+
+// Eval evaluates the given expression in the scope of
+// the paused statement.
+func (d *Debugger) Eval(expr string) (*Variable, error) {
+	reply, err := d.send(&debugCommand{eval: expr})
+	if err != nil {
+		return nil, err
+	}
+	return reply.variable, reply.err
+}
+
+// Scopes returns the variables visible from the paused statement,
+// innermost scope first.
+func (d *Debugger) Scopes() ([]*Scope, error) {
+	reply, err := d.send(&debugCommand{scope: true})
+	if err != nil {
+		return nil, err
+	}
+	return reply.scopes, reply.err
+}
+
+func (d *Debugger) hasBreakpoint(p *probe) bool {
+	for _, v := range d.bpLines[p.line] {
+		if v == p.file {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Debugger) statement(c *Context, id int) bool {
+	p := d.in.probe(id)
+	if p == nil {
+		return false
+	}
+	d.mu.Lock()
+	depth := len(d.frames)
+	if depth > 0 {
+		d.frames[depth-1].probe = id
+	}
+	// Pause only once when there are multiple statements
+	// in the breakpoint line.
+	sameLine := d.last != nil && d.last.file == p.file && d.last.line == p.line && d.lastDepth == depth
+	d.last = p
+	d.lastDepth = depth
+	var reason string
+	switch {
+	case p.debugger:
+		reason = PauseDebugger
+	case d.request:
+		reason = PauseRequested
+	case d.step == stepIn,
+		d.step == stepOver && depth <= d.depth,
+		d.step == stepOut && depth < d.depth:
+		reason = PauseStep
+	case !sameLine && d.hasBreakpoint(p):
+		reason = PauseBreakpoint
+	default:
+		d.mu.Unlock()
+		return false
+	}
+	d.request = false
+	d.step = stepNone
+	d.paused = true
+	pause := d.newPause(p, reason)
+	d.mu.Unlock()
+	d.pauses <- pause
+	return true
+}
+
+func (d *Debugger) enter(c *Context, fn int) {
+	d.mu.Lock()
+	d.frames = append(d.frames, debugFrame{fn: fn, probe: -1})
+	d.mu.Unlock()
+}
+
+func (d *Debugger) exit(c *Context, fn int) {
+	d.mu.Lock()
+	if n := len(d.frames); n > 0 {
+		d.frames = d.frames[:n-1]
+	}
+	d.mu.Unlock()
+}
+
+func (d *Debugger) newPause(p *probe, reason string) *Pause {
+	pause := &Pause{
+		File:   p.file,
+		Line:   p.line,
+		Column: p.column,
+		Reason: reason,
+	}
+	if fn := d.in.function(p.fn); fn != nil {
+		pause.Function = fn.name
+	}
+	for ii := len(d.frames) - 1; ii >= 0; ii-- {
+		f := d.frames[ii]
+		frame := new(StackFrame)
+		if fn := d.in.function(f.fn); fn != nil {
+			frame.Function = fn.name
+			frame.File, frame.Line, frame.Column = fn.file, fn.line, fn.column
+		}
+		if fp := d.in.probe(f.probe); fp != nil {
+			frame.File, frame.Line, frame.Column = fp.file, fp.line, fp.column
+		}
+		pause.Stack = append(pause.Stack, frame)
+	}
+	if len(d.frames) == 0 {
+		pause.Stack = append(pause.Stack, &StackFrame{File: p.file, Line: p.line, Column: p.column})
+	}
+	return pause
+}
+
+// pause is called from the JS goroutine when the paused statement
+// is about to be executed. It runs the commands received until the
+// script is resumed. eval is a function which evaluates its argument
+// in the scope of the statement.
+func (d *Debugger) pause(c *Context, eval otto.Value) {
+	d.mu.Lock()
+	d.depth = len(d.frames)
+	fn := -1
+	if d.last != nil {
+		fn = d.last.fn
+	}
+	d.mu.Unlock()
+	for cmd := range d.commands {
+		if cmd.reply == nil {
+			d.mu.Lock()
+			d.step = cmd.step
+			d.mu.Unlock()
+			return
+		}
+		reply := new(debugReply)
+		if cmd.scope {
+			reply.scopes = d.scopes(c, eval, fn)
+		} else {
+			val, err := eval.Call(otto.UndefinedValue(), cmd.eval)
+			if err != nil {
+				reply.err = c.scriptError(err)
+			} else {
+				reply.variable = newVariable(c, cmd.eval, val)
+			}
+		}
+		cmd.reply <- reply
+	}
+}
+
+func (d *Debugger) scopes(c *Context, eval otto.Value, fn int) []*Scope {
+	var scopes []*Scope
+	seen := make(map[string]bool)
+	name := "local"
+	for f := d.in.function(fn); f != nil; f = d.in.function(f.parent) {
+		scope := &Scope{Name: name, Function: f.name}
+		for _, v := range f.locals {
+			if seen[v] {
+				// Shadowed by an inner scope
+				continue
+			}
+			seen[v] = true
+			val, err := eval.Call(otto.UndefinedValue(), v)
+			if err != nil {
+				continue
+			}
+			scope.Variables = append(scope.Variables, newVariable(c, v, val))
+		}
+		scopes = append(scopes, scope)
+		name = "closure"
+	}
+	global := &Scope{Name: "global"}
+	names := c.Globals()
+	sort.Strings(names)
+	for _, v := range names {
+		if seen[v] {
+			continue
+		}
+		if val, err := c.vm.Get(v); err == nil {
+			global.Variables = append(global.Variables, newVariable(c, v, val))
+		}
+	}
+	return append(scopes, global)
+}
+
+func newVariable(c *Context, name string, val otto.Value) *Variable {
+	v := &Variable{Name: name}
+	switch {
+	case val.IsUndefined():
+		v.Type, v.Value = "undefined", "undefined"
+	case val.IsNull():
+		v.Type, v.Value = "null", "null"
+	case val.IsFunction():
+		v.Type, v.Value = "function", "[Function]"
+	case val.IsString():
+		v.Type, v.Value = "string", strconv.Quote(val.String())
+	case val.IsNumber():
+		v.Type, v.Value = "number", val.String()
+	case val.IsBoolean():
+		v.Type, v.Value = "boolean", val.String()
+	default:
+		v.Type = strings.ToLower(val.Class())
+		v.Value = val.String()
+		if s, err := c.vm.Call("JSON.stringify", nil, val); err == nil && s.IsString() {
+			v.Value = s.String()
+		}
+	}
+	if utf8.RuneCountInString(v.Value) > maxVariableLength {
+		v.Value = string([]rune(v.Value)[:maxVariableLength]) + "..."
+	}
+	return v
+}
+
+type breakpointsByPosition []*Breakpoint
+
+func (b breakpointsByPosition) Len() int      { return len(b) }
+func (b breakpointsByPosition) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b breakpointsByPosition) Less(i, j int) bool {
+	if b[i].File != b[j].File {
+		return b[i].File < b[j].File
+	}
+	return b[i].Line < b[j].Line
+}
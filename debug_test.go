@@ -0,0 +1,130 @@
+package macaco
+
+import (
+	"testing"
+)
+
+const debugScript = `function sum(items) {
+    var total = 0;
+    for (var ii = 0; ii < items.length; ii++)
+        total = add(total, items[ii]);
+    return total;
+}
+function add(a, b) {
+    var c = a + b;
+    return c;
+}
+function labels(n) {
+    var found = -1;
+    outer: for (var ii = 0; ii < n; ii++) {
+        for (var jj = 0; jj < n; jj++) {
+            if (ii * jj == 6) { found = ii; break outer; }
+            else if (jj > ii) continue outer;
+            else ;
+        }
+    }
+    return found;
+}
+function fails() {
+    var x = null; return x.foo;
+}`
+
+func newDebugContext(t *testing.T) (*Context, *Debugger) {
+	ctx := newTestingContext(t)
+	d := ctx.Debugger()
+	if err := ctx.LoadScript("debug.js", debugScript); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, d
+}
+
+func TestInstrument(t *testing.T) {
+	ctx, _ := newDebugContext(t)
+	val, err := ctx.Call("sum", nil, []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := val.ToInteger(); n != 6 {
+		t.Errorf("expecting sum = 6, got %v", val)
+	}
+	val, err = ctx.Call("labels", nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := val.ToInteger(); n != 2 {
+		t.Errorf("expecting labels = 2, got %v", val)
+	}
+	_, err = ctx.Call("fails", nil)
+	se, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+	}
+	if se.Line != 23 || se.Column != 26 {
+		t.Errorf("expecting error at 23:26, got %d:%d", se.Line, se.Column)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	ctx, d := newDebugContext(t)
+	bp, err := d.SetBreakpoint("debug.js", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.Line != 8 {
+		t.Errorf("expecting breakpoint at line 8, got %d", bp.Line)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ctx.Call("sum", nil, []int{1, 2})
+		done <- err
+	}()
+	pause := <-d.Paused()
+	if pause.Line != 8 || pause.Function != "add" || pause.Reason != PauseBreakpoint {
+		t.Errorf("expecting pause at add (line 8) due to breakpoint, got %+v", pause)
+	}
+	if len(pause.Stack) != 2 || pause.Stack[1].Function != "sum" || pause.Stack[1].Line != 4 {
+		t.Errorf("unexpected stack %v", pause.Stack)
+	}
+	v, err := d.Eval("a + b * 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "10" || v.Type != "number" {
+		t.Errorf("expecting a + b * 10 = 10, got %+v", v)
+	}
+	scopes, err := d.Scopes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 || scopes[0].Name != "local" || len(scopes[0].Variables) != 3 {
+		t.Fatalf("unexpected scopes %+v", scopes)
+	}
+	if c := scopes[0].Variables[2]; c.Name != "c" || c.Value != "undefined" {
+		t.Errorf("expecting c = undefined, got %+v", c)
+	}
+	if err := d.StepOver(); err != nil {
+		t.Fatal(err)
+	}
+	if pause = <-d.Paused(); pause.Line != 9 {
+		t.Errorf("expecting pause at line 9, got %d", pause.Line)
+	}
+	if err := d.StepOut(); err != nil {
+		t.Fatal(err)
+	}
+	// Next statement in sum is the loop body
+	if pause = <-d.Paused(); pause.Function != "sum" || pause.Line != 4 {
+		t.Errorf("expecting pause at sum (line 4), got %+v", pause)
+	}
+	if err := d.ClearBreakpoint("debug.js", 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Continue(); err != ErrNotPaused {
+		t.Errorf("expecting ErrNotPaused, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package macaco
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rainycape/otto"
+	"github.com/rainycape/otto/parser"
+)
+
+const (
+	// callHelper is the name of a non-enumerable global function
+	// which is used to call functions while recording the thrown
+	// exception, since otto doesn't expose it in its errors.
+	callHelper = "__macaco_call"
+	// errorHelper is a non-enumerable global function which creates
+	// the exceptions thrown by native functions, see throwError.
+	errorHelper = "__macaco_error"
+	// callHelperFile is the file name used when compiling the
+	// call helper. Frames from this file are omitted from stack
+	// traces.
+	callHelperFile = "<macaco>"
+	callHelperSrc  = `(function(global) {
+	if (typeof global.__macaco_call === 'function') {
+		return;
+	}
+	var call = function(f, t) {
+		call.exception = undefined;
+		try {
+			return f.apply(t, Array.prototype.slice.call(arguments, 2));
+		} catch (e) {
+			call.exception = e;
+			throw e;
+		}
+	};
+	Object.defineProperty(global, '__macaco_call', {value: call, enumerable: false});
+	var makeError = function(ctorName, message, code, name) {
+		var ctor = global;
+		var parts = ctorName.split('.');
+		for (var ii = 0; ii < parts.length && ctor; ii++) {
+			ctor = ctor[parts[ii]];
+		}
+		var e = typeof ctor === 'function' ? new ctor(message) : new Error(message);
+		e.message = message;
+		if (code !== undefined) {
+			e.code = code;
+		}
+		if (name && name !== e.name) {
+			e.name = name;
+		}
+		return e;
+	};
+	Object.defineProperty(global, '__macaco_error', {value: makeError, enumerable: false});
+})(this);`
+	nativeLocation = "<native code>"
+	// errorConstructor is the constructor used for the exceptions
+	// thrown by the built-in functions, see throwError.
+	errorConstructor = "M.Error"
+	// errorSrc defines M.Error when the runtime hasn't defined it,
+	// accepting either a message and a code or an *Error.
+	errorSrc = `(function(M) {
+	if (typeof M.Error === 'function') {
+		return;
+	}
+	var E = function(message, code) {
+		if (message !== null && typeof message === 'object') {
+			code = message.Code;
+			message = message.Message;
+		}
+		this.message = message === undefined ? '' : String(message);
+		this.code = code || 0;
+	};
+	E.prototype = Object.create(Error.prototype);
+	E.prototype.constructor = E;
+	E.prototype.name = 'Error';
+	M.Error = E;
+})`
+)
+
+var (
+	frameRe       = regexp.MustCompile(`^\s+at (.*)$`)
+	frameCalleeRe = regexp.MustCompile(`^(.*) \((.*)\)$`)
+	scriptLocRe   = regexp.MustCompile(`^(.*):(\d+):(\d+)$`)
+	nativeLocRe   = regexp.MustCompile(`^(.*):(\d+)$`)
+	errorNameRe   = regexp.MustCompile(`^([A-Za-z_$][\w$]*)?Error$`)
+)
+
+// StackFrame represents a function call in the stack
+// trace of a ScriptError.
+type StackFrame struct {
+	// Function is the called function name, might be empty.
+	Function string
+	File     string
+	Line     int
+	// Column is zero for native frames.
+	Column int
+	// Native is true when the function is implemented in Go.
+	Native bool
+}
+
+func (f *StackFrame) location() string {
+	var loc string
+	switch {
+	case f.File == "":
+		loc = nativeLocation
+	case f.Column > 0:
+		loc = fmt.Sprintf("%s:%d:%d", f.File, f.Line, f.Column)
+	default:
+		loc = fmt.Sprintf("%s:%d", f.File, f.Line)
+	}
+	if f.Function != "" {
+		return fmt.Sprintf("%s (%s)", f.Function, loc)
+	}
+	return loc
+}
+
+func (f *StackFrame) String() string {
+	return f.location()
+}
+
+// ScriptError is the error type returned when a script fails to compile
+// or throws an exception.
+type ScriptError struct {
+	// Name is the error name (e.g. TypeError), might be empty
+	// when the thrown value is not an Error.
+	Name    string
+	Message string
+	// Value is the thrown value. It's only available when the
+	// exception was thrown from a function invoked by Context.Call,
+	// Value.Call or Value.Method, otherwise it's nil.
+	Value *Value
+	// File, Line and Column indicate the position where the
+	// error was thrown. They're empty if unknown.
+	File   string
+	Line   int
+	Column int
+	// Stack contains the stack frames, innermost first. Might
+	// be empty for syntax errors and thrown non-Error values.
+	Stack []*StackFrame
+}
+
+func (e *ScriptError) description() string {
+	if e.Name == "" {
+		return e.Message
+	}
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// Error returns the error description prefixed by its position,
+// if known.
+func (e *ScriptError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.description())
+	}
+	return e.description()
+}
+
+// String returns the error description followed by the stack trace.
+func (e *ScriptError) String() string {
+	s := e.description()
+	for _, v := range e.Stack {
+		s += "\n    at " + v.location()
+	}
+	return s
+}
+
+func parseStackFrame(s string) *StackFrame {
+	f := new(StackFrame)
+	if m := frameCalleeRe.FindStringSubmatch(s); m != nil {
+		f.Function = m[1]
+		s = m[2]
+	}
+	if m := scriptLocRe.FindStringSubmatch(s); m != nil {
+		f.File = m[1]
+		f.Line, _ = strconv.Atoi(m[2])
+		f.Column, _ = strconv.Atoi(m[3])
+	} else if m := nativeLocRe.FindStringSubmatch(s); m != nil {
+		f.File = m[1]
+		f.Line, _ = strconv.Atoi(m[2])
+		f.Native = true
+	} else {
+		f.Native = true
+	}
+	return f
+}
+
+// newScriptError converts an error returned by otto into a *ScriptError.
+// Errors which are already a *ScriptError are returned unchanged.
+func newScriptError(err error) *ScriptError {
+	switch x := err.(type) {
+	case *ScriptError:
+		return x
+	case *otto.Error:
+		se := new(ScriptError)
+		var desc []string
+		for _, line := range strings.Split(strings.TrimRight(x.String(), "\n"), "\n") {
+			if m := frameRe.FindStringSubmatch(line); m != nil {
+				frame := parseStackFrame(m[1])
+				if frame.File == callHelperFile {
+					// Remove the Function.apply call made by the helper
+					if n := len(se.Stack); n > 0 && se.Stack[n-1].Native && se.Stack[n-1].Function == "apply" {
+						se.Stack = se.Stack[:n-1]
+					}
+					continue
+				}
+				se.Stack = append(se.Stack, frame)
+				continue
+			}
+			if len(se.Stack) == 0 {
+				desc = append(desc, line)
+			}
+		}
+		se.setDescription(strings.Join(desc, "\n"))
+		for _, v := range se.Stack {
+			if !v.Native {
+				se.File, se.Line, se.Column = v.File, v.Line, v.Column
+				break
+			}
+		}
+		return se
+	case *parser.Error:
+		return &ScriptError{
+			Name:    "SyntaxError",
+			Message: x.Message,
+			File:    x.Position.Filename,
+			Line:    x.Position.Line,
+			Column:  x.Position.Column,
+		}
+	case parser.ErrorList:
+		if len(x) > 0 {
+			se := newScriptError(x[0])
+			if len(x) > 1 {
+				se.Message += fmt.Sprintf(" (and %d more errors)", len(x)-1)
+			}
+			return se
+		}
+	}
+	// Non-Error values thrown from JS are returned by otto as plain
+	// errors with the value converted to a string. This includes
+	// objects inheriting from Error, like M.Error.
+	se := new(ScriptError)
+	se.setDescription(err.Error())
+	return se
+}
+
+// setDescription sets the error name and message from
+// a description like "TypeError: message".
+func (e *ScriptError) setDescription(desc string) {
+	e.Message = desc
+	if sep := strings.Index(desc, ": "); sep > 0 && errorNameRe.MatchString(desc[:sep]) {
+		e.Name = desc[:sep]
+		e.Message = desc[sep+2:]
+	} else if errorNameRe.MatchString(desc) {
+		e.Name = desc
+		e.Message = ""
+	}
+}
+
+func (c *Context) loadCallHelper() error {
+	script, err := c.vm.Compile(callHelperFile, callHelperSrc)
+	if err != nil {
+		return err
+	}
+	_, err = c.vm.Run(script)
+	return err
+}
+
+func (c *Context) loadErrors(obj *otto.Object) error {
+	script, err := c.vm.Compile(callHelperFile, errorSrc)
+	if err != nil {
+		return err
+	}
+	fn, err := c.vm.Run(script)
+	if err != nil {
+		return err
+	}
+	_, err = fn.Call(otto.UndefinedValue(), obj)
+	return err
+}
+
+// throwError throws a JS exception from a native function. All the
+// errors produced by the built-in functions are thrown following the
+// same rule: they're M.Error instances with a code (0 unless err is an
+// *Error) and their name property set to kind, which is TypeError for
+// invalid arguments, SyntaxError for invalid input data and Error for
+// the rest. Exceptions thrown by JS code called from Go, which arrive
+// as a *ScriptError or an *otto.Error, propagate instead: the thrown
+// value is rethrown when it's known (see Context.callFunction),
+// otherwise a new exception with the same name and message is thrown.
+// It never returns.
+func throwError(vm *otto.Otto, kind string, err error) {
+	throwException(vm, errorConstructor, kind, err)
+}
+
+// throwStandardError works like throwError, but throws an instance of
+// the standard constructor ctor (e.g. SyntaxError) rather than an
+// M.Error. It's only used by the standard JS functions, like
+// JSON.parse, which must throw the errors required by the spec.
+func throwStandardError(vm *otto.Otto, ctor string, err error) {
+	throwException(vm, ctor, "", err)
+}
+
+func throwException(vm *otto.Otto, ctor string, name string, err error) {
+	message := err.Error()
+	var code interface{}
+	switch x := err.(type) {
+	case *Error:
+		message, code = x.Message, x.Code
+	case *ScriptError:
+		if x.Value != nil {
+			panic(x.Value.val)
+		}
+		ctor, name, message = firstNonEmpty(x.Name, "Error"), x.Name, x.Message
+	case *otto.Error:
+		se := newScriptError(x)
+		ctor, name, message = firstNonEmpty(se.Name, "Error"), se.Name, se.Message
+	}
+	helper, herr := vm.Get(errorHelper)
+	if herr != nil || !helper.IsFunction() {
+		panic(err)
+	}
+	exc, herr := helper.Call(otto.UndefinedValue(), ctor, message, code, name)
+	if herr != nil {
+		panic(herr)
+	}
+	panic(exc)
+}
+
+// throwingFunc returns a JS function which calls fn and, if it returns
+// an error, throws an M.Error of the given kind (e.g. SyntaxError) with
+// the error message, see throwError.
+func (c *Context) throwingFunc(kind string, fn func(call otto.FunctionCall) (otto.Value, error)) otto.Value {
+	native := func(call otto.FunctionCall) otto.Value {
+		val, err := fn(call)
+		if err != nil {
+			throwError(call.Otto, kind, err)
+		}
+		return val
+	}
+	val, err := c.vm.ToValue(native)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// callFunction calls fn and, when it throws, returns a *ScriptError
+// which includes the thrown value.
+func (c *Context) callFunction(fn otto.Value, this otto.Value, args []interface{}) (otto.Value, error) {
+	helper, err := c.vm.Get(callHelper)
+	if err != nil || !helper.IsFunction() {
+		// Bare otto VM without the helper
+		val, err := fn.Call(this, args...)
+		if err != nil {
+			return val, c.scriptError(err)
+		}
+		return val, nil
+	}
+	helperArgs := make([]interface{}, 0, len(args)+2)
+	helperArgs = append(helperArgs, fn, this)
+	helperArgs = append(helperArgs, args...)
+	val, err := helper.Call(otto.UndefinedValue(), helperArgs...)
+	if err != nil {
+		se := c.scriptError(err)
+		if exc, err := helper.Object().Get("exception"); err == nil && !exc.IsUndefined() {
+			se.Value = &Value{exc, c}
+			if se.Name == "" && se.Message == "" {
+				se.Message = exc.String()
+			}
+		}
+		return val, se
+	}
+	return val, nil
+}
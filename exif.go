@@ -0,0 +1,351 @@
+package macaco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF tags, see the EXIF 2.3 specification.
+const (
+	exifTagMake              = 0x010f
+	exifTagModel             = 0x0110
+	exifTagOrientation       = 0x0112
+	exifTagSoftware          = 0x0131
+	exifTagDateTime          = 0x0132
+	exifTagExifIFD           = 0x8769
+	exifTagGPSIFD            = 0x8825
+	exifTagDateTimeOriginal  = 0x9003
+	exifTagDateTimeDigitized = 0x9004
+	exifTagGPSLatitudeRef    = 0x0001
+	exifTagGPSLatitude       = 0x0002
+	exifTagGPSLongitudeRef   = 0x0003
+	exifTagGPSLongitude      = 0x0004
+	exifTagGPSAltitudeRef    = 0x0005
+	exifTagGPSAltitude       = 0x0006
+)
+
+// exifTimeFormat is the format used by the EXIF timestamps, which
+// don't include a time zone.
+const exifTimeFormat = "2006:01:02 15:04:05"
+
+// exifTypeSizes contains the size in bytes of each EXIF type.
+var exifTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+}
+
+var errNoExif = errors.New("no EXIF data")
+
+type exifGPS struct {
+	Latitude  float64 `macaco:"latitude"`
+	Longitude float64 `macaco:"longitude"`
+	Altitude  float64 `macaco:"altitude"`
+}
+
+// exif contains the EXIF metadata exposed to JS. Timestamps
+// are interpreted as UTC, since EXIF doesn't store the zone.
+type exif struct {
+	Orientation int       `macaco:"orientation"`
+	Make        string    `macaco:"make,omitempty"`
+	Model       string    `macaco:"model,omitempty"`
+	Camera      string    `macaco:"camera,omitempty"`
+	Software    string    `macaco:"software,omitempty"`
+	Taken       time.Time `macaco:"taken,omitempty"`
+	Digitized   time.Time `macaco:"digitized,omitempty"`
+	Modified    time.Time `macaco:"modified,omitempty"`
+	GPS         *exifGPS  `macaco:"gps,omitempty"`
+}
+
+// exifCamera returns the camera make and model, omitting the make
+// when the model already includes it, as many vendors do.
+func exifCamera(vendor string, model string) string {
+	if vendor == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(vendor)) {
+		return model
+	}
+	if model == "" {
+		return vendor
+	}
+	return vendor + " " + model
+}
+
+type exifEntry struct {
+	typ   uint16
+	count int
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (e *exifEntry) int(idx int) int {
+	switch e.typ {
+	case 1, 7:
+		return int(e.data[idx])
+	case 6:
+		return int(int8(e.data[idx]))
+	case 3:
+		return int(e.order.Uint16(e.data[idx*2:]))
+	case 8:
+		return int(int16(e.order.Uint16(e.data[idx*2:])))
+	case 4:
+		return int(e.order.Uint32(e.data[idx*4:]))
+	case 9:
+		return int(int32(e.order.Uint32(e.data[idx*4:])))
+	}
+	return 0
+}
+
+func (e *exifEntry) float(idx int) float64 {
+	switch e.typ {
+	case 5, 10:
+		num, den := e.order.Uint32(e.data[idx*8:]), e.order.Uint32(e.data[idx*8+4:])
+		if den == 0 {
+			return 0
+		}
+		if e.typ == 10 {
+			return float64(int32(num)) / float64(int32(den))
+		}
+		return float64(num) / float64(den)
+	case 11:
+		return float64(math.Float32frombits(e.order.Uint32(e.data[idx*4:])))
+	case 12:
+		return math.Float64frombits(e.order.Uint64(e.data[idx*8:]))
+	}
+	return float64(e.int(idx))
+}
+
+func (e *exifEntry) string() string {
+	if e.typ != 2 {
+		return ""
+	}
+	s := string(e.data)
+	if p := strings.IndexByte(s, 0); p >= 0 {
+		s = s[:p]
+	}
+	return strings.TrimSpace(s)
+}
+
+func (e *exifEntry) time() time.Time {
+	t, _ := time.Parse(exifTimeFormat, e.string())
+	return t
+}
+
+// exifIFD is an image file directory, with its entries by tag.
+type exifIFD map[uint16]*exifEntry
+
+// exifReader reads the IFDs from a TIFF structure, which is
+// the format used by EXIF.
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newExifReader(data []byte) (*exifReader, error) {
+	if len(data) < 8 {
+		return nil, errNoExif
+	}
+	r := &exifReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order %q", data[:2])
+	}
+	if r.order.Uint16(data[2:]) != 42 {
+		return nil, errors.New("invalid EXIF header")
+	}
+	return r, nil
+}
+
+func (r *exifReader) ifd(offset int) (exifIFD, error) {
+	if offset < 8 || offset+2 > len(r.data) {
+		return nil, fmt.Errorf("invalid EXIF IFD offset %d", offset)
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	offset += 2
+	if offset+count*12 > len(r.data) {
+		return nil, errors.New("truncated EXIF IFD")
+	}
+	ifd := make(exifIFD, count)
+	for ii := 0; ii < count; ii++ {
+		p := r.data[offset+ii*12:]
+		typ := r.order.Uint16(p[2:])
+		size := exifTypeSizes[typ]
+		if size == 0 {
+			// Unknown type, skip it
+			continue
+		}
+		n := int(r.order.Uint32(p[4:]))
+		if n < 0 || n > len(r.data)/size {
+			continue
+		}
+		data := p[8:12]
+		if total := n * size; total > 4 {
+			start := int(r.order.Uint32(p[8:]))
+			if start < 0 || start+total > len(r.data) {
+				continue
+			}
+			data = r.data[start : start+total]
+		} else {
+			data = data[:total]
+		}
+		ifd[r.order.Uint16(p)] = &exifEntry{typ: typ, count: n, data: data, order: r.order}
+	}
+	return ifd, nil
+}
+
+// subIFD returns the IFD pointed by the given tag in ifd,
+// or nil if there's no such tag or it can't be read.
+func (r *exifReader) subIFD(ifd exifIFD, tag uint16) exifIFD {
+	if e := ifd[tag]; e != nil && e.count > 0 {
+		sub, _ := r.ifd(e.int(0))
+		return sub
+	}
+	return nil
+}
+
+// gpsCoordinate returns the coordinate in degrees from an entry with
+// degrees, minutes and seconds, negated if ref is S or W.
+func gpsCoordinate(e *exifEntry, ref *exifEntry) (float64, bool) {
+	if e == nil || e.count < 3 {
+		return 0, false
+	}
+	v := e.float(0) + e.float(1)/60 + e.float(2)/3600
+	if ref != nil {
+		if s := ref.string(); s == "S" || s == "W" {
+			v = -v
+		}
+	}
+	return v, true
+}
+
+// parseExif parses the EXIF metadata from data, which
+// must start with the TIFF header.
+func parseExif(data []byte) (*exif, error) {
+	r, err := newExifReader(data)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := r.ifd(int(r.order.Uint32(data[4:])))
+	if err != nil {
+		return nil, err
+	}
+	e := &exif{Orientation: 1}
+	if v := ifd0[exifTagOrientation]; v != nil && v.count > 0 {
+		if o := v.int(0); o >= 1 && o <= 8 {
+			e.Orientation = o
+		}
+	}
+	if v := ifd0[exifTagMake]; v != nil {
+		e.Make = v.string()
+	}
+	if v := ifd0[exifTagModel]; v != nil {
+		e.Model = v.string()
+	}
+	e.Camera = exifCamera(e.Make, e.Model)
+	if v := ifd0[exifTagSoftware]; v != nil {
+		e.Software = v.string()
+	}
+	if v := ifd0[exifTagDateTime]; v != nil {
+		e.Modified = v.time()
+	}
+	if sub := r.subIFD(ifd0, exifTagExifIFD); sub != nil {
+		if v := sub[exifTagDateTimeOriginal]; v != nil {
+			e.Taken = v.time()
+		}
+		if v := sub[exifTagDateTimeDigitized]; v != nil {
+			e.Digitized = v.time()
+		}
+	}
+	if gps := r.subIFD(ifd0, exifTagGPSIFD); gps != nil {
+		lat, ok1 := gpsCoordinate(gps[exifTagGPSLatitude], gps[exifTagGPSLatitudeRef])
+		lon, ok2 := gpsCoordinate(gps[exifTagGPSLongitude], gps[exifTagGPSLongitudeRef])
+		if ok1 && ok2 {
+			e.GPS = &exifGPS{Latitude: lat, Longitude: lon}
+			if v := gps[exifTagGPSAltitude]; v != nil && v.count > 0 {
+				e.GPS.Altitude = v.float(0)
+				// Reference 1 means below sea level
+				if ref := gps[exifTagGPSAltitudeRef]; ref != nil && ref.count > 0 && ref.int(0) == 1 {
+					e.GPS.Altitude = -e.GPS.Altitude
+				}
+			}
+		}
+	}
+	return e, nil
+}
+
+// jpegExif returns the TIFF structure stored in the EXIF APP1
+// segment of a JPEG image, or errNoExif if there's none.
+func jpegExif(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errNoExif
+	}
+	exifHeader := []byte("Exif\x00\x00")
+	for p := 2; p+4 <= len(data); {
+		if data[p] != 0xff {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := data[p+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte
+			p++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// Markers without a length
+			p += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// Start of scan or end of image, EXIF
+			// must appear before
+			return nil, errNoExif
+		}
+		length := int(binary.BigEndian.Uint16(data[p+2:]))
+		end := p + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		if seg := data[p+4 : end]; marker == 0xe1 && bytes.HasPrefix(seg, exifHeader) {
+			return seg[len(exifHeader):], nil
+		}
+		p = end
+	}
+	return nil, errNoExif
+}
+
+// imageExif returns the EXIF metadata embedded in a JPEG or a TIFF
+// image, or nil if there's none or it can't be parsed.
+func imageExif(data []byte, format string) *exif {
+	var tiff []byte
+	switch format {
+	case "JPEG":
+		var err error
+		if tiff, err = jpegExif(data); err != nil {
+			return nil
+		}
+	case "TIFF":
+		tiff = data
+	default:
+		return nil
+	}
+	e, err := parseExif(tiff)
+	if err != nil {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,311 @@
+package macaco
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rainycape/otto"
+)
+
+const (
+	atomNamespace    = "http://www.w3.org/2005/Atom"
+	contentNamespace = "http://purl.org/rss/1.0/modules/content/"
+	dcNamespace      = "http://purl.org/dc/elements/1.1/"
+)
+
+var (
+	errNotAFeed = errors.New("not an RSS or Atom feed")
+
+	// feedDateLayouts are the date formats found in the wild. RSS uses
+	// RFC 822 with lots of variations, while Atom uses RFC 3339.
+	feedDateLayouts = []string{
+		time.RFC3339,
+		time.RFC1123Z,
+		time.RFC1123,
+		"Mon, 2 Jan 2006 15:04:05 -0700",
+		"Mon, 2 Jan 2006 15:04:05 MST",
+		"Mon, 2 Jan 2006 15:04 -0700",
+		"Mon, 2 Jan 2006 15:04 MST",
+		"2 Jan 2006 15:04:05 -0700",
+		"2 Jan 2006 15:04:05 MST",
+		time.RFC822Z,
+		time.RFC822,
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+	}
+
+	// feedZones are the zone abbreviations defined by RFC 822, which
+	// time.Parse doesn't know.
+	feedZones = map[string]int{
+		"EST": -5 * 3600,
+		"EDT": -4 * 3600,
+		"CST": -6 * 3600,
+		"CDT": -5 * 3600,
+		"MST": -7 * 3600,
+		"MDT": -6 * 3600,
+		"PST": -8 * 3600,
+		"PDT": -7 * 3600,
+	}
+)
+
+// feed is the common structure returned by M.feed.parse for both RSS
+// and Atom feeds. It's converted to JS via JSON, so the field order is
+// preserved and missing values become empty strings and arrays.
+type feed struct {
+	Type        string      `json:"type"`
+	Title       string      `json:"title"`
+	Link        string      `json:"link"`
+	Description string      `json:"description"`
+	Updated     string      `json:"updated"`
+	Items       []*feedItem `json:"items"`
+}
+
+type feedItem struct {
+	ID          string           `json:"id"`
+	Title       string           `json:"title"`
+	Link        string           `json:"link"`
+	Description string           `json:"description"`
+	Content     string           `json:"content"`
+	Author      string           `json:"author"`
+	Published   string           `json:"published"`
+	Updated     string           `json:"updated"`
+	Categories  []string         `json:"categories"`
+	Enclosures  []*feedEnclosure `json:"enclosures"`
+}
+
+type feedEnclosure struct {
+	URL    string `json:"url"`
+	Type   string `json:"type"`
+	Length int64  `json:"length"`
+}
+
+func newFeedItem() *feedItem {
+	return &feedItem{Categories: []string{}, Enclosures: []*feedEnclosure{}}
+}
+
+// feedDate returns the given date in RFC 3339, or the original
+// string if it can't be parsed or its time zone is unknown.
+func feedDate(s string) string {
+	s = strings.TrimSpace(s)
+	for _, v := range feedDateLayouts {
+		// Parse in UTC, so abbreviations don't depend on the
+		// local zone. Unknown ones get a zero offset.
+		t, err := time.ParseInLocation(v, s, time.UTC)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(v, "MST") {
+			name, offset := t.Zone()
+			if off, ok := feedZones[name]; ok {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone(name, off))
+			} else if offset == 0 && name != "UTC" && name != "GMT" {
+				return s
+			}
+		}
+		return t.Format(time.RFC3339)
+	}
+	return s
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseFeed parses an RSS (0.9x, 1.0 or 2.0) or Atom feed.
+func parseFeed(doc *xmlNode) (*feed, error) {
+	var root *xmlNode
+	for c := doc.firstChild; c != nil; c = c.next {
+		if c.typ == nodeTypeElement {
+			root = c
+			break
+		}
+	}
+	if root == nil {
+		return nil, errNotAFeed
+	}
+	switch root.local {
+	case "rss", "RDF":
+		return parseRSS(root)
+	case "feed":
+		return parseAtom(root), nil
+	}
+	return nil, errNotAFeed
+}
+
+func parseRSS(root *xmlNode) (*feed, error) {
+	channel := root.child("channel")
+	if channel == nil {
+		return nil, errNotAFeed
+	}
+	// RSS 2.0 elements have no namespace, while RSS 1.0
+	// uses its own. Match the one used by the channel.
+	ns := func(name string) string {
+		return "{" + channel.space + "}" + name
+	}
+	dc := func(name string) string {
+		return "{" + dcNamespace + "}" + name
+	}
+	f := &feed{
+		Type:        "rss",
+		Title:       channel.childText(ns("title")),
+		Link:        channel.childText(ns("link")),
+		Description: channel.childText(ns("description")),
+		Updated:     feedDate(channel.childText(ns("lastBuildDate"), ns("pubDate"), dc("date"))),
+		Items:       []*feedItem{},
+	}
+	// RSS 1.0 items are siblings of the channel
+	items := channel
+	if root.local == "RDF" {
+		items = root
+	}
+	for el := items.firstChild; el != nil; el = el.next {
+		if !el.matches(ns("item"), nil) {
+			continue
+		}
+		item := newFeedItem()
+		item.Title = el.childText(ns("title"))
+		item.Link = el.childText(ns("link"))
+		item.ID = firstNonEmpty(el.childText(ns("guid")), el.Attr("{http://www.w3.org/1999/02/22-rdf-syntax-ns#}about"), item.Link)
+		item.Description = el.childText(ns("description"))
+		item.Content = el.childText("{" + contentNamespace + "}encoded")
+		item.Author = el.childText(ns("author"), dc("creator"))
+		if published := el.childText(ns("pubDate"), dc("date")); published != "" {
+			item.Published = feedDate(published)
+		}
+		if updated := el.childText("{" + atomNamespace + "}updated"); updated != "" {
+			item.Updated = feedDate(updated)
+		}
+		for c := el.firstChild; c != nil; c = c.next {
+			switch {
+			case c.matches(ns("category"), nil), c.matches(dc("subject"), nil):
+				if cat := strings.TrimSpace(c.Text()); cat != "" {
+					item.Categories = append(item.Categories, cat)
+				}
+			case c.matches(ns("enclosure"), nil):
+				length, _ := strconv.ParseInt(c.Attr("length"), 10, 64)
+				item.Enclosures = append(item.Enclosures, &feedEnclosure{
+					URL:    c.Attr("url"),
+					Type:   c.Attr("type"),
+					Length: length,
+				})
+			}
+		}
+		f.Items = append(f.Items, item)
+	}
+	return f, nil
+}
+
+// atomText returns the contents of an Atom text construct. For
+// xhtml, the markup inside the wrapping div is returned.
+func atomText(n *xmlNode) string {
+	if n == nil {
+		return ""
+	}
+	if n.Attr("type") == "xhtml" {
+		for c := n.firstChild; c != nil; c = c.next {
+			if c.typ == nodeTypeElement {
+				return strings.TrimSpace(c.Inner())
+			}
+		}
+	}
+	return strings.TrimSpace(n.Text())
+}
+
+// atomLink returns the href of the first link with the
+// given rel. Links without rel are alternate links.
+func atomLink(n *xmlNode, ns string, rel string) string {
+	for c := n.firstChild; c != nil; c = c.next {
+		if c.matches(ns+"link", nil) && firstNonEmpty(c.Attr("rel"), "alternate") == rel {
+			return c.Attr("href")
+		}
+	}
+	return ""
+}
+
+func parseAtom(root *xmlNode) *feed {
+	// Use the root namespace, so Atom 0.3 feeds are also supported
+	ns := "{" + root.space + "}"
+	f := &feed{
+		Type:        "atom",
+		Title:       atomText(root.child(ns + "title")),
+		Link:        atomLink(root, ns, "alternate"),
+		Description: atomText(firstNonNil(root.child(ns+"subtitle"), root.child(ns+"tagline"))),
+		Updated:     feedDate(root.childText(ns+"updated", ns+"modified")),
+		Items:       []*feedItem{},
+	}
+	for el := root.firstChild; el != nil; el = el.next {
+		if !el.matches(ns+"entry", nil) {
+			continue
+		}
+		item := newFeedItem()
+		item.ID = el.childText(ns + "id")
+		item.Title = atomText(el.child(ns + "title"))
+		item.Link = atomLink(el, ns, "alternate")
+		item.Description = atomText(el.child(ns + "summary"))
+		item.Content = atomText(el.child(ns + "content"))
+		if author := el.child(ns + "author"); author != nil {
+			item.Author = author.childText(ns + "name")
+		}
+		if published := el.childText(ns+"published", ns+"issued"); published != "" {
+			item.Published = feedDate(published)
+		}
+		if updated := el.childText(ns+"updated", ns+"modified"); updated != "" {
+			item.Updated = feedDate(updated)
+		}
+		for c := el.firstChild; c != nil; c = c.next {
+			switch {
+			case c.matches(ns+"category", nil):
+				if term := c.Attr("term"); term != "" {
+					item.Categories = append(item.Categories, term)
+				}
+			case c.matches(ns+"link", map[string]string{"rel": "enclosure"}):
+				length, _ := strconv.ParseInt(c.Attr("length"), 10, 64)
+				item.Enclosures = append(item.Enclosures, &feedEnclosure{
+					URL:    c.Attr("href"),
+					Type:   c.Attr("type"),
+					Length: length,
+				})
+			}
+		}
+		f.Items = append(f.Items, item)
+	}
+	return f
+}
+
+func firstNonNil(nodes ...*xmlNode) *xmlNode {
+	for _, v := range nodes {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func (c *Context) feedParse(call otto.FunctionCall) (otto.Value, error) {
+	doc, err := parseXML(strings.NewReader(call.Argument(0).String()), c)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	f, err := parseFeed(doc)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	return c.parseJSON(string(data))
+}
+
+func (c *Context) loadFeed(obj *otto.Object) {
+	feedObj := c.newMacacoObject("feed")
+	feedObj.Set("parse", c.throwingFunc("SyntaxError", c.feedParse))
+}
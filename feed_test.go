@@ -0,0 +1,88 @@
+package macaco
+
+import (
+	"strconv"
+	"testing"
+)
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+  <title>Example</title>
+  <link>http://example.com/</link>
+  <description>An example feed</description>
+  <lastBuildDate>Tue, 10 Jun 2003 04:00:00 GMT</lastBuildDate>
+  <item>
+    <title>First post</title>
+    <link>http://example.com/1</link>
+    <description>Short</description>
+    <content:encoded><![CDATA[<p>Long</p>]]></content:encoded>
+    <dc:creator>Ann</dc:creator>
+    <pubDate>Mon, 2 Jun 2003 09:39:21 +0200</pubDate>
+    <category>news</category>
+    <category>go</category>
+    <enclosure url="http://example.com/1.mp3" length="1234" type="audio/mpeg"/>
+  </item>
+</channel>
+</rss>`
+
+const testAtom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Example</title>
+  <subtitle>An example feed</subtitle>
+  <link href="http://example.com/feed" rel="self"/>
+  <link href="http://example.com/"/>
+  <updated>2003-12-13T18:30:02Z</updated>
+  <entry>
+    <title type="html">First &amp;lt;post&amp;gt;</title>
+    <link href="http://example.com/1"/>
+    <link rel="enclosure" href="http://example.com/1.mp3" type="audio/mpeg" length="1234"/>
+    <id>urn:uuid:1</id>
+    <published>2003-12-13T08:29:29-04:00</published>
+    <updated>2003-12-13T18:30:02Z</updated>
+    <author><name>Ann</name></author>
+    <category term="news"/>
+    <summary>Short</summary>
+    <content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Long</p></div></content>
+  </entry>
+</feed>`
+
+func TestFeed(t *testing.T) {
+	ctx := newTestingContext(t)
+	if _, err := ctx.Run("var rss = " + strconv.Quote(testRSS)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Run("var atom = " + strconv.Quote(testAtom)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []jsCase{
+		{`var f = M.feed.parse(rss); delete f.items; JSON.stringify(f)`,
+			`{"type":"rss","title":"Example","link":"http://example.com/","description":"An example feed","updated":"2003-06-10T04:00:00Z"}`},
+		{`JSON.stringify(M.feed.parse(rss).items)`,
+			`[{"id":"http://example.com/1","title":"First post","link":"http://example.com/1","description":"Short","content":"<p>Long</p>","author":"Ann","published":"2003-06-02T09:39:21+02:00","updated":"","categories":["news","go"],"enclosures":[{"url":"http://example.com/1.mp3","type":"audio/mpeg","length":1234}]}]`},
+		{`var f = M.feed.parse(atom); delete f.items; JSON.stringify(f)`,
+			`{"type":"atom","title":"Example","link":"http://example.com/","description":"An example feed","updated":"2003-12-13T18:30:02Z"}`},
+		{`JSON.stringify(M.feed.parse(atom).items)`,
+			`[{"id":"urn:uuid:1","title":"First &lt;post&gt;","link":"http://example.com/1","description":"Short","content":"<p>Long</p>","author":"Ann","published":"2003-12-13T08:29:29-04:00","updated":"2003-12-13T18:30:02Z","categories":["news"],"enclosures":[{"url":"http://example.com/1.mp3","type":"audio/mpeg","length":1234}]}]`},
+		{`try { M.feed.parse('<html></html>') } catch (e) { e.name + ': ' + e.message }`, `SyntaxError: not an RSS or Atom feed`},
+	}
+	runJSCases(t, ctx, cases)
+}
+
+func TestFeedDate(t *testing.T) {
+	cases := map[string]string{
+		"Tue, 10 Jun 2003 04:00:00 GMT":   "2003-06-10T04:00:00Z",
+		"Tue, 10 Jun 2003 04:00:00 EST":   "2003-06-10T04:00:00-05:00",
+		"Tue, 10 Jun 2003 04:00:00 PDT":   "2003-06-10T04:00:00-07:00",
+		"10 Jun 2003 04:00:00 CST":        "2003-06-10T04:00:00-06:00",
+		"Tue, 10 Jun 2003 04:00:00 +0200": "2003-06-10T04:00:00+02:00",
+		// Unknown zone, keep the original
+		"Tue, 10 Jun 2003 04:00:00 XYZ": "Tue, 10 Jun 2003 04:00:00 XYZ",
+		"not a date":                    "not a date",
+	}
+	for k, v := range cases {
+		if d := feedDate(k); d != v {
+			t.Errorf("expecting feedDate(%q) = %q, got %q", k, v, d)
+		}
+	}
+}
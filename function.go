@@ -0,0 +1,138 @@
+package macaco
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rainycape/otto"
+)
+
+var (
+	contextType      = reflect.TypeOf((*Context)(nil))
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+	functionCallType = reflect.TypeOf(otto.FunctionCall{})
+)
+
+// Function returns a JS function which calls the Go function fn. The JS
+// arguments are converted to the parameter types as Value.Export does,
+// throwing an M.Error named TypeError if they can't be converted. A
+// leading *Context parameter receives c, while *Value and
+// otto.FunctionCall parameters receive the raw arguments. Since the
+// function is bound to c, functions which should receive the copies of
+// c must be registered with Register.
+//
+// fn might return a value, an error or both. A non-nil error is thrown
+// as an M.Error with the error message and, if it's an *Error, its
+// code, see throwError. Errors returned from Value.Call and Context.Call
+// are thrown again, so exceptions propagate through Go functions.
+// Functions with the signature func(otto.FunctionCall) otto.Value are
+// returned as is.
+func (c *Context) Function(fn interface{}) (*Value, error) {
+	if f, ok := fn.(func(otto.FunctionCall) otto.Value); ok {
+		val, err := c.vm.ToValue(f)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{val, c}, nil
+	}
+	fnVal := reflect.ValueOf(fn)
+	if fn == nil || fnVal.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%T is not a function", fn)
+	}
+	typ := fnVal.Type()
+	returnsError := typ.NumOut() > 0 && typ.Out(typ.NumOut()-1) == errorType
+	switch {
+	case typ.NumOut() > 2:
+		return nil, fmt.Errorf("%s has more than two results", typ)
+	case typ.NumOut() == 2 && !returnsError:
+		return nil, fmt.Errorf("%s second result must be an error", typ)
+	}
+	native := func(call otto.FunctionCall) otto.Value {
+		args, err := c.functionArguments(typ, call)
+		if err != nil {
+			throwError(call.Otto, "TypeError", err)
+		}
+		out := fnVal.Call(args)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				throwError(call.Otto, "Error", err)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return otto.UndefinedValue()
+		}
+		val, err := c.ottoValue(out[0].Interface())
+		if err != nil {
+			throwError(call.Otto, "TypeError", err)
+		}
+		return val
+	}
+	val, err := c.vm.ToValue(native)
+	if err != nil {
+		return nil, err
+	}
+	return &Value{val, c}, nil
+}
+
+// mustFunction is a shorthand for the built-in functions, which
+// are known to have a valid signature.
+func (c *Context) mustFunction(fn interface{}) otto.Value {
+	val, err := c.Function(fn)
+	if err != nil {
+		panic(err)
+	}
+	return val.val
+}
+
+func (c *Context) functionArguments(typ reflect.Type, call otto.FunctionCall) ([]reflect.Value, error) {
+	args := make([]reflect.Value, 0, typ.NumIn())
+	pos := 0
+	for ii := 0; ii < typ.NumIn(); ii++ {
+		in := typ.In(ii)
+		switch {
+		case ii == 0 && in == contextType:
+			args = append(args, reflect.ValueOf(c))
+			continue
+		case in == functionCallType:
+			args = append(args, reflect.ValueOf(call))
+			continue
+		}
+		if ii == typ.NumIn()-1 && typ.IsVariadic() {
+			for ; pos < len(call.ArgumentList); pos++ {
+				arg, err := c.functionArgument(in.Elem(), call.ArgumentList[pos])
+				if err != nil {
+					return nil, fmt.Errorf("argument %d: %s", pos+1, err)
+				}
+				args = append(args, arg)
+			}
+			break
+		}
+		arg, err := c.functionArgument(in, call.Argument(pos))
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", pos+1, err)
+		}
+		args = append(args, arg)
+		pos++
+	}
+	return args, nil
+}
+
+func (c *Context) functionArgument(typ reflect.Type, val otto.Value) (reflect.Value, error) {
+	switch typ {
+	case valueType:
+		return reflect.ValueOf(&Value{val, c}), nil
+	case ottoValueType:
+		return reflect.ValueOf(val), nil
+	}
+	// Go values wrapped by the VM, like HTML nodes
+	if x, err := val.Export(); err == nil && x != nil && reflect.TypeOf(x).AssignableTo(typ) {
+		return reflect.ValueOf(x).Convert(typ), nil
+	}
+	arg := reflect.New(typ).Elem()
+	v := &Value{val, c}
+	if err := v.exportInto(arg, val); err != nil {
+		return reflect.Value{}, err
+	}
+	return arg, nil
+}
@@ -22,14 +22,14 @@ const (
 
 type node struct {
 	node *html.Node
-	vm   *otto.Otto
+	ctx  *Context
 }
 
-func asNode(n *html.Node, vm *otto.Otto) *node {
+func asNode(n *html.Node, ctx *Context) *node {
 	if n == nil {
 		return nil
 	}
-	return &node{n, vm}
+	return &node{n, ctx}
 }
 
 func (n *node) String() string {
@@ -41,31 +41,31 @@ func (n *node) String() string {
 }
 
 func (n *node) Parent() *node {
-	return asNode(n.node.Parent, n.vm)
+	return asNode(n.node.Parent, n.ctx)
 }
 
 func (n *node) Next() *node {
-	return asNode(n.node.NextSibling, n.vm)
+	return asNode(n.node.NextSibling, n.ctx)
 }
 
 func (n *node) Prev() *node {
-	return asNode(n.node.PrevSibling, n.vm)
+	return asNode(n.node.PrevSibling, n.ctx)
 }
 
 func (n *node) FirstChild() *node {
-	return asNode(n.node.FirstChild, n.vm)
+	return asNode(n.node.FirstChild, n.ctx)
 }
 
 func (n *node) LastChild() *node {
-	return asNode(n.node.LastChild, n.vm)
+	return asNode(n.node.LastChild, n.ctx)
 }
 
 func (n *node) Children() otto.Value {
 	var children []*node
 	for nn := n.node.FirstChild; nn != nil; nn = nn.NextSibling {
-		children = append(children, asNode(nn, n.vm))
+		children = append(children, asNode(nn, n.ctx))
 	}
-	v, err := n.vm.ToValue(children)
+	v, err := n.ctx.vm.ToValue(children)
 	if err != nil {
 		panic(err)
 	}
@@ -101,7 +101,9 @@ func (n *node) Attr(name string) string {
 	return ""
 }
 
-func (n *node) matchArguments(call otto.FunctionCall) (string, map[string]string, error) {
+// matchArguments returns the name and attributes to match from the
+// arguments of a Find or Matches call, both optional.
+func matchArguments(call otto.FunctionCall) (string, map[string]string, error) {
 	var name string
 	var attrs map[string]string
 	for _, arg := range call.ArgumentList {
@@ -146,9 +148,9 @@ func (n *node) matchArguments(call otto.FunctionCall) (string, map[string]string
 }
 
 func (n *node) Matches(call otto.FunctionCall) bool {
-	name, attrs, err := n.matchArguments(call)
+	name, attrs, err := matchArguments(call)
 	if err != nil {
-		panic(err)
+		throwError(n.ctx.vm, "TypeError", err)
 	}
 	return n.matches(name, attrs)
 }
@@ -161,64 +163,53 @@ func (n *node) matches(name string, attrs map[string]string) bool {
 		return false
 	}
 	for k, v := range attrs {
-		val := n.Attr(k)
-		switch {
-		case v == "":
-			if val == "" {
-				return false
-			}
-		case v[0] == '|':
-			if !strings.HasPrefix(val, v[1:]) {
-				return false
-			}
-		case v[0] == '~':
-			words := strings.Split(val, " ")
-			contains := false
-			for _, w := range words {
-				if w != "" && w == v[1:] {
-					contains = true
-					break
-				}
-			}
-			if !contains {
-				return false
-			}
-		case v[0] == '*':
-			if !strings.Contains(val, v[1:]) {
-				return false
-			}
-		case v[0] == '$':
-			if !strings.HasSuffix(val, v[1:]) {
-				return false
-			}
-		case v[0] == '=':
-			if val != v[1:] {
-				return false
-			}
-		default:
-			if val != v {
-				return false
-			}
-
+		if !matchAttr(n.Attr(k), v) {
+			return false
 		}
 	}
 	return true
 }
 
+// matchAttr returns true if the attribute value val matches v, which
+// might start with an operator: | (prefix), ~ (word), * (substring),
+// $ (suffix) or = (equality). An empty v matches any non-empty value.
+func matchAttr(val string, v string) bool {
+	switch {
+	case v == "":
+		return val != ""
+	case v[0] == '|':
+		return strings.HasPrefix(val, v[1:])
+	case v[0] == '~':
+		for _, w := range strings.Split(val, " ") {
+			if w != "" && w == v[1:] {
+				return true
+			}
+		}
+		return false
+	case v[0] == '*':
+		return strings.Contains(val, v[1:])
+	case v[0] == '$':
+		return strings.HasSuffix(val, v[1:])
+	case v[0] == '=':
+		return val == v[1:]
+	}
+	return val == v
+}
+
 func (n *node) Find(call otto.FunctionCall) otto.Value {
-	name, attrs, err := n.matchArguments(call)
+	name, attrs, err := matchArguments(call)
 	if err != nil {
-		panic(err)
+		throwError(n.ctx.vm, "TypeError", err)
 	}
 	var nodes []*node
 	n.visit(n.node, func(node *html.Node) bool {
-		nn := asNode(node, n.vm)
+		nn := asNode(node, n.ctx)
 		if nn.matches(name, attrs) {
 			nodes = append(nodes, nn)
 		}
 		return false
 	})
-	v, err := n.vm.ToValue(nodes)
+	v, err := n.ctx.vm.ToValue(nodes)
 	if err != nil {
 		panic(err)
 	}
@@ -255,18 +246,18 @@ func (n *node) visit(node *html.Node, f func(*html.Node) bool) bool {
 func (n *node) Visit(call otto.FunctionCall) otto.Value {
 	fn := call.Argument(0)
 	if fn.IsFunction() {
-		thisVal, err := n.vm.ToValue(nil)
+		thisVal, err := n.ctx.vm.ToValue(nil)
 		if err != nil {
 			panic(err)
 		}
 		n.visit(n.node, func(node *html.Node) bool {
-			nodeVal, err := n.vm.ToValue(asNode(node, n.vm))
+			nodeVal, err := n.ctx.vm.ToValue(asNode(node, n.ctx))
 			if err != nil {
 				panic(err)
 			}
-			res, err := fn.Call(thisVal, nodeVal)
+			res, err := n.ctx.callFunction(fn, thisVal, []interface{}{nodeVal})
 			if err != nil {
-				panic(err)
+				throwError(n.ctx.vm, "Error", err)
 			}
 			if b, _ := res.ToBoolean(); b {
 				return true
@@ -277,46 +268,43 @@ func (n *node) Visit(call otto.FunctionCall) otto.Value {
 	return otto.Value{}
 }
 
-func (c *Context) htmlParse(call otto.FunctionCall) otto.Value {
-	doc, err := html.Parse(strings.NewReader(call.Argument(0).String()))
-	if err != nil {
-		c.Errorf("error parsing HTML: %s\n", err)
-		return otto.Value{}
+func (c *Context) htmlParse(call otto.FunctionCall) (otto.Value, error) {
+	src := call.Argument(0).String()
+	if p := c.profile(); p != nil {
+		defer p.endHTMLParse(p.beginHTMLParse(len(src), false))
 	}
-	val, err := c.vm.ToValue(asNode(doc, c.vm))
+	doc, err := html.Parse(strings.NewReader(src))
 	if err != nil {
-		panic(err)
+		return otto.Value{}, fmt.Errorf("error parsing HTML: %s", err)
 	}
-	return val
+	return c.vm.ToValue(asNode(doc, c))
 }
 
-func (c *Context) htmlParseFragment(call otto.FunctionCall) otto.Value {
+func (c *Context) htmlParseFragment(call otto.FunctionCall) (otto.Value, error) {
 	fragment := call.Argument(0).String()
 	var ctx *html.Node
 	arg1, _ := call.Argument(1).Export()
 	if c, ok := arg1.(*node); ok {
 		ctx = c.node
 	}
+	if p := c.profile(); p != nil {
+		defer p.endHTMLParse(p.beginHTMLParse(len(fragment), true))
+	}
 	nodes, err := html.ParseFragment(strings.NewReader(fragment), ctx)
 	if err != nil {
-		c.Errorf("error parsing HTML fragment: %s\n", err)
-		return otto.Value{}
+		return otto.Value{}, fmt.Errorf("error parsing HTML fragment: %s", err)
 	}
 	values := make([]*node, len(nodes))
 	for ii, v := range nodes {
-		values[ii] = asNode(v, c.vm)
-	}
-	val, err := c.vm.ToValue(values)
-	if err != nil {
-		panic(err)
+		values[ii] = asNode(v, c)
 	}
-	return val
+	return c.vm.ToValue(values)
 }
 
 func (c *Context) loadHTML(obj *otto.Object) {
 	htmlObject := c.newMacacoObject("html")
-	htmlObject.Set("parse", c.htmlParse)
-	htmlObject.Set("parse_fragment", c.htmlParseFragment)
+	htmlObject.Set("parse", c.throwingFunc("SyntaxError", c.htmlParse))
+	htmlObject.Set("parse_fragment", c.throwingFunc("SyntaxError", c.htmlParseFragment))
 	htmlObject.Set("_parses_doctype_node", true)
 	htmlObject.Set("escape", html.EscapeString)
 	htmlObject.Set("unescape", html.UnescapeString)
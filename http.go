@@ -48,8 +48,7 @@ func (c *Context) sendHttpRequest(method string, call otto.FunctionCall) otto.Va
 		for _, k := range obj.Keys() {
 			val, err := obj.Get(k)
 			if err != nil {
-				c.Errorf("error getting object key %q: %s", k, err)
-				return otto.Value{}
+				throwError(call.Otto, "TypeError", fmt.Errorf("error getting object key %q: %s", k, err))
 			}
 			values.Add(k, val.String())
 			qs = values.Encode()
@@ -77,21 +76,18 @@ func (c *Context) sendHttpRequest(method string, call otto.FunctionCall) otto.Va
 		for _, k := range obj.Keys() {
 			val, err := obj.Get(k)
 			if err != nil {
-				c.Errorf("error getting object key %q: %s", k, err)
-				return otto.Value{}
+				throwError(call.Otto, "TypeError", fmt.Errorf("error getting object key %q: %s", k, err))
 			}
 			switch strings.ToLower(k) {
 			case "headers":
 				if !val.IsObject() {
-					c.Errorf("headers must be an object")
-					return otto.Value{}
+					throwError(call.Otto, "TypeError", fmt.Errorf("headers must be an object"))
 				}
 				hobj := val.Object()
 				for _, hk := range hobj.Keys() {
 					hval, err := hobj.Get(hk)
 					if err != nil {
-						c.Errorf("error getting object key %q: %s", k, err)
-						return otto.Value{}
+						throwError(call.Otto, "TypeError", fmt.Errorf("error getting object key %q: %s", k, err))
 					}
 					req.Header.Add(hk, hval.String())
 				}
@@ -106,19 +102,40 @@ func (c *Context) sendHttpRequest(method string, call otto.FunctionCall) otto.Va
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		}
 	}
+	var rec *HTTPRequestProfile
+	if p := c.profile(); p != nil {
+		rec = p.beginHTTPRequest(method, u)
+		defer p.endHTTPRequest(rec)
+	}
 	if cache && !methodHasBody(method) {
 		// Try cache
 		if entry, err := c.cache.cachedEntry(u); err == nil {
 			c.Debugf("cached response from %s\n", u)
+			if rec != nil {
+				rec.Cached = true
+				rec.StatusCode = entry.StatusCode
+				rec.Bytes = len(entry.Data)
+			}
 			return c.newHTTPResponse(u, entry.URL, entry.Data, entry.StatusCode, entry.Header)
 		}
 	}
-	resp, err := c.httpClient().Do(req)
+	c.httpRequests++
+	resp, err := c.doHTTPRequest(req)
 	if err != nil {
+		if rec != nil {
+			rec.Error = err.Error()
+		}
 		return c.responseError(err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	if rec != nil {
+		rec.StatusCode = resp.StatusCode
+		rec.Bytes = len(body)
+		if err != nil {
+			rec.Error = err.Error()
+		}
+	}
 	if err != nil {
 		return c.responseError(err)
 	}
@@ -143,7 +160,9 @@ func (c *Context) makeHttpRequest(method string, call otto.FunctionCall) otto.Va
 	val := c.sendHttpRequest(method, call)
 	callback := call.Argument(len(call.ArgumentList) - 1)
 	if callback.IsFunction() {
-		callback.Call(otto.Value{}, val)
+		if _, err := c.callFunction(callback, otto.UndefinedValue(), []interface{}{val}); err != nil {
+			throwError(c.vm, "Error", err)
+		}
 	}
 	return val
 }
@@ -167,6 +186,13 @@ func (c *Context) httpClient() *http.Client {
 	return http.DefaultClient
 }
 
+func (c *Context) doHTTPRequest(req *http.Request) (*http.Response, error) {
+	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return c.httpClient().Do(req)
+}
+
 func (c *Context) loadHTTP(obj *otto.Object) {
 	httpObj := c.newMacacoObject("http")
 	httpObj.Set("request", c.httpRequest)
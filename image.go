@@ -1,19 +1,42 @@
 package macaco
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
 	"image"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
-	"io"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"sort"
 	"strings"
 
+	_ "code.google.com/p/go.image/bmp"
+	_ "code.google.com/p/go.image/tiff"
+	_ "code.google.com/p/go.image/webp"
 	"github.com/rainycape/otto"
 )
 
+// maxImagePixels is the maximum number of pixels in the images
+// created by decoding or transforming, since allocating too much
+// memory can't be recovered from.
+const maxImagePixels = 1 << 26
+
+// checkImageSize returns an error if an image with the given
+// size would have more than maxImagePixels.
+func checkImageSize(width int, height int) error {
+	if width > 0 && height > 0 && width > maxImagePixels/height {
+		return fmt.Errorf("image size %dx%d is too big, the maximum is %d pixels", width, height, maxImagePixels)
+	}
+	return nil
+}
+
 type _image struct {
 	image.Image
 	format string
+	c      *Context
 }
 
 func (i *_image) Width() int {
@@ -28,16 +51,452 @@ func (i *_image) Format() string {
 	return i.format
 }
 
+// derive returns a new image, with the same format, which
+// wraps im.
+func (i *_image) derive(im image.Image) *_image {
+	return &_image{Image: im, format: i.format, c: i.c}
+}
+
+// value returns the image as a JS value, for the methods
+// receiving an otto.FunctionCall.
+func (i *_image) value() otto.Value {
+	val, err := i.c.vm.ToValue(i)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func (i *_image) throw(err error) {
+	throwError(i.c.vm, "Error", err)
+}
+
+func intArgument(call otto.FunctionCall, idx int) int {
+	v, _ := call.Argument(idx).ToInteger()
+	return int(v)
+}
+
+// At returns the color of the pixel at (x, y), relative to the top left
+// corner, as an object with the r, g, b and a components in [0, 255],
+// not premultiplied. Pixels outside of the image are transparent.
+func (i *_image) At(x int, y int) otto.Value {
+	b := i.Bounds()
+	var c color.NRGBA
+	// Most images don't return transparent pixels outside
+	// of their bounds, e.g. JPEG or grayscale images.
+	if pt := image.Pt(b.Min.X+x, b.Min.Y+y); pt.In(b) {
+		c = color.NRGBAModel.Convert(i.Image.At(pt.X, pt.Y)).(color.NRGBA)
+	}
+	obj, err := i.c.vm.Object("({})")
+	if err != nil {
+		panic(err)
+	}
+	obj.Set("r", c.R)
+	obj.Set("g", c.G)
+	obj.Set("b", c.B)
+	obj.Set("a", c.A)
+	return obj.Value()
+}
+
+// Resize returns the image resized to (width, height), using the
+// filter given as the third argument: nearest, linear (the default),
+// cubic or lanczos. If either the width or the height is zero, it's
+// calculated to preserve the aspect ratio.
+func (i *_image) Resize(call otto.FunctionCall) otto.Value {
+	width, height := intArgument(call, 0), intArgument(call, 1)
+	w, h := i.Width(), i.Height()
+	switch {
+	case width == 0 && height > 0 && h > 0:
+		width = (w*height + h/2) / h
+	case height == 0 && width > 0 && w > 0:
+		height = (h*width + w/2) / w
+	}
+	var filter string
+	if arg := call.Argument(2); arg.IsDefined() {
+		filter = arg.String()
+	}
+	im, err := resizeImage(i.Image, width, height, filter)
+	if err != nil {
+		i.throw(err)
+	}
+	return i.derive(im).value()
+}
+
+// Crop returns the rectangle with its top left corner at (x, y) and the
+// given width and height, intersected with the image bounds.
+func (i *_image) Crop(x int, y int, width int, height int) *_image {
+	if width < 0 || height < 0 {
+		i.throw(fmt.Errorf("invalid crop size %dx%d", width, height))
+	}
+	b := i.Bounds()
+	r := image.Rect(x, y, x+width, y+height).Add(b.Min).Intersect(b)
+	if err := checkImageSize(r.Dx(), r.Dy()); err != nil {
+		i.throw(err)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for yy := 0; yy < r.Dy(); yy++ {
+		for xx := 0; xx < r.Dx(); xx++ {
+			dst.Set(xx, yy, i.Image.At(r.Min.X+xx, r.Min.Y+yy))
+		}
+	}
+	return i.derive(dst)
+}
+
+// transform returns a new image with size (w, h), with each pixel
+// (x, y) from the source copied to the point returned by f.
+func (i *_image) transform(w int, h int, f func(x, y int) (int, int)) *_image {
+	if err := checkImageSize(w, h); err != nil {
+		i.throw(err)
+	}
+	src := toRGBA(i.Image)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			dx, dy := f(x, y)
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):])
+		}
+	}
+	return i.derive(dst)
+}
+
+// Rotate returns the image rotated clockwise by the given degrees,
+// which must be a multiple of 90.
+func (i *_image) Rotate(degrees int) *_image {
+	if degrees%90 != 0 {
+		i.throw(fmt.Errorf("can't rotate by %d degrees, only multiples of 90 are supported", degrees))
+	}
+	w, h := i.Width(), i.Height()
+	switch (degrees/90%4 + 4) % 4 {
+	case 1:
+		return i.transform(h, w, func(x, y int) (int, int) { return h - 1 - y, x })
+	case 2:
+		return i.transform(w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 3:
+		return i.transform(h, w, func(x, y int) (int, int) { return y, w - 1 - x })
+	}
+	return i.transform(w, h, func(x, y int) (int, int) { return x, y })
+}
+
+// Flip returns the image flipped horizontally (the default)
+// or vertically, when the argument is "vertical" or "v".
+func (i *_image) Flip(call otto.FunctionCall) otto.Value {
+	w, h := i.Width(), i.Height()
+	var dir string
+	if arg := call.Argument(0); arg.IsDefined() {
+		dir = strings.ToLower(arg.String())
+	}
+	switch dir {
+	case "", "h", "horizontal":
+		return i.transform(w, h, func(x, y int) (int, int) { return w - 1 - x, y }).value()
+	case "v", "vertical":
+		return i.transform(w, h, func(x, y int) (int, int) { return x, h - 1 - y }).value()
+	}
+	i.throw(fmt.Errorf("invalid flip direction %q", dir))
+	return otto.Value{}
+}
+
+// orient returns the image transformed according to the given EXIF
+// orientation, so its top left corner is the first pixel.
+func (i *_image) orient(orientation int) *_image {
+	w, h := i.Width(), i.Height()
+	switch orientation {
+	case 2:
+		return i.transform(w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case 3:
+		return i.Rotate(180)
+	case 4:
+		return i.transform(w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	case 5:
+		// Transpose
+		return i.transform(h, w, func(x, y int) (int, int) { return y, x })
+	case 6:
+		return i.Rotate(90)
+	case 7:
+		// Transverse
+		return i.transform(h, w, func(x, y int) (int, int) { return h - 1 - y, w - 1 - x })
+	case 8:
+		return i.Rotate(270)
+	}
+	return i
+}
+
+// ToGray returns the image converted to grayscale.
+func (i *_image) ToGray() *_image {
+	b := i.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(x, y, i.Image.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return i.derive(dst)
+}
+
+// Encode encodes the image in the given format (png, jpeg or gif),
+// returning its bytes as a binary string, like HTTP response bodies,
+// which can be passed to M.image.decode. The optional second argument
+// accepts the quality for jpeg, from 1 to 100.
+func (i *_image) Encode(call otto.FunctionCall) otto.Value {
+	format := strings.ToLower(call.Argument(0).String())
+	var opts struct {
+		Quality int `macaco:"quality"`
+	}
+	if arg := call.Argument(1); arg.IsObject() {
+		if err := (&Value{arg, i.c}).Export(&opts); err != nil {
+			throwError(i.c.vm, "TypeError", err)
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, i.Image)
+	case "jpeg", "jpg":
+		quality := opts.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		if quality < 1 || quality > 100 {
+			i.throw(fmt.Errorf("invalid jpeg quality %d", quality))
+		}
+		err = jpeg.Encode(&buf, i.Image, &jpeg.Options{Quality: quality})
+	case "gif":
+		err = gif.Encode(&buf, i.Image, nil)
+	default:
+		err = fmt.Errorf("unsupported image format %q", format)
+	}
+	if err != nil {
+		i.throw(err)
+	}
+	val, err := i.c.vm.ToValue(buf.String())
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// grayMatrix returns the image resized to (w, h) as a matrix of
+// luminance values, indexed by row.
+func (i *_image) grayMatrix(w int, h int) [][]float64 {
+	im, err := resizeImage(i.Image, w, h, "linear")
+	if err != nil {
+		i.throw(err)
+	}
+	m := make([][]float64, h)
+	for y := range m {
+		m[y] = make([]float64, w)
+		for x := range m[y] {
+			off := im.PixOffset(x, y)
+			m[y][x] = 0.299*float64(im.Pix[off]) + 0.587*float64(im.Pix[off+1]) + 0.114*float64(im.Pix[off+2])
+		}
+	}
+	return m
+}
+
+// hashString returns the hash bits, with the first one
+// as the most significant, as a hex string.
+func hashString(bits []bool) string {
+	var h uint64
+	for _, v := range bits {
+		h <<= 1
+		if v {
+			h |= 1
+		}
+	}
+	return fmt.Sprintf("%016x", h)
+}
+
+// AHash returns the average hash of the image as a 16 character
+// hex string. Each bit indicates if a pixel of the image reduced
+// to 8x8 is brighter than the mean.
+func (i *_image) AHash() string {
+	m := i.grayMatrix(8, 8)
+	var mean float64
+	for _, row := range m {
+		for _, v := range row {
+			mean += v
+		}
+	}
+	mean /= 64
+	bits := make([]bool, 0, 64)
+	for _, row := range m {
+		for _, v := range row {
+			bits = append(bits, v > mean)
+		}
+	}
+	return hashString(bits)
+}
+
+// DHash returns the difference hash of the image as a 16 character
+// hex string. Each bit indicates if a pixel of the image reduced
+// to 9x8 is brighter than the one at its right.
+func (i *_image) DHash() string {
+	m := i.grayMatrix(9, 8)
+	bits := make([]bool, 0, 64)
+	for _, row := range m {
+		for x := 0; x < 8; x++ {
+			bits = append(bits, row[x] > row[x+1])
+		}
+	}
+	return hashString(bits)
+}
+
+// dct returns the 2D DCT-II of the square matrix m.
+func dct(m [][]float64) [][]float64 {
+	n := len(m)
+	cos := make([][]float64, n)
+	for u := range cos {
+		cos[u] = make([]float64, n)
+		for x := range cos[u] {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*n))
+		}
+	}
+	// Rows first, then columns
+	tmp := make([][]float64, n)
+	for y := range tmp {
+		tmp[y] = make([]float64, n)
+		for u := range tmp[y] {
+			for x, v := range m[y] {
+				tmp[y][u] += v * cos[u][x]
+			}
+		}
+	}
+	res := make([][]float64, n)
+	for v := range res {
+		res[v] = make([]float64, n)
+		for u := range res[v] {
+			for y := range tmp {
+				res[v][u] += tmp[y][u] * cos[v][y]
+			}
+		}
+	}
+	return res
+}
+
+// PHash returns the perceptual hash of the image as a 16 character
+// hex string. Each bit indicates if one of the 8x8 lowest frequencies
+// of the DCT of the image reduced to 32x32 is above the median. It's
+// more robust than AHash and DHash against scaling, compression and
+// small color changes.
+func (i *_image) PHash() string {
+	freqs := dct(i.grayMatrix(32, 32))
+	values := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		values = append(values, freqs[y][:8]...)
+	}
+	// The DC coefficient is excluded from the median,
+	// since it would dominate the rest.
+	sorted := make([]float64, len(values)-1)
+	copy(sorted, values[1:])
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	bits := make([]bool, len(values))
+	for ii, v := range values {
+		bits[ii] = v > median
+	}
+	return hashString(bits)
+}
+
+// Diff compares the image with the one received as argument, which is
+// resized to the same size if needed. It returns an object with the
+// similarity, from 0 (completely different) to 1 (identical), and an
+// image with the absolute difference of each pixel.
+func (i *_image) Diff(call otto.FunctionCall) otto.Value {
+	arg, _ := call.Argument(0).Export()
+	other, ok := arg.(*_image)
+	if !ok {
+		throwError(i.c.vm, "TypeError", fmt.Errorf("can't compare image with %v", call.Argument(0)))
+	}
+	a := toRGBA(i.Image)
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	var b *image.RGBA
+	if other.Width() == w && other.Height() == h {
+		b = toRGBA(other.Image)
+	} else {
+		var err error
+		if b, err = resizeImage(other.Image, w, h, "linear"); err != nil {
+			i.throw(err)
+		}
+	}
+	diff := image.NewRGBA(a.Bounds())
+	var total float64
+	for ii := 0; ii < len(a.Pix); ii += 4 {
+		var max uint8
+		for c := 0; c < 4; c++ {
+			x, y := a.Pix[ii+c], b.Pix[ii+c]
+			d := x - y
+			if y > x {
+				d = y - x
+			}
+			if c < 3 {
+				diff.Pix[ii+c] = d
+			}
+			if d > max {
+				max = d
+			}
+		}
+		diff.Pix[ii+3] = 255
+		total += float64(max) / 255
+	}
+	similarity := 1.0
+	if n := len(a.Pix) / 4; n > 0 {
+		similarity -= total / float64(n)
+	}
+	obj, err := i.c.vm.Object("({})")
+	if err != nil {
+		panic(err)
+	}
+	obj.Set("similarity", similarity)
+	obj.Set("image", i.derive(diff).value())
+	return obj.Value()
+}
+
+// hashDistance returns the Hamming distance between two
+// hashes in hex, as returned by AHash, DHash or PHash.
+func hashDistance(h1 string, h2 string) (int, error) {
+	if len(h1) != len(h2) {
+		return 0, fmt.Errorf("can't compare hashes with different lengths (%d and %d)", len(h1), len(h2))
+	}
+	b1, err := hex.DecodeString(h1)
+	if err != nil {
+		return 0, err
+	}
+	b2, err := hex.DecodeString(h2)
+	if err != nil {
+		return 0, err
+	}
+	distance := 0
+	for ii := range b1 {
+		for x := b1[ii] ^ b2[ii]; x != 0; x &= x - 1 {
+			distance++
+		}
+	}
+	return distance, nil
+}
+
 type info struct {
 	cfg    image.Config
 	format string
+	exif   *exif
+	c      *Context
 }
 
+// Width returns the image width, after applying the EXIF
+// orientation, so it matches the decoded image.
 func (i *info) Width() int {
+	if i.transposed() {
+		return i.cfg.Height
+	}
 	return i.cfg.Width
 }
 
+// Height returns the image height, after applying the
+// EXIF orientation.
 func (i *info) Height() int {
+	if i.transposed() {
+		return i.cfg.Width
+	}
 	return i.cfg.Height
 }
 
@@ -45,44 +504,90 @@ func (i *info) Format() string {
 	return i.format
 }
 
-func imageReader(call otto.FunctionCall) (io.Reader, error) {
-	return strings.NewReader(call.Argument(0).String()), nil
+// Orientation returns the EXIF orientation, from 1 to 8,
+// or 1 if the image has no EXIF metadata.
+func (i *info) Orientation() int {
+	if i.exif == nil {
+		return 1
+	}
+	return i.exif.Orientation
 }
 
-func decodeImage(call otto.FunctionCall) otto.Value {
-	r, err := imageReader(call)
-	if err != nil {
-		panic(err)
+// Exif returns the EXIF metadata as an object with the orientation,
+// make, model, camera, software, taken, digitized and modified (as
+// Dates) and gps ({latitude, longitude, altitude}) properties. Missing
+// properties are omitted and null is returned for images without
+// EXIF metadata, which is only read from JPEG and TIFF images.
+func (i *info) Exif() otto.Value {
+	if i.exif == nil {
+		return otto.NullValue()
 	}
-	im, format, err := image.Decode(r)
+	val, err := i.c.ToValue(i.exif)
 	if err != nil {
 		panic(err)
 	}
-	v, err := call.Otto.ToValue(&_image{im, strings.ToUpper(format)})
-	if err != nil {
-		panic(err)
+	return val.val
+}
+
+// transposed returns true iff the EXIF orientation
+// swaps the image width and height.
+func (i *info) transposed() bool {
+	return i.Orientation() >= 5
+}
+
+// imageData returns the image bytes from either a binary string,
+// as returned by Encode, or an array of numbers.
+func imageData(data *Value) ([]byte, error) {
+	if data.IsArray() {
+		var b []byte
+		err := data.Export(&b)
+		return b, err
 	}
-	return v
+	return []byte(data.String()), nil
 }
 
-func decodeImageInfo(call otto.FunctionCall) otto.Value {
-	r, err := imageReader(call)
+// decodeImage decodes a GIF, JPEG, PNG, BMP, TIFF or WebP image,
+// applying its EXIF orientation.
+func decodeImage(c *Context, data *Value) (*_image, error) {
+	b, err := imageData(data)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	cfg, format, err := image.DecodeConfig(r)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	v, err := call.Otto.ToValue(&info{cfg, strings.ToUpper(format)})
+	if err := checkImageSize(cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+	im, format, err := image.Decode(bytes.NewReader(b))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	format = strings.ToUpper(format)
+	img := &_image{Image: im, format: format, c: c}
+	if e := imageExif(b, format); e != nil {
+		img = img.orient(e.Orientation)
+	}
+	return img, nil
+}
+
+func decodeImageInfo(c *Context, data *Value) (*info, error) {
+	b, err := imageData(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
 	}
-	return v
+	format = strings.ToUpper(format)
+	return &info{cfg: cfg, format: format, exif: imageExif(b, format), c: c}, nil
 }
 
 func (c *Context) loadImage(obj *otto.Object) {
 	imageObj := c.newMacacoObject("image")
-	imageObj.Set("decode", decodeImage)
-	imageObj.Set("decodeInfo", decodeImageInfo)
+	imageObj.Set("decode", c.mustFunction(decodeImage))
+	imageObj.Set("decodeInfo", c.mustFunction(decodeImageInfo))
+	imageObj.Set("distance", c.mustFunction(hashDistance))
 }
@@ -0,0 +1,255 @@
+package macaco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"code.google.com/p/go.image/bmp"
+	"code.google.com/p/go.image/tiff"
+)
+
+// newTestImage returns a 4x2 PNG with red, green, blue and white
+// pixels in the first row and black ones in the second.
+func newTestImage(t *testing.T) []byte {
+	im := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	for x, c := range colors {
+		im.Set(x, 0, c)
+		im.Set(x, 1, color.NRGBA{0, 0, 0, 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImage(t *testing.T) {
+	ctx := newTestingContext(t)
+	data, err := ctx.ToValue(newTestImage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Call("(function(data) { im = M.image.decode(data); })", nil, data); err != nil {
+		t.Fatal(err)
+	}
+	cases := []jsCase{
+		{`[im.Width(), im.Height(), im.Format()].join()`, `4,2,PNG`},
+		{`JSON.stringify(im.At(1, 0))`, `{"r":0,"g":255,"b":0,"a":255}`},
+		{`var r = im.Resize(2, 2, 'nearest'); [r.Width(), r.Height(), r.At(1, 0).b, r.At(1, 1).b].join()`, `2,2,255,0`},
+		{`var r = im.Resize(8, 0, 'lanczos'); [r.Width(), r.Height()].join()`, `8,4`},
+		{`var r = im.Resize(0, 1, 'cubic'); [r.Width(), r.Height()].join()`, `2,1`},
+		{`var r = im.Resize(2, 1); r.At(0, 0).r`, `64`},
+		{`var c = im.Crop(2, 0, 10, 1); [c.Width(), c.Height(), c.At(0, 0).b].join()`, `2,1,255`},
+		{`var r = im.Rotate(90); [r.Width(), r.Height(), r.At(1, 0).r, r.At(0, 3).a].join()`, `2,4,255,255`},
+		{`var r = im.Rotate(-90); [r.Width(), r.Height(), r.At(0, 3).r].join()`, `2,4,255`},
+		{`im.Flip().At(0, 0).g`, `255`},
+		{`im.Flip('vertical').At(0, 0).r`, `0`},
+		{`var g = im.ToGray().At(1, 0); [g.r == g.g, g.g == g.b, g.g > 100].join()`, `true,true,true`},
+		{`JSON.stringify([im.At(-1, 0), im.At(4, 0), im.ToGray().At(10, 10)])`, `[{"r":0,"g":0,"b":0,"a":0},{"r":0,"g":0,"b":0,"a":0},{"r":0,"g":0,"b":0,"a":0}]`},
+		{`JSON.stringify(M.image.decode(im.Encode('jpeg')).At(-1, -1))`, `{"r":0,"g":0,"b":0,"a":0}`},
+		{`typeof im.Encode('png')`, `string`},
+		{`JSON.stringify(M.image.decode(im.Encode('png')).At(2, 0))`, `{"r":0,"g":0,"b":255,"a":255}`},
+		{`M.image.decode(im.Encode('jpeg', {quality: 90})).Format()`, `JPEG`},
+		{`M.image.decodeInfo(im.Encode('gif')).Format()`, `GIF`},
+		{`try { im.Rotate(45) } catch (e) { e.message }`, `can't rotate by 45 degrees, only multiples of 90 are supported`},
+		{`try { im.Resize(2, 2, 'foo') } catch (e) { e.message }`, `invalid resize filter "foo"`},
+		{`try { im.Encode('bmp') } catch (e) { e.message }`, `unsupported image format "bmp"`},
+		{`try { im.Resize(1e6, 1e6) } catch (e) { [e instanceof M.Error, e.message].join() }`, `true,image size 1000000x1000000 is too big, the maximum is 67108864 pixels`},
+		{`try { im.Resize(0, 1e9) } catch (e) { e.message }`, `image size 2000000000x1000000000 is too big, the maximum is 67108864 pixels`},
+		{`try { im.Resize(4e7, 1) } catch (e) { e.message }`, `image size 40000000x2 is too big, the maximum is 67108864 pixels`},
+	}
+	runJSCases(t, ctx, cases)
+}
+
+// newTestPattern returns a PNG with a diagonal gradient and
+// a bright square, so it has both low and high frequencies.
+func newTestPattern(t *testing.T, size int) []byte {
+	im := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := uint8((x + y) * 255 / (2 * size))
+			if x > size/4 && x < size/2 && y > size/2 && y < 3*size/4 {
+				v = 255
+			}
+			im.SetGray(x, y, color.Gray{v})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageHash(t *testing.T) {
+	ctx := newTestingContext(t)
+	data, err := ctx.ToValue(newTestPattern(t, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Call("(function(data) { im = M.image.decode(data); small = im.Resize(40, 40, 'cubic'); flipped = im.Rotate(180); })", nil, data); err != nil {
+		t.Fatal(err)
+	}
+	cases := []jsCase{
+		{`[im.AHash().length, im.DHash().length, im.PHash().length].join()`, `16,16,16`},
+		{`M.image.distance(im.AHash(), small.AHash()) <= 4`, `true`},
+		{`M.image.distance(im.DHash(), small.DHash()) <= 4`, `true`},
+		{`M.image.distance(im.PHash(), small.PHash()) <= 4`, `true`},
+		{`M.image.distance(im.PHash(), flipped.PHash()) > 16`, `true`},
+		{`M.image.distance(im.DHash(), flipped.DHash()) > 16`, `true`},
+		{`M.image.distance('ff00', '0f01')`, `5`},
+		{`try { M.image.distance('ff', 'ff00') } catch (e) { e instanceof M.Error }`, `true`},
+		{`var d = im.Diff(im); [d.similarity, d.image.Width(), d.image.At(3, 3).r].join()`, `1,64,0`},
+		{`var d = im.Diff(small); d.similarity > 0.95`, `true`},
+		{`var d = im.Diff(flipped); d.similarity < 0.9`, `true`},
+		{`try { im.Diff(1) } catch (e) { e.name }`, `TypeError`},
+	}
+	runJSCases(t, ctx, cases)
+}
+
+type testExifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func exifShort(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func exifLong(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func exifRational(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, exifLong(v)...)
+		b = append(b, exifLong(1)...)
+	}
+	return b
+}
+
+// exifIFDData returns an IFD starting at the given offset, followed
+// by the values which don't fit into its entries.
+func exifIFDData(offset int, entries []testExifEntry) []byte {
+	var data []byte
+	dataOffset := offset + 2 + len(entries)*12 + 4
+	ifd := exifShort(uint16(len(entries)))
+	for _, e := range entries {
+		ifd = append(ifd, exifShort(e.tag)...)
+		ifd = append(ifd, exifShort(e.typ)...)
+		ifd = append(ifd, exifLong(e.count)...)
+		if len(e.data) > 4 {
+			ifd = append(ifd, exifLong(uint32(dataOffset+len(data)))...)
+			data = append(data, e.data...)
+		} else {
+			var v [4]byte
+			copy(v[:], e.data)
+			ifd = append(ifd, v[:]...)
+		}
+	}
+	ifd = append(ifd, 0, 0, 0, 0)
+	return append(ifd, data...)
+}
+
+// newTestExif returns the EXIF data for an image taken with
+// orientation 6 (rotated 90 degrees), with its camera, timestamps
+// and GPS position.
+func newTestExif() []byte {
+	taken := []byte("2014:05:06 07:08:09\x00")
+	ifd0 := func(exifOffset, gpsOffset uint32) []testExifEntry {
+		return []testExifEntry{
+			{0x010f, 2, 6, []byte("Canon\x00")},
+			{0x0110, 2, 16, []byte("Canon EOS 5D II\x00")},
+			{0x0112, 3, 1, []byte{6, 0}},
+			{0x8769, 4, 1, exifLong(exifOffset)},
+			{0x8825, 4, 1, exifLong(gpsOffset)},
+		}
+	}
+	exifIFD := []testExifEntry{
+		{0x9003, 2, uint32(len(taken)), taken},
+	}
+	gpsIFD := []testExifEntry{
+		{0x0001, 2, 2, []byte("N\x00")},
+		{0x0002, 5, 3, exifRational(40, 30, 0)},
+		{0x0003, 2, 2, []byte("W\x00")},
+		{0x0004, 5, 3, exifRational(3, 45, 36)},
+		{0x0005, 1, 1, []byte{0}},
+		{0x0006, 5, 1, exifRational(650)},
+	}
+	exifOffset := 8 + len(exifIFDData(8, ifd0(0, 0)))
+	gpsOffset := exifOffset + len(exifIFDData(exifOffset, exifIFD))
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	data = append(data, exifIFDData(8, ifd0(uint32(exifOffset), uint32(gpsOffset)))...)
+	data = append(data, exifIFDData(exifOffset, exifIFD)...)
+	return append(data, exifIFDData(gpsOffset, gpsIFD)...)
+}
+
+// newTestJPEG returns the image from newTestImage as a JPEG
+// with the EXIF data from newTestExif.
+func newTestJPEG(t *testing.T) []byte {
+	im, err := png.Decode(bytes.NewReader(newTestImage(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, im, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte("Exif\x00\x00"), newTestExif()...)
+	app1 := []byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	data := buf.Bytes()
+	// Insert the APP1 segment after the SOI marker
+	return append(append(append([]byte{}, data[:2]...), append(app1, segment...)...), data[2:]...)
+}
+
+func TestImageFormats(t *testing.T) {
+	ctx := newTestingContext(t)
+	im, err := png.Decode(bytes.NewReader(newTestImage(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bmpData, tiffData bytes.Buffer
+	if err := bmp.Encode(&bmpData, im); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(&tiffData, im, nil); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string][]byte{"jpegData": newTestJPEG(t), "bmpData": bmpData.Bytes(), "tiffData": tiffData.Bytes(), "pngData": newTestImage(t)} {
+		data, err := ctx.ToValue(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ctx.Call("(function(k, data) { this[k] = data; })", nil, k, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []jsCase{
+		{`var im = M.image.decode(bmpData); [im.Format(), im.Width(), im.Height(), im.At(2, 0).b].join()`, `BMP,4,2,255`},
+		{`var im = M.image.decode(tiffData); [im.Format(), im.Width(), im.Height(), im.At(1, 0).g].join()`, `TIFF,4,2,255`},
+		{`M.image.decodeInfo(tiffData).Exif().orientation`, `1`},
+		{`var info = M.image.decodeInfo(pngData); [info.Orientation(), info.Exif()].join()`, `1,`},
+		{`var info = M.image.decodeInfo(jpegData); [info.Format(), info.Width(), info.Height(), info.Orientation()].join()`, `JPEG,2,4,6`},
+		{`var e = M.image.decodeInfo(jpegData).Exif(); [e.make, e.model, e.camera].join()`, `Canon,Canon EOS 5D II,Canon EOS 5D II`},
+		{`M.image.decodeInfo(jpegData).Exif().taken.toISOString()`, `2014-05-06T07:08:09.000Z`},
+		{`M.image.decodeInfo(jpegData).Exif().modified`, `undefined`},
+		{`JSON.stringify(M.image.decodeInfo(jpegData).Exif().gps)`, `{"latitude":40.5,"longitude":-3.76,"altitude":650}`},
+		// Rotated clockwise, the white pixel ends up in the bottom right
+		// corner and the red one in the top right
+		{`var im = M.image.decode(jpegData); [im.Width(), im.Height(), im.At(1, 3).g - im.At(0, 3).g > 100, im.At(1, 0).r > im.At(0, 0).r].join()`, `2,4,true,true`},
+	}
+	runJSCases(t, ctx, cases)
+}
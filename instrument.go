@@ -0,0 +1,645 @@
+package macaco
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/rainycape/otto"
+	"github.com/rainycape/otto/ast"
+	"github.com/rainycape/otto/file"
+	"github.com/rainycape/otto/parser"
+)
+
+// Instrumented scripts are rewritten before compiling them, inserting
+// calls to the functions in the non-enumerable global hooks object:
+//
+//	before every statement: if(H.s(probe)&&H.p(function(){return eval(arguments[0]);})){}else
+//	after the { in a function body: H.e(fn);try{
+//	before the } in a function body: }finally{H.x(fn);}
+//
+// s() returns true when the statement should pause and p() receives a
+// function which evaluates expressions in the scope of the statement,
+// always returning undefined, so the statement is executed. Since the
+// statement becomes the else branch of the inserted if, no brackets need
+// to be added around bodies of if, for, etc... which are not a block.
+// No newlines are inserted, so line numbers are preserved. Columns in
+// errors are mapped back to the original source.
+const hooksName = "__macaco_hooks"
+
+// probe is an instrumented statement.
+type probe struct {
+	file   string
+	line   int
+	column int
+	// fn is the index of the enclosing function, -1 for
+	// top level statements.
+	fn int
+	// debugger is true for debugger statements.
+	debugger bool
+}
+
+// probeFunction is an instrumented function.
+type probeFunction struct {
+	name   string
+	file   string
+	line   int
+	column int
+	// locals contains the parameters and the names
+	// declared with var or function in its body.
+	locals []string
+	// parent is the index of the enclosing function,
+	// -1 for top level functions.
+	parent int
+}
+
+// columnShift indicates that, starting at the given column of a line
+// of the original source, the columns in the instrumented source are
+// shifted by shift. Columns are 0-based.
+type columnShift struct {
+	column int
+	shift  int
+}
+
+// instrumentationHooks is implemented by the types which receive
+// the events from instrumented scripts.
+type instrumentationHooks interface {
+	// statement is called before executing the given probe,
+	// returning true requests a pause.
+	statement(c *Context, id int) bool
+	// enter and exit are called when a function is
+	// entered or exited, respectively.
+	enter(c *Context, fn int)
+	exit(c *Context, fn int)
+}
+
+// instrumentation contains the probes of all the instrumented scripts
+// and the hooks receiving their events. It's shared by all the copies
+// of a Context.
+type instrumentation struct {
+	sync.RWMutex
+	probes    []*probe
+	functions []*probeFunction
+	// files contains the instrumented files in load order.
+	files []string
+	// sources contains the original source for each file.
+	sources map[string][]byte
+	// shifts contains the column shifts for each line of
+	// every instrumented file.
+	shifts   map[string][][]columnShift
+	debugger *Debugger
+	profile  *Profile
+	coverage *Coverage
+}
+
+func newInstrumentation() *instrumentation {
+	return &instrumentation{
+		sources: make(map[string][]byte),
+		shifts:  make(map[string][][]columnShift),
+	}
+}
+
+func (in *instrumentation) probe(id int) *probe {
+	in.RLock()
+	defer in.RUnlock()
+	if id >= 0 && id < len(in.probes) {
+		return in.probes[id]
+	}
+	return nil
+}
+
+func (in *instrumentation) function(fn int) *probeFunction {
+	in.RLock()
+	defer in.RUnlock()
+	if fn >= 0 && fn < len(in.functions) {
+		return in.functions[fn]
+	}
+	return nil
+}
+
+// source returns the original source for the given file.
+func (in *instrumentation) source(filename string) []byte {
+	in.RLock()
+	defer in.RUnlock()
+	return in.sources[filename]
+}
+
+func (in *instrumentation) hooks() []instrumentationHooks {
+	in.RLock()
+	defer in.RUnlock()
+	var hooks []instrumentationHooks
+	if in.debugger != nil {
+		hooks = append(hooks, in.debugger)
+	}
+	if in.profile != nil {
+		hooks = append(hooks, in.profile)
+	}
+	if in.coverage != nil {
+		hooks = append(hooks, in.coverage)
+	}
+	return hooks
+}
+
+// originalColumn maps a 1-based column in the instrumented file
+// to the original source.
+func (in *instrumentation) originalColumn(filename string, line int, column int) int {
+	in.RLock()
+	lines := in.shifts[filename]
+	in.RUnlock()
+	if line < 1 || line > len(lines) {
+		return column
+	}
+	gen := column - 1
+	orig := gen
+	prev := 0
+	for _, v := range lines[line-1] {
+		if gen >= v.column+v.shift {
+			orig = gen - v.shift
+		} else {
+			if gen >= v.column+prev {
+				// Inside the inserted code
+				orig = v.column
+			}
+			break
+		}
+		prev = v.shift
+	}
+	return orig + 1
+}
+
+// apply maps the columns in the error and its stack frames
+// back to the original sources.
+func (in *instrumentation) apply(se *ScriptError) {
+	if se.File != "" {
+		se.Column = in.originalColumn(se.File, se.Line, se.Column)
+	}
+	for _, v := range se.Stack {
+		if !v.Native {
+			v.Column = in.originalColumn(v.File, v.Line, v.Column)
+		}
+	}
+}
+
+// Instrument makes the scripts loaded from now on instrumented, which
+// is required by the debugger and for profiling JS functions.
+// Instrumented scripts run slower, so it should only be enabled when
+// needed. Scripts loaded before calling Instrument are not affected.
+// Copies of an instrumented Context are also instrumented.
+func (c *Context) Instrument() {
+	if c.instr == nil {
+		c.instr = newInstrumentation()
+	}
+}
+
+// Instrumented returns true iff Instrument has been called in
+// this Context or in the Context it was copied from.
+func (c *Context) Instrumented() bool {
+	return c.instr != nil
+}
+
+func (c *Context) loadHooks() error {
+	obj, err := c.vm.Object(`(function(global) {
+	if (!global.` + hooksName + `) {
+		Object.defineProperty(global, '` + hooksName + `', {value: {}, enumerable: false});
+	}
+	return global.` + hooksName + `;
+})(this)`)
+	if err != nil {
+		return err
+	}
+	obj.Set("s", c.hookStatement)
+	obj.Set("p", c.hookPause)
+	obj.Set("e", c.hookEnter)
+	obj.Set("x", c.hookExit)
+	return nil
+}
+
+func (c *Context) hookStatement(id int) bool {
+	pause := false
+	if c.instr != nil {
+		for _, v := range c.instr.hooks() {
+			if v.statement(c, id) {
+				pause = true
+			}
+		}
+	}
+	return pause
+}
+
+func (c *Context) hookPause(call otto.FunctionCall) otto.Value {
+	if c.instr != nil {
+		c.instr.RLock()
+		d := c.instr.debugger
+		c.instr.RUnlock()
+		if d != nil {
+			d.pause(c, call.Argument(0))
+		}
+	}
+	return otto.UndefinedValue()
+}
+
+func (c *Context) hookEnter(fn int) {
+	if c.instr != nil {
+		for _, v := range c.instr.hooks() {
+			v.enter(c, fn)
+		}
+	}
+}
+
+func (c *Context) hookExit(fn int) {
+	if c.instr != nil {
+		for _, v := range c.instr.hooks() {
+			v.exit(c, fn)
+		}
+	}
+}
+
+type insertion struct {
+	offset int
+	text   string
+}
+
+type instrumenter struct {
+	file    string
+	src     []byte
+	lines   []int
+	inserts []insertion
+	// fn is the function being instrumented, -1 at top level
+	fn        int
+	probes    []*probe
+	functions []*probeFunction
+	// probeBase and fnBase are the indexes of the first
+	// probe and function in this file.
+	probeBase int
+	fnBase    int
+}
+
+// instrument returns the instrumented source for the given script.
+func (in *instrumentation) instrument(filename string, src []byte) ([]byte, error) {
+	in.Lock()
+	defer in.Unlock()
+	// Remove the shifts from previous versions, so
+	// syntax errors are not mapped.
+	delete(in.shifts, filename)
+	program, err := parser.ParseFile(nil, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	ins := &instrumenter{
+		file:      filename,
+		src:       src,
+		lines:     []int{0},
+		fn:        -1,
+		probeBase: len(in.probes),
+		fnBase:    len(in.functions),
+	}
+	for ii, b := range src {
+		if b == '\n' {
+			ins.lines = append(ins.lines, ii+1)
+		}
+	}
+	ins.statements(program.Body)
+	out, shifts := ins.rewrite()
+	in.probes = append(in.probes, ins.probes...)
+	in.functions = append(in.functions, ins.functions...)
+	if _, ok := in.sources[filename]; !ok {
+		in.files = append(in.files, filename)
+	}
+	in.sources[filename] = src
+	in.shifts[filename] = shifts
+	return out, nil
+}
+
+// offset returns the 0-based offset in the source for idx.
+func (ins *instrumenter) offset(idx file.Idx) int {
+	return int(idx) - 1
+}
+
+// position returns the 1-based line and column for the given offset.
+func (ins *instrumenter) position(offset int) (int, int) {
+	line := sort.Search(len(ins.lines), func(i int) bool { return ins.lines[i] > offset })
+	return line, offset - ins.lines[line-1] + 1
+}
+
+func (ins *instrumenter) insert(offset int, text string) {
+	ins.inserts = append(ins.inserts, insertion{offset, text})
+}
+
+func (ins *instrumenter) rewrite() ([]byte, [][]columnShift) {
+	sort.Stable(insertionsByOffset(ins.inserts))
+	var buf bytes.Buffer
+	shifts := make([][]columnShift, len(ins.lines))
+	prev := 0
+	for _, v := range ins.inserts {
+		buf.Write(ins.src[prev:v.offset])
+		buf.WriteString(v.text)
+		prev = v.offset
+		line, column := ins.position(v.offset)
+		s := shifts[line-1]
+		shift := len(v.text)
+		if n := len(s); n > 0 {
+			shift += s[n-1].shift
+			if s[n-1].column == column-1 {
+				s[n-1].shift = shift
+				continue
+			}
+		}
+		shifts[line-1] = append(s, columnShift{column: column - 1, shift: shift})
+	}
+	buf.Write(ins.src[prev:])
+	return buf.Bytes(), shifts
+}
+
+// statementStart returns the offset where the statement starts,
+// including any parenthesis around the initial expression.
+func (ins *instrumenter) statementStart(s ast.Statement) int {
+	var offset int
+	switch x := s.(type) {
+	case *ast.ExpressionStatement:
+		offset = ins.offset(expressionStart(x.Expression))
+	// The parser doesn't set the position of the keyword for these
+	// statements, so it must be found before their first child.
+	case *ast.IfStatement:
+		offset = ins.keywordBefore("if", x.Test)
+	case *ast.ForStatement:
+		offset = ins.keywordBefore("for", x.Initializer, x.Test, x.Update, x.Body)
+	case *ast.ForInStatement:
+		offset = ins.keywordBefore("for", x.Into)
+	case *ast.WhileStatement:
+		offset = ins.keywordBefore("while", x.Test)
+	case *ast.DoWhileStatement:
+		offset = ins.keywordBefore("do", x.Body)
+	case *ast.WithStatement:
+		offset = ins.keywordBefore("with", x.Object)
+	case *ast.SwitchStatement:
+		offset = ins.keywordBefore("switch", x.Discriminant)
+	case *ast.ThrowStatement:
+		offset = ins.keywordBefore("throw", x.Argument)
+	default:
+		offset = ins.offset(s.Idx0())
+	}
+	for ii := offset - 1; ii >= 0; ii-- {
+		switch ins.src[ii] {
+		case '(':
+			offset = ii
+		case ' ', '\t', '\r', '\n':
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// keywordBefore returns the offset of the last occurrence of keyword
+// before the first non-nil node.
+func (ins *instrumenter) keywordBefore(keyword string, nodes ...ast.Node) int {
+	for _, v := range nodes {
+		if v == nil || reflect.ValueOf(v).IsNil() {
+			continue
+		}
+		start := v.Idx0()
+		if e, ok := v.(ast.Expression); ok {
+			start = expressionStart(e)
+		}
+		return bytes.LastIndex(ins.src[:ins.offset(start)], []byte(keyword))
+	}
+	return 0
+}
+
+func expressionStart(e ast.Expression) file.Idx {
+	switch x := e.(type) {
+	case *ast.AssignExpression:
+		return expressionStart(x.Left)
+	case *ast.BinaryExpression:
+		return expressionStart(x.Left)
+	case *ast.BracketExpression:
+		return expressionStart(x.Left)
+	case *ast.CallExpression:
+		return expressionStart(x.Callee)
+	case *ast.ConditionalExpression:
+		return expressionStart(x.Test)
+	case *ast.DotExpression:
+		return expressionStart(x.Left)
+	case *ast.SequenceExpression:
+		if len(x.Sequence) > 0 {
+			return expressionStart(x.Sequence[0])
+		}
+	case *ast.UnaryExpression:
+		if x.Postfix {
+			return expressionStart(x.Operand)
+		}
+	}
+	return e.Idx0()
+}
+
+func (ins *instrumenter) statements(list []ast.Statement) {
+	for _, v := range list {
+		ins.statement(v)
+	}
+}
+
+// statement adds a probe before s, if it's executable, and
+// instruments its children.
+func (ins *instrumenter) statement(s ast.Statement) {
+	switch x := s.(type) {
+	case nil, *ast.EmptyStatement, *ast.BadStatement:
+		return
+	case *ast.BlockStatement:
+		ins.statements(x.List)
+		return
+	case *ast.FunctionStatement:
+		ins.function(x.Function, "")
+		return
+	case *ast.ExpressionStatement:
+		if _, ok := x.Expression.(*ast.StringLiteral); ok {
+			// Might be a directive, like "use strict"
+			return
+		}
+	}
+	offset := ins.statementStart(s)
+	line, column := ins.position(offset)
+	_, isDebugger := s.(*ast.DebuggerStatement)
+	id := ins.probeBase + len(ins.probes)
+	ins.probes = append(ins.probes, &probe{
+		file:     ins.file,
+		line:     line,
+		column:   column,
+		fn:       ins.fn,
+		debugger: isDebugger,
+	})
+	ins.insert(offset, hooksPrefixFor(id))
+	ins.children(s)
+}
+
+func hooksPrefixFor(id int) string {
+	return "if(" + hooksName + ".s(" + strconv.Itoa(id) + ")&&" + hooksName + ".p(function(){return eval(arguments[0]);})){}else "
+}
+
+func (ins *instrumenter) children(s ast.Statement) {
+	switch x := s.(type) {
+	case *ast.ExpressionStatement:
+		ins.expression(x.Expression, "")
+	case *ast.VariableStatement:
+		ins.expressions(x.List)
+	case *ast.IfStatement:
+		ins.expression(x.Test, "")
+		ins.statement(x.Consequent)
+		ins.statement(x.Alternate)
+	case *ast.ForStatement:
+		ins.expression(x.Initializer, "")
+		ins.expression(x.Test, "")
+		ins.expression(x.Update, "")
+		ins.statement(x.Body)
+	case *ast.ForInStatement:
+		ins.expression(x.Into, "")
+		ins.expression(x.Source, "")
+		ins.statement(x.Body)
+	case *ast.WhileStatement:
+		ins.expression(x.Test, "")
+		ins.statement(x.Body)
+	case *ast.DoWhileStatement:
+		ins.statement(x.Body)
+		ins.expression(x.Test, "")
+	case *ast.WithStatement:
+		ins.expression(x.Object, "")
+		ins.statement(x.Body)
+	case *ast.ReturnStatement:
+		ins.expression(x.Argument, "")
+	case *ast.ThrowStatement:
+		ins.expression(x.Argument, "")
+	case *ast.SwitchStatement:
+		ins.expression(x.Discriminant, "")
+		for _, v := range x.Body {
+			ins.expression(v.Test, "")
+			ins.statements(v.Consequent)
+		}
+	case *ast.TryStatement:
+		ins.statement(x.Body)
+		if x.Catch != nil {
+			ins.statement(x.Catch.Body)
+		}
+		ins.statement(x.Finally)
+	case *ast.LabelledStatement:
+		// Don't put the probe between the label and its
+		// statement, since the label must be followed
+		// by the loop.
+		if b, ok := x.Statement.(*ast.BlockStatement); ok {
+			ins.statements(b.List)
+		} else {
+			ins.children(x.Statement)
+		}
+	}
+}
+
+func (ins *instrumenter) expressions(list []ast.Expression) {
+	for _, v := range list {
+		ins.expression(v, "")
+	}
+}
+
+// expression instruments the functions inside e. name is used
+// for naming anonymous functions assigned to a variable or property.
+func (ins *instrumenter) expression(e ast.Expression, name string) {
+	switch x := e.(type) {
+	case *ast.FunctionLiteral:
+		ins.function(x, name)
+	case *ast.ArrayLiteral:
+		ins.expressions(x.Value)
+	case *ast.AssignExpression:
+		ins.expression(x.Left, "")
+		ins.expression(x.Right, expressionName(x.Left))
+	case *ast.BinaryExpression:
+		ins.expression(x.Left, "")
+		ins.expression(x.Right, "")
+	case *ast.BracketExpression:
+		ins.expression(x.Left, "")
+		ins.expression(x.Member, "")
+	case *ast.CallExpression:
+		ins.expression(x.Callee, "")
+		ins.expressions(x.ArgumentList)
+	case *ast.ConditionalExpression:
+		ins.expression(x.Test, "")
+		ins.expression(x.Consequent, "")
+		ins.expression(x.Alternate, "")
+	case *ast.DotExpression:
+		ins.expression(x.Left, "")
+	case *ast.NewExpression:
+		ins.expression(x.Callee, "")
+		ins.expressions(x.ArgumentList)
+	case *ast.ObjectLiteral:
+		for _, v := range x.Value {
+			ins.expression(v.Value, v.Key)
+		}
+	case *ast.SequenceExpression:
+		ins.expressions(x.Sequence)
+	case *ast.UnaryExpression:
+		ins.expression(x.Operand, "")
+	case *ast.VariableExpression:
+		ins.expression(x.Initializer, x.Name)
+	}
+}
+
+func expressionName(e ast.Expression) string {
+	switch x := e.(type) {
+	case *ast.Identifier:
+		return x.Name
+	case *ast.DotExpression:
+		if left := expressionName(x.Left); left != "" {
+			return left + "." + x.Identifier.Name
+		}
+		return x.Identifier.Name
+	}
+	return ""
+}
+
+func (ins *instrumenter) function(fl *ast.FunctionLiteral, name string) {
+	body, ok := fl.Body.(*ast.BlockStatement)
+	if !ok {
+		return
+	}
+	if fl.Name != nil {
+		name = fl.Name.Name
+	}
+	line, column := ins.position(ins.offset(fl.Function))
+	fn := &probeFunction{
+		name:   name,
+		file:   ins.file,
+		line:   line,
+		column: column,
+		parent: ins.fn,
+	}
+	if fl.ParameterList != nil {
+		for _, v := range fl.ParameterList.List {
+			fn.locals = append(fn.locals, v.Name)
+		}
+	}
+	for _, v := range fl.DeclarationList {
+		switch x := v.(type) {
+		case *ast.VariableDeclaration:
+			for _, ve := range x.List {
+				fn.locals = append(fn.locals, ve.Name)
+			}
+		case *ast.FunctionDeclaration:
+			if x.Function.Name != nil {
+				fn.locals = append(fn.locals, x.Function.Name.Name)
+			}
+		}
+	}
+	id := ins.fnBase + len(ins.functions)
+	ins.functions = append(ins.functions, fn)
+	fnID := strconv.Itoa(id)
+	ins.insert(ins.offset(body.LeftBrace)+1, hooksName+".e("+fnID+");try{")
+	ins.insert(ins.offset(body.RightBrace), "}finally{"+hooksName+".x("+fnID+");}")
+	parent := ins.fn
+	ins.fn = id
+	ins.statements(body.List)
+	ins.fn = parent
+}
+
+type insertionsByOffset []insertion
+
+func (s insertionsByOffset) Len() int           { return len(s) }
+func (s insertionsByOffset) Less(i, j int) bool { return s[i].offset < s[j].offset }
+func (s insertionsByOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -1,40 +1,456 @@
 package macaco
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/rainycape/otto"
 )
 
-func (c *Context) jsonParse(call otto.FunctionCall) otto.Value {
-	if len(call.ArgumentList) > 0 {
-		s := call.ArgumentList[0].String()
-		var m interface{}
-		if err := json.Unmarshal([]byte(s), &m); err != nil {
-			c.Errorf("error in JSON.parse: %s %s\n", s, err)
-		} else {
-			val, _ := call.Otto.ToValue(m)
-			return val
+const (
+	jsonFile = "<json>"
+	// jsonSrc implements JSON.parse and JSON.stringify as specified
+	// by ES5 (section 15.12). Parsing is done by the native parse
+	// function, while quote converts a string to a JSON string.
+	jsonSrc = `(function(parse, quote) {
+	var toString = Object.prototype.toString;
+	var isArray = function(v) {
+		if (Array.isArray(v)) {
+			return true;
 		}
+		var cls = toString.call(v);
+		return cls === '[object GoArray]' || cls === '[object GoSlice]';
+	};
+	var JSON = {};
+	JSON.parse = function(text, reviver) {
+		var value = parse(String(text));
+		if (typeof reviver !== 'function') {
+			return value;
+		}
+		var walk = function(holder, key) {
+			var val = holder[key];
+			if (val !== null && typeof val === 'object') {
+				var keys = isArray(val) ? null : Object.keys(val);
+				var n = keys ? keys.length : val.length;
+				for (var ii = 0; ii < n; ii++) {
+					var k = keys ? keys[ii] : String(ii);
+					var nv = walk(val, k);
+					if (nv === undefined) {
+						delete val[k];
+					} else {
+						val[k] = nv;
+					}
+				}
+			}
+			return reviver.call(holder, key, val);
+		};
+		return walk({'': value}, '');
+	};
+	JSON.stringify = function(value, replacer, space) {
+		var indent = '';
+		var gap = '';
+		var replacerFn, propertyList;
+		var stack = [];
+		if (space !== null && typeof space === 'object') {
+			var cls = toString.call(space);
+			if (cls === '[object Number]') {
+				space = Number(space);
+			} else if (cls === '[object String]') {
+				space = String(space);
+			}
+		}
+		if (typeof space === 'number') {
+			for (var ii = 0; ii < Math.min(10, space); ii++) {
+				gap += ' ';
+			}
+		} else if (typeof space === 'string') {
+			gap = space.slice(0, 10);
+		}
+		if (typeof replacer === 'function') {
+			replacerFn = replacer;
+		} else if (isArray(replacer)) {
+			propertyList = [];
+			var seen = {};
+			for (var ii = 0; ii < replacer.length; ii++) {
+				var v = replacer[ii];
+				var item;
+				if (typeof v === 'string') {
+					item = v;
+				} else if (typeof v === 'number') {
+					item = String(v);
+				} else if (v !== null && typeof v === 'object') {
+					var cls = toString.call(v);
+					if (cls === '[object String]' || cls === '[object Number]') {
+						item = String(v);
+					}
+				}
+				if (item !== undefined && !Object.prototype.hasOwnProperty.call(seen, item)) {
+					seen[item] = true;
+					propertyList.push(item);
+				}
+			}
+		}
+		var enter = function(value) {
+			for (var ii = 0; ii < stack.length; ii++) {
+				if (stack[ii] === value) {
+					throw new TypeError('Converting circular structure to JSON');
+				}
+			}
+			stack.push(value);
+		};
+		var str = function(key, holder) {
+			var value = holder[key];
+			if (value !== null && (typeof value === 'object' || typeof value === 'function') && typeof value.toJSON === 'function') {
+				value = value.toJSON(key);
+			}
+			if (replacerFn) {
+				value = replacerFn.call(holder, key, value);
+			}
+			if (value !== null && typeof value === 'object') {
+				var cls = toString.call(value);
+				if (cls === '[object Number]') {
+					value = Number(value);
+				} else if (cls === '[object String]') {
+					value = String(value);
+				} else if (cls === '[object Boolean]') {
+					value = value.valueOf();
+				}
+			}
+			switch (typeof value) {
+			case 'string':
+				return quote(value);
+			case 'number':
+				return isFinite(value) ? String(value) : 'null';
+			case 'boolean':
+				return String(value);
+			case 'object':
+				if (value === null) {
+					return 'null';
+				}
+				var stepback = indent;
+				var partial = [];
+				var open, close;
+				enter(value);
+				indent += gap;
+				if (isArray(value)) {
+					open = '[';
+					close = ']';
+					for (var ii = 0; ii < value.length; ii++) {
+						var s = str(String(ii), value);
+						partial.push(s === undefined ? 'null' : s);
+					}
+				} else {
+					open = '{';
+					close = '}';
+					var keys = propertyList || Object.keys(value);
+					for (var ii = 0; ii < keys.length; ii++) {
+						var s = str(keys[ii], value);
+						if (s !== undefined) {
+							partial.push(quote(keys[ii]) + (gap ? ': ' : ':') + s);
+						}
+					}
+				}
+				stack.pop();
+				indent = stepback;
+				if (partial.length === 0) {
+					return open + close;
+				}
+				if (!gap) {
+					return open + partial.join(',') + close;
+				}
+				var inner = indent + gap;
+				return open + '\n' + inner + partial.join(',\n' + inner) + '\n' + indent + close;
+			}
+			return undefined;
+		};
+		return str('', {'': value});
+	};
+	return JSON;
+})`
+)
+
+// jsonParse parses its argument, preserving the key order in objects.
+func (c *Context) jsonParse(call otto.FunctionCall) (otto.Value, error) {
+	return c.parseJSON(call.Argument(0).String())
+}
+
+// parseJSON parses a JSON value, which must be the only
+// value in s, into a JS value.
+func (c *Context) parseJSON(s string) (otto.Value, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	val, err := c.jsonValue(dec)
+	if err == nil {
+		if _, terr := dec.Token(); terr != io.EOF {
+			err = errors.New("unexpected data after JSON value")
+		}
+	}
+	return val, jsonError(err)
+}
+
+func jsonError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("unexpected end of JSON input")
+	}
+	return err
+}
+
+func (c *Context) jsonValue(dec *json.Decoder) (otto.Value, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return otto.Value{}, err
+	}
+	switch x := tok.(type) {
+	case json.Delim:
+		if x == '{' {
+			obj, err := c.vm.Object("({})")
+			if err != nil {
+				return otto.Value{}, err
+			}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return otto.Value{}, err
+				}
+				val, err := c.jsonValue(dec)
+				if err != nil {
+					return otto.Value{}, err
+				}
+				obj.Set(key.(string), val)
+			}
+			// Closing }
+			if _, err := dec.Token(); err != nil {
+				return otto.Value{}, err
+			}
+			return obj.Value(), nil
+		}
+		var items []interface{}
+		for dec.More() {
+			val, err := c.jsonValue(dec)
+			if err != nil {
+				return otto.Value{}, err
+			}
+			items = append(items, val)
+		}
+		// Closing ]
+		if _, err := dec.Token(); err != nil {
+			return otto.Value{}, err
+		}
+		return c.newArray(items)
+	case json.Number:
+		f, err := jsonNumber(x)
+		if err != nil {
+			return otto.Value{}, err
+		}
+		return c.vm.ToValue(f)
+	case nil:
+		return otto.NullValue(), nil
+	}
+	return c.vm.ToValue(tok)
+}
+
+// jsonNumber parses n as JSON.parse does, returning
+// ±Infinity for numbers which overflow a float64.
+func jsonNumber(n json.Number) (float64, error) {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+			// f is ±Inf or 0 for underflows
+			return f, nil
+		}
+		return 0, err
+	}
+	return f, nil
+}
+
+// newArray returns a JS array with the given items.
+func (c *Context) newArray(items []interface{}) (otto.Value, error) {
+	arr, err := c.vm.Object("[]")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	if len(items) > 0 {
+		if _, err := arr.Call("push", items...); err != nil {
+			return otto.Value{}, err
+		}
+	}
+	return arr.Value(), nil
+}
+
+// jsonQuote returns s as a JSON string. Unlike json.Marshal, it
+// only escapes the characters required by the JSON grammar.
+func jsonQuote(s string) string {
+	var buf bytes.Buffer
+	buf.Grow(len(s) + 2)
+	buf.WriteByte('"')
+	for ii := 0; ii < len(s); {
+		r, size := utf8.DecodeRuneInString(s[ii:])
+		switch {
+		case r == '"':
+			buf.WriteString(`\"`)
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			buf.WriteString(s[ii : ii+size])
+		}
+		ii += size
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// jsonTokenizer reads a JSON document incrementally, returning one
+// token at a time or decoding a single value, so large documents can
+// be processed without building all their values.
+type jsonTokenizer struct {
+	c   *Context
+	dec *json.Decoder
+	// objects contains true for each open object and
+	// false for each open array.
+	objects []bool
+	// key is true when the next string is an object key.
+	key bool
+}
+
+func (t *jsonTokenizer) inObject() bool {
+	return len(t.objects) > 0 && t.objects[len(t.objects)-1]
+}
+
+func (t *jsonTokenizer) token(typ string, val interface{}) (otto.Value, error) {
+	obj, err := t.c.vm.Object("({})")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	obj.Set("type", typ)
+	if val != nil {
+		obj.Set("value", val)
+	}
+	return obj.Value(), nil
+}
+
+// next returns the next token as an object with a type, which is one
+// of begin_object, end_object, begin_array, end_array, key and value,
+// and a value for key and value tokens. At the end of the input, it
+// returns undefined.
+func (t *jsonTokenizer) next(call otto.FunctionCall) (otto.Value, error) {
+	tok, err := t.dec.Token()
+	if err != nil {
+		if err == io.EOF && len(t.objects) == 0 {
+			return otto.UndefinedValue(), nil
+		}
+		return otto.Value{}, jsonError(err)
 	}
-	return otto.UndefinedValue()
+	switch x := tok.(type) {
+	case json.Delim:
+		switch x {
+		case '{', '[':
+			t.objects = append(t.objects, x == '{')
+			t.key = x == '{'
+			if x == '{' {
+				return t.token("begin_object", nil)
+			}
+			return t.token("begin_array", nil)
+		}
+		t.objects = t.objects[:len(t.objects)-1]
+		t.key = t.inObject()
+		if x == '}' {
+			return t.token("end_object", nil)
+		}
+		return t.token("end_array", nil)
+	case string:
+		if t.key {
+			t.key = false
+			return t.token("key", x)
+		}
+	case json.Number:
+		f, err := jsonNumber(x)
+		if err != nil {
+			return otto.Value{}, err
+		}
+		tok = f
+	case nil:
+		t.key = t.inObject()
+		return t.token("value", otto.NullValue())
+	}
+	t.key = t.inObject()
+	return t.token("value", tok)
 }
 
-func (c *Context) jsonStringify(call otto.FunctionCall) otto.Value {
-	if len(call.ArgumentList) > 0 {
-		obj, _ := call.ArgumentList[0].Export()
-		data, err := json.Marshal(obj)
-		if err == nil {
-			val, _ := call.Otto.ToValue(string(data))
-			return val
+// value decodes the next complete value, which might be an object
+// or an array. It returns undefined at the end of the input.
+func (t *jsonTokenizer) value(call otto.FunctionCall) (otto.Value, error) {
+	if t.key {
+		return otto.Value{}, errors.New("expecting an object key, use next() to read it")
+	}
+	if !t.dec.More() {
+		if len(t.objects) == 0 {
+			return otto.UndefinedValue(), nil
 		}
-		c.Errorf("error in JSON.stringify: %s\n", err)
+		return otto.Value{}, errors.New("no more values in the current object or array")
 	}
-	return otto.UndefinedValue()
+	val, err := t.c.jsonValue(t.dec)
+	if err != nil {
+		return otto.Value{}, jsonError(err)
+	}
+	t.key = t.inObject()
+	return val, nil
+}
+
+func (c *Context) jsonTokenizer(call otto.FunctionCall) (otto.Value, error) {
+	dec := json.NewDecoder(strings.NewReader(call.Argument(0).String()))
+	dec.UseNumber()
+	t := &jsonTokenizer{c: c, dec: dec}
+	obj, err := c.vm.Object("({})")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	obj.Set("next", c.throwingFunc("SyntaxError", t.next))
+	obj.Set("value", c.throwingFunc("SyntaxError", t.value))
+	obj.Set("more", func() bool { return t.dec.More() })
+	obj.Set("depth", func() int { return len(t.objects) })
+	return obj.Value(), nil
 }
 
 func (c *Context) loadJSON() {
-	obj, _ := c.vm.Object("JSON = {}")
-	obj.Set("parse", c.jsonParse)
-	obj.Set("stringify", c.jsonStringify)
+	script, err := c.vm.Compile(jsonFile, jsonSrc)
+	if err != nil {
+		panic(err)
+	}
+	fn, err := c.vm.Run(script)
+	if err != nil {
+		panic(err)
+	}
+	// JSON.parse must throw a SyntaxError, as required by the spec
+	parse := func(call otto.FunctionCall) otto.Value {
+		val, err := c.jsonParse(call)
+		if err != nil {
+			throwStandardError(call.Otto, "SyntaxError", err)
+		}
+		return val
+	}
+	obj, err := fn.Call(otto.UndefinedValue(), parse, jsonQuote)
+	if err != nil {
+		panic(err)
+	}
+	c.vm.Set("JSON", obj)
+	jsonObj := c.newMacacoObject("json")
+	jsonObj.Set("tokenizer", c.throwingFunc("TypeError", c.jsonTokenizer))
 }
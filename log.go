@@ -1,37 +1,245 @@
 package macaco
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rainycape/otto"
 )
 
-func (c *Context) Debug(args ...interface{}) {
-	if c.verbose {
-		fmt.Fprintln(c.Stdout, args...)
+// LogLevel indicates the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l >= 0 && int(l) < len(logLevelNames) {
+		return logLevelNames[l]
 	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
 }
 
-func (c *Context) Debugf(format string, args ...interface{}) {
-	if c.verbose {
-		fmt.Fprintf(c.Stdout, format, args...)
+// ParseLogLevel returns the LogLevel with the given
+// name (debug, info, warn or error).
+func ParseLogLevel(s string) (LogLevel, error) {
+	for ii, v := range logLevelNames {
+		if strings.EqualFold(s, v) {
+			return LogLevel(ii), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// LogEntry is a message logged by a script or by the Context itself.
+type LogEntry struct {
+	Time    time.Time
+	Level   LogLevel
+	Prefix  string
+	Message string
+	// Fields contains the structured fields attached to the message,
+	// e.g. M.log.info("fetched", {url: u}). It might be nil.
+	Fields map[string]interface{}
+}
+
+// Logger receives the log entries from a Context, see Context.Logger.
+// Log might be called from multiple goroutines when several Contexts
+// share the same Logger.
+type Logger interface {
+	Log(e *LogEntry)
+}
+
+type writerLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+func (l *writerLogger) Log(e *LogEntry) {
+	if e.Level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	if l.json {
+		writeJSONLogEntry(&buf, e)
+	} else {
+		buf.WriteString(e.Time.Format(time.RFC3339))
+		buf.WriteByte(' ')
+		buf.WriteString(strings.ToUpper(e.Level.String()))
+		buf.WriteByte(' ')
+		writeTextLogEntry(&buf, e)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf.WriteTo(l.w)
+}
+
+// NewTextLogger returns a Logger which writes the entries with the given
+// level or higher to w as text, one per line, including the time and
+// the level.
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+// NewJSONLogger returns a Logger which writes the entries with the given
+// level or higher to w as JSON objects, one per line. See Context.LogJSON
+// for the object format.
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{w: w, level: level, json: true}
+}
+
+func writeTextLogEntry(buf *bytes.Buffer, e *LogEntry) {
+	if e.Prefix != "" {
+		buf.WriteString(e.Prefix)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.Message)
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val := fmt.Sprint(e.Fields[k])
+		if strings.ContainsAny(val, " \t\n\"=") {
+			val = fmt.Sprintf("%q", val)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, val)
 	}
+	buf.WriteByte('\n')
+}
+
+func writeJSONLogEntry(buf *bytes.Buffer, e *LogEntry) {
+	obj := map[string]interface{}{
+		"time":    e.Time.Format(time.RFC3339Nano),
+		"level":   e.Level.String(),
+		"message": e.Message,
+	}
+	if e.Prefix != "" {
+		obj["prefix"] = e.Prefix
+	}
+	if len(e.Fields) > 0 {
+		obj["fields"] = e.Fields
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		// Fields can't be encoded, log them as text
+		obj["fields"] = fmt.Sprint(e.Fields)
+		data, _ = json.Marshal(obj)
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+}
+
+// log sends a message to the Context's Logger or, if there's none,
+// writes it to Stdout or Stderr. When the message has neither prefix
+// nor fields, text is written verbatim, so formatted messages
+// are not forced to end with a newline.
+func (c *Context) log(level LogLevel, text string, fields map[string]interface{}) {
+	e := &LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Prefix:  c.LogPrefix,
+		Message: strings.TrimSuffix(text, "\n"),
+		Fields:  fields,
+	}
+	if c.Logger != nil {
+		c.Logger.Log(e)
+		return
+	}
+	if level == LogDebug && !c.verbose {
+		return
+	}
+	w := c.Stdout
+	if level >= LogWarn {
+		w = c.Stderr
+	}
+	var buf bytes.Buffer
+	switch {
+	case c.LogJSON:
+		writeJSONLogEntry(&buf, e)
+	case e.Prefix != "" || len(e.Fields) > 0:
+		writeTextLogEntry(&buf, e)
+	default:
+		buf.WriteString(text)
+	}
+	buf.WriteTo(w)
+}
+
+func (c *Context) Debug(args ...interface{}) {
+	c.log(LogDebug, fmt.Sprintln(args...), nil)
+}
+
+func (c *Context) Debugf(format string, args ...interface{}) {
+	c.log(LogDebug, fmt.Sprintf(format, args...), nil)
 }
 
 func (c *Context) Log(args ...interface{}) {
-	fmt.Fprintln(c.Stdout, args...)
+	c.log(LogInfo, fmt.Sprintln(args...), nil)
 }
 
 func (c *Context) Logf(format string, args ...interface{}) {
-	fmt.Fprintf(c.Stdout, format, args...)
+	c.log(LogInfo, fmt.Sprintf(format, args...), nil)
+}
+
+// Warn logs a message with the LogWarn level.
+func (c *Context) Warn(args ...interface{}) {
+	c.log(LogWarn, fmt.Sprintln(args...), nil)
+}
+
+// Warnf logs a formatted message with the LogWarn level.
+func (c *Context) Warnf(format string, args ...interface{}) {
+	c.log(LogWarn, fmt.Sprintf(format, args...), nil)
 }
 
 func (c *Context) Error(args ...interface{}) {
-	fmt.Fprintln(c.Stderr, args...)
+	c.log(LogError, fmt.Sprintln(args...), nil)
 }
 
 func (c *Context) Errorf(format string, args ...interface{}) {
-	fmt.Fprintf(c.Stderr, format, args...)
+	c.log(LogError, fmt.Sprintf(format, args...), nil)
+}
+
+// LogFields logs a message with the given level and structured fields.
+func (c *Context) LogFields(level LogLevel, msg string, fields map[string]interface{}) {
+	c.log(level, msg+"\n", fields)
+}
+
+// logFunc returns a JS function which logs its arguments with the given
+// level. If the last argument is a plain object and there are more
+// arguments, it's used as the message fields.
+func (c *Context) logFunc(level LogLevel) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		args := call.ArgumentList
+		var fields map[string]interface{}
+		if n := len(args); n > 1 && args[n-1].IsObject() && args[n-1].Class() == "Object" {
+			if v, err := args[n-1].Export(); err == nil {
+				fields, _ = v.(map[string]interface{})
+			}
+			if fields != nil {
+				args = args[:n-1]
+			}
+		}
+		values := make([]interface{}, len(args))
+		for ii, v := range args {
+			values[ii], _ = v.Export()
+		}
+		c.log(level, fmt.Sprintln(values...), fields)
+		return otto.UndefinedValue()
+	}
 }
 
 func (c *Context) loadLogging(obj *otto.Object) {
@@ -39,18 +247,18 @@ func (c *Context) loadLogging(obj *otto.Object) {
 	obj.Set("debugf", c.Debugf)
 	obj.Set("log", c.Log)
 	obj.Set("logf", c.Logf)
+	obj.Set("warn", c.Warn)
+	obj.Set("warnf", c.Warnf)
 	obj.Set("error", c.Error)
 	obj.Set("errorf", c.Errorf)
 
-	console, err := c.vm.Object("this.console = this.console || new Object()")
-	if err != nil {
-		panic(err)
+	// M.log is still a function, but also has a method for each level
+	if logFn, err := obj.Get("log"); err == nil && logFn.IsObject() {
+		logObj := logFn.Object()
+		for ii, v := range logLevelNames {
+			logObj.Set(v, c.logFunc(LogLevel(ii)))
+		}
 	}
-	console.Set("debug", c.Debug)
-	console.Set("debugf", c.Debugf)
-	console.Set("log", c.Log)
-	console.Set("logf", c.Logf)
-	console.Set("error", c.Error)
-	console.Set("errorf", c.Errorf)
 
+	c.loadConsole()
 }
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
@@ -23,10 +24,43 @@ type Options struct {
 	Bare bool
 	// The runtime to load. If empty defaults to "macaco/runtime"
 	Runtime string
-	// Token is the macaco API token used with
-	Token      string
-	Verbose    bool
+	// Token is the macaco API token used when loading and
+	// uploading programs. It might be either a token or the name
+	// of a token stored in ~/.macaco/tokens. If empty, the
+	// MACACO_TOKEN environment variable or the default token
+	// are used.
+	Token   string
+	Verbose bool
+	// API is the base URL of the program API. If empty, the
+	// MACACO_API environment variable or http://macaco.io/api/v1
+	// are used.
+	API string
+	// HTTPClient is used for all HTTP requests. If nil,
+	// http.DefaultClient is used, unless Proxy is non-empty.
 	HTTPClient *http.Client
+	// Proxy is the URL of the proxy used for HTTP requests
+	// when HTTPClient is nil.
+	Proxy string
+	// UserAgent is sent as the User-Agent header in HTTP requests
+	// when non-empty.
+	UserAgent string
+	// CacheMaxAge limits how long HTTP responses are cached. Zero
+	// means no limit besides the response expiration.
+	CacheMaxAge time.Duration
+	// CacheMaxEntrySize is the maximum size in bytes of the HTTP
+	// responses which are cached on disk. Zero means no limit.
+	CacheMaxEntrySize int64
+	// Instrument enables instrumentation for the loaded programs,
+	// see Context.Instrument. The runtime is never instrumented.
+	Instrument bool
+	// Logger, LogJSON and LogPrefix set the respective fields
+	// in the Context, see Context.Logger.
+	Logger    Logger
+	LogJSON   bool
+	LogPrefix string
+	// Modules are installed into the Context before loading
+	// the runtime, see Context.Install.
+	Modules []Module
 }
 
 type Macaco struct {
@@ -43,22 +77,46 @@ func New(opts *Options) (*Macaco, error) {
 	mc := &Macaco{ctx: ctx}
 	runtime := "macaco/runtime"
 	bare := false
+	var token string
 	if opts != nil {
 		ctx.HTTPClient = opts.HTTPClient
+		if ctx.HTTPClient == nil && opts.Proxy != "" {
+			proxy, err := url.Parse(opts.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy URL %q: %s", opts.Proxy, err)
+			}
+			ctx.HTTPClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+		}
+		ctx.UserAgent = opts.UserAgent
+		ctx.Logger = opts.Logger
+		ctx.LogJSON = opts.LogJSON
+		ctx.LogPrefix = opts.LogPrefix
+		ctx.api = opts.API
+		ctx.cache.maxAge = opts.CacheMaxAge
+		ctx.cache.maxEntrySize = opts.CacheMaxEntrySize
 		bare = opts.Bare
 		if opts.Runtime != "" {
 			runtime = opts.Runtime
 		}
-		mc.token = expandToken(opts.Token)
-		mc.ctx.token = opts.Token
+		token = opts.Token
 		mc.verbose = opts.Verbose
 		mc.ctx.verbose = opts.Verbose
+		for _, v := range opts.Modules {
+			if err := ctx.Install(v); err != nil {
+				return nil, err
+			}
+		}
 	}
+	mc.token = expandToken(mc.ctx, token)
+	mc.ctx.token = mc.token
 	if !bare {
 		if err := mc.Load(runtime); err != nil {
 			return nil, err
 		}
 	}
+	if opts != nil && opts.Instrument {
+		ctx.Instrument()
+	}
 	return mc, nil
 }
 
@@ -86,11 +144,7 @@ func (m *Macaco) loadFiles(prog string) error {
 		if m.verbose {
 			fmt.Println("compiling", v)
 		}
-		script, err := m.ctx.vm.Compile(v, data)
-		if err != nil {
-			return err
-		}
-		if _, err := m.ctx.vm.Run(script); err != nil {
+		if _, err := m.ctx.loadScript(v, v, data); err != nil {
 			return err
 		}
 	}
@@ -161,8 +215,13 @@ func (m *Macaco) Upload(name string, src interface{}) error {
 	values := make(url.Values)
 	values.Set("name", name)
 	values.Set("access_token", m.token)
-	p := apiURL("/upload?" + values.Encode())
-	resp, err := http.Post(p, "application/zip", bytes.NewReader(data))
+	p := m.ctx.apiURL("/upload?" + values.Encode())
+	req, err := http.NewRequest("POST", p, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := m.ctx.doHTTPRequest(req)
 	if err != nil {
 		return err
 	}
@@ -173,10 +232,13 @@ func (m *Macaco) Upload(name string, src interface{}) error {
 	return nil
 }
 
-func apiURL(p string) string {
-	api := defaultAPI
-	if v := os.Getenv("MACACO_API"); v != "" {
-		api = v
+func (c *Context) apiURL(p string) string {
+	api := c.api
+	if api == "" {
+		api = defaultAPI
+		if v := os.Getenv(APIEnvVar); v != "" {
+			api = v
+		}
 	}
 	return api + p
 }
@@ -0,0 +1,256 @@
+package macaco
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/rainycape/otto"
+)
+
+var (
+	valueType     = reflect.TypeOf((*Value)(nil))
+	ottoValueType = reflect.TypeOf(otto.Value{})
+)
+
+// marshaler converts Go values to plain JS values,
+// see Context.ToValue.
+type marshaler struct {
+	c *Context
+	// pointers, maps and slices in the path being converted,
+	// for detecting cycles
+	seen map[marshalRef]bool
+}
+
+// marshalRef identifies a pointer, map or slice. Slices also
+// include their length, since a slice and its subslices share
+// the same pointer.
+type marshalRef struct {
+	ptr uintptr
+	len int
+}
+
+// ToValue converts v to a JS value. Unlike passing Go values to Call or
+// Set, which exposes them to JS as wrappers with all their exported
+// fields and methods, ToValue returns plain JS values. Structs become
+// objects with a property for each field, named according to the same
+// rules used by Value.Export, while their methods are not exposed.
+// Fields with the omitempty option are omitted when they have their zero
+// value. Maps with string keys become objects, slices and arrays become
+// arrays (nil slices become null), time.Time becomes a Date and functions
+// remain callable. []byte becomes a binary string, with the same bytes,
+// like the HTTP response bodies, so it can be passed to functions
+// accepting binary data (e.g. M.image.decode) and exported back into
+// a []byte.
+//
+// *Value and otto.Value are returned as is, so values returned by
+// ToValue might be passed again to it or to Call and Set.
+func (c *Context) ToValue(v interface{}) (*Value, error) {
+	m := &marshaler{c: c, seen: make(map[marshalRef]bool)}
+	val, err := m.value(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return &Value{val, c}, nil
+}
+
+// ottoValue converts an argument to an otto.Value, passing the
+// values returned by ToValue through.
+func (c *Context) ottoValue(v interface{}) (otto.Value, error) {
+	switch x := v.(type) {
+	case *Value:
+		if x == nil {
+			return otto.UndefinedValue(), nil
+		}
+		return x.val, nil
+	case otto.Value:
+		return x, nil
+	}
+	return c.vm.ToValue(v)
+}
+
+func isEmptyValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	case reflect.Bool:
+		return !val.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return val.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return val.Float() == 0
+	case reflect.Interface, reflect.Ptr, reflect.Func:
+		return val.IsNil()
+	case reflect.Struct:
+		if val.Type() == timeType {
+			return val.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
+
+func (m *marshaler) value(val reflect.Value) (otto.Value, error) {
+	if !val.IsValid() {
+		return otto.NullValue(), nil
+	}
+	switch val.Type() {
+	case valueType:
+		if val.IsNil() {
+			return otto.UndefinedValue(), nil
+		}
+		return val.Interface().(*Value).val, nil
+	case ottoValueType:
+		return val.Interface().(otto.Value), nil
+	case timeType:
+		t := val.Interface().(time.Time)
+		ms := float64(t.UnixNano()) / float64(time.Millisecond)
+		return m.c.vm.Call("new Date", nil, ms)
+	}
+	switch val.Kind() {
+	case reflect.Bool:
+		return m.c.vm.ToValue(val.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return m.c.vm.ToValue(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return m.c.vm.ToValue(val.Uint())
+	case reflect.Float32, reflect.Float64:
+		return m.c.vm.ToValue(val.Float())
+	case reflect.String:
+		return m.c.vm.ToValue(val.String())
+	case reflect.Func:
+		if val.IsNil() {
+			return otto.NullValue(), nil
+		}
+		return m.c.vm.ToValue(val.Interface())
+	case reflect.Interface:
+		if val.IsNil() {
+			return otto.NullValue(), nil
+		}
+		return m.value(val.Elem())
+	case reflect.Ptr:
+		if val.IsNil() {
+			return otto.NullValue(), nil
+		}
+		ref := marshalRef{ptr: val.Pointer()}
+		if err := m.enter(val, ref); err != nil {
+			return otto.Value{}, err
+		}
+		defer delete(m.seen, ref)
+		return m.value(val.Elem())
+	case reflect.Struct:
+		return m.structValue(val)
+	case reflect.Map:
+		if val.IsNil() {
+			return m.mapValue(val)
+		}
+		ref := marshalRef{ptr: val.Pointer()}
+		if err := m.enter(val, ref); err != nil {
+			return otto.Value{}, err
+		}
+		defer delete(m.seen, ref)
+		return m.mapValue(val)
+	case reflect.Slice:
+		if val.IsNil() {
+			return otto.NullValue(), nil
+		}
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			// Binary string, see ToValue
+			return m.c.vm.ToValue(string(val.Bytes()))
+		}
+		ref := marshalRef{ptr: val.Pointer(), len: val.Len()}
+		if err := m.enter(val, ref); err != nil {
+			return otto.Value{}, err
+		}
+		defer delete(m.seen, ref)
+		return m.arrayValue(val)
+	case reflect.Array:
+		return m.arrayValue(val)
+	}
+	return otto.Value{}, fmt.Errorf("can't convert %s to JS", val.Type())
+}
+
+// enter marks ref as being converted, returning an error if
+// it's already in the path, which means val contains a cycle.
+func (m *marshaler) enter(val reflect.Value, ref marshalRef) error {
+	if m.seen[ref] {
+		return fmt.Errorf("can't convert %s to JS, it contains a cycle", val.Type())
+	}
+	m.seen[ref] = true
+	return nil
+}
+
+func (m *marshaler) structValue(val reflect.Value) (otto.Value, error) {
+	obj, err := m.c.vm.Object("({})")
+	if err != nil {
+		return otto.Value{}, err
+	}
+fields:
+	for _, f := range structFields(val.Type()) {
+		fv := val
+		for ii, idx := range f.index {
+			if ii > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					// Embedded nil pointer, the field is not present
+					continue fields
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(idx)
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		v, err := m.value(fv)
+		if err != nil {
+			return otto.Value{}, fmt.Errorf("field %s: %s", f.name, err)
+		}
+		if err := obj.Set(f.name, v); err != nil {
+			return otto.Value{}, err
+		}
+	}
+	return obj.Value(), nil
+}
+
+func (m *marshaler) mapValue(val reflect.Value) (otto.Value, error) {
+	if val.Type().Key().Kind() != reflect.String {
+		return otto.Value{}, fmt.Errorf("can't convert %s to JS, map keys must be strings", val.Type())
+	}
+	if val.IsNil() {
+		return otto.NullValue(), nil
+	}
+	obj, err := m.c.vm.Object("({})")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	// Sort the keys, so the property order is deterministic
+	keys := make([]string, 0, val.Len())
+	for _, k := range val.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := m.value(val.MapIndex(reflect.ValueOf(k).Convert(val.Type().Key())))
+		if err != nil {
+			return otto.Value{}, fmt.Errorf("key %s: %s", k, err)
+		}
+		if err := obj.Set(k, v); err != nil {
+			return otto.Value{}, err
+		}
+	}
+	return obj.Value(), nil
+}
+
+func (m *marshaler) arrayValue(val reflect.Value) (otto.Value, error) {
+	items := make([]interface{}, val.Len())
+	for ii := range items {
+		v, err := m.value(val.Index(ii))
+		if err != nil {
+			return otto.Value{}, fmt.Errorf("index %d: %s", ii, err)
+		}
+		items[ii] = v
+	}
+	return m.c.newArray(items)
+}
@@ -0,0 +1,152 @@
+package macaco
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rainycape/otto"
+)
+
+// Module is a set of Go functions and values installed into the JS
+// runtime by the host application, see Context.Install and
+// Options.Modules. Modules are installed again into every copy of
+// the Context, so the functions registered by Install should only
+// reference the *Context they receive.
+type Module interface {
+	// Name returns the module name. Installing a module replaces
+	// any previously installed module with the same name.
+	Name() string
+	// Install registers the module functions into the given
+	// Context, usually with Context.Register. Modules conventionally
+	// register their functions under M.<name>.
+	Install(c *Context) error
+}
+
+// Install installs the given Module into the Context and
+// into all its subsequent copies.
+func (c *Context) Install(m Module) error {
+	if err := c.installModule(m); err != nil {
+		return fmt.Errorf("error installing module %s: %s", m.Name(), err)
+	}
+	// Always allocate a new slice, since the previous
+	// one might be shared with other copies.
+	modules := make([]Module, 0, len(c.modules)+1)
+	for _, v := range c.modules {
+		if v.Name() != m.Name() {
+			modules = append(modules, v)
+		}
+	}
+	c.modules = append(modules, m)
+	return nil
+}
+
+func (c *Context) installModules() error {
+	for _, v := range c.modules {
+		if err := c.installModule(v); err != nil {
+			return fmt.Errorf("error installing module %s: %s", v.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (c *Context) installModule(m Module) error {
+	c.installing = true
+	defer func() {
+		c.installing = false
+	}()
+	return m.Install(c)
+}
+
+// registeredFunction is a function registered directly
+// with Register, see Context.functions.
+type registeredFunction struct {
+	name string
+	fn   interface{}
+}
+
+func (c *Context) registerFunctions() error {
+	for _, v := range c.functions {
+		if err := c.register(v.name, v.fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register makes the Go function fn available to JS with the given
+// name, which might contain dots to set it as a property of an object
+// (e.g. M.geo.distance). Missing objects in the path are created. See
+// Context.Function for how arguments, results and errors are converted.
+//
+// Functions registered directly into the Context are registered again
+// into its copies, so functions receiving the Context as their first
+// parameter receive the copy running them. Closures which reference
+// the Context should be registered from a Module, so they're created
+// again for each copy.
+func (c *Context) Register(name string, fn interface{}) error {
+	if err := c.register(name, fn); err != nil {
+		return err
+	}
+	if !c.installing {
+		// Always allocate a new slice, like Install does
+		functions := make([]registeredFunction, 0, len(c.functions)+1)
+		for _, v := range c.functions {
+			if v.name != name {
+				functions = append(functions, v)
+			}
+		}
+		c.functions = append(functions, registeredFunction{name, fn})
+	}
+	return nil
+}
+
+func (c *Context) register(name string, fn interface{}) error {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("can't register %T as %s, it's not a function", fn, name)
+	}
+	parts := strings.Split(name, ".")
+	for _, v := range parts {
+		if v == "" {
+			return fmt.Errorf("invalid function name %q", name)
+		}
+	}
+	obj, err := c.vm.Object("this")
+	if err != nil {
+		return err
+	}
+	for _, v := range parts[:len(parts)-1] {
+		obj, err = c.childObject(obj, v)
+		if err != nil {
+			return fmt.Errorf("can't register %s: %s", name, err)
+		}
+	}
+	val, err := c.Function(fn)
+	if err != nil {
+		return err
+	}
+	return obj.Set(parts[len(parts)-1], val.val)
+}
+
+// childObject returns the object stored in the given property of
+// obj, creating it if it doesn't exist.
+func (c *Context) childObject(obj *otto.Object, name string) (*otto.Object, error) {
+	val, err := obj.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if val.IsObject() {
+		return val.Object(), nil
+	}
+	if val.IsDefined() && !val.IsNull() {
+		return nil, fmt.Errorf("%s is not an object", name)
+	}
+	child, err := c.vm.Object("({})")
+	if err != nil {
+		return nil, err
+	}
+	if err := obj.Set(name, child); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
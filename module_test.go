@@ -0,0 +1,126 @@
+package macaco
+
+import (
+	"errors"
+	"testing"
+)
+
+type testModule struct {
+	installs int
+}
+
+func (m *testModule) Name() string {
+	return "greet"
+}
+
+func (m *testModule) Install(c *Context) error {
+	m.installs++
+	prefix := c.LogPrefix
+	return c.Register("M.greet.hello", func(name string) string {
+		return prefix + ": hello " + name
+	})
+}
+
+func TestModule(t *testing.T) {
+	ctx := newTestingContext(t)
+	ctx.LogPrefix = "orig"
+	mod := &testModule{}
+	if err := ctx.Install(mod); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Register("util.math.double", func(x int) int { return 2 * x }); err != nil {
+		t.Fatal(err)
+	}
+	cpy := ctx.Copy()
+	cpy.LogPrefix = "copy"
+	if err := cpy.Install(mod); err != nil {
+		t.Fatal(err)
+	}
+	runJSCases(t, ctx, []jsCase{
+		{`M.greet.hello('Ann')`, `orig: hello Ann`},
+		{`util.math.double(21)`, `42`},
+	})
+	runJSCases(t, cpy, []jsCase{
+		{`M.greet.hello('Ann')`, `copy: hello Ann`},
+		{`util.math.double(2)`, `4`},
+	})
+	runJSCases(t, cpy.Copy(), []jsCase{
+		{`M.greet.hello('Bob')`, `copy: hello Bob`},
+	})
+	if len(cpy.modules) != 1 || len(ctx.modules) != 1 {
+		t.Errorf("expecting 1 module, got %d and %d", len(ctx.modules), len(cpy.modules))
+	}
+	// Initial install, copy, reinstall into the copy and copy of the copy
+	if mod.installs != 4 {
+		t.Errorf("expecting 4 installs, got %d", mod.installs)
+	}
+	if err := ctx.Register("M.greet.hello.bad.", func() {}); err == nil {
+		t.Error("expecting an error with an empty name")
+	}
+	if err := ctx.Register("x", 1); err == nil {
+		t.Error("expecting an error registering a non-function")
+	}
+}
+
+func TestFunction(t *testing.T) {
+	ctx := newTestingContext(t)
+	funcs := map[string]interface{}{
+		"add": func(a, b int) int { return a + b },
+		"fail": func(code int) (string, error) {
+			if code > 0 {
+				return "", &Error{Message: "failed", Code: code}
+			}
+			return "ok", nil
+		},
+		"plain": func() error { return errors.New("plain error") },
+		"sum": func(values ...float64) float64 {
+			var s float64
+			for _, v := range values {
+				s += v
+			}
+			return s
+		},
+		"prefix": func(c *Context, s string) string { return c.LogPrefix + s },
+		"apply":  func(fn *Value, arg int) (*Value, error) { return fn.Call(nil, arg) },
+	}
+	for k, v := range funcs {
+		if err := ctx.Register(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cpy := ctx.Copy()
+	cpy.LogPrefix = "copy:"
+	cases := []jsCase{
+		{`add(1, 2)`, `3`},
+		{`try { add(1.5, 2) } catch (e) { e.name }`, `TypeError`},
+		{`fail(0)`, `ok`},
+		{`try { fail(42) } catch (e) { [e instanceof M.Error, e.message, e.code].join() }`, `true,failed,42`},
+		{`try { plain() } catch (e) { [e instanceof M.Error, e.message].join() }`, `true,plain error`},
+		{`sum(1, 2, 3.5)`, `6.5`},
+		{`prefix('x')`, `copy:x`},
+		{`__macaco_context = 1; [add(1, 2), prefix('y')].join()`, `3,copy:y`},
+		{`apply(function(x) { return x * 2 }, 4)`, `8`},
+		{`try { apply(function() { throw new RangeError('r') }, 1) } catch (e) { e.name + ': ' + e.message }`, `RangeError: r`},
+		{`try { M.html.parse('<a>').Find(1) } catch (e) { e.name }`, `TypeError`},
+		{`try { M.image.decode('not an image') } catch (e) { e instanceof M.Error }`, `true`},
+		{`try { M.http.get('http://localhost', null, {headers: 1}) } catch (e) { e.name }`, `TypeError`},
+		// Exceptions thrown by callbacks propagate unchanged
+		{`try { M.html.parse('<a></a>').Visit(function() { throw new M.Error('boom', 5) }) } catch (e) { [e instanceof M.Error, e.code, e.message].join() }`, `true,5,boom`},
+		{`try { M.xml.parse('<a/>').Visit(function() { throw {a: 1} }) } catch (e) { e.a }`, `1`},
+		{`try { M.load_script('x.js', "throw new RangeError('r')") } catch (e) { e.name + ': ' + e.message }`, `RangeError: r`},
+		// Built-ins throw M.Error, named after the error kind
+		{`try { M.feed.parse('<html></html>') } catch (e) { [e instanceof M.Error, e.code, e.name].join() }`, `true,0,SyntaxError`},
+		{`try { M.csv.each('a', 1) } catch (e) { [e instanceof M.Error, e.name].join() }`, `true,TypeError`},
+		{`try { M.image.decode('x') } catch (e) { [e instanceof M.Error, e.name].join() }`, `true,Error`},
+		// Except the standard ones
+		{`try { JSON.parse('{') } catch (e) { [e instanceof SyntaxError, e instanceof M.Error].join() }`, `true,false`},
+	}
+	runJSCases(t, cpy, cases)
+	_, err := cpy.Run("fail(7)")
+	if se, ok := err.(*ScriptError); !ok || se.Message != "failed" {
+		t.Errorf("expecting a ScriptError with message failed, got %v", err)
+	}
+	if _, err := ctx.Function(func() (int, int) { return 0, 0 }); err == nil {
+		t.Error("expecting an error with a non-error second result")
+	}
+}
@@ -0,0 +1,98 @@
+package macaco
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/rainycape/otto"
+)
+
+// ndjsonReader reads newline delimited JSON values, skipping
+// empty lines.
+type ndjsonReader struct {
+	c    *Context
+	text string
+	line int
+}
+
+func (r *ndjsonReader) next() (otto.Value, error) {
+	for r.text != "" {
+		var line string
+		if nl := strings.IndexByte(r.text, '\n'); nl >= 0 {
+			line, r.text = r.text[:nl], r.text[nl+1:]
+		} else {
+			line, r.text = r.text, ""
+		}
+		r.line++
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		val, err := r.c.parseJSON(line)
+		if err != nil {
+			return otto.Value{}, fmt.Errorf("line %d: %s", r.line, err)
+		}
+		return val, nil
+	}
+	return otto.UndefinedValue(), nil
+}
+
+func (c *Context) ndjsonReader(call otto.FunctionCall) (otto.Value, error) {
+	r := &ndjsonReader{c: c, text: call.Argument(0).String()}
+	return c.newReader(r.next), nil
+}
+
+func (c *Context) ndjsonParse(call otto.FunctionCall) (otto.Value, error) {
+	r := &ndjsonReader{c: c, text: call.Argument(0).String()}
+	var values []interface{}
+	for {
+		val, err := r.next()
+		if err != nil {
+			return otto.Value{}, err
+		}
+		if val.IsUndefined() {
+			break
+		}
+		values = append(values, val)
+	}
+	return c.newArray(values)
+}
+
+func (c *Context) ndjsonStringify(call otto.FunctionCall) (otto.Value, error) {
+	arg := call.Argument(0)
+	if !arg.IsObject() {
+		return otto.Value{}, fmt.Errorf("M.ndjson.stringify requires an array, not %s", arg)
+	}
+	values := arg.Object()
+	length, err := values.Get("length")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	n, _ := length.ToInteger()
+	var buf bytes.Buffer
+	for ii := int64(0); ii < n; ii++ {
+		v, err := values.Get(fmt.Sprint(ii))
+		if err != nil {
+			return otto.Value{}, err
+		}
+		s, err := c.vm.Call("JSON.stringify", nil, v)
+		if err != nil {
+			return otto.Value{}, fmt.Errorf("item %d: %s", ii, c.scriptError(err).Message)
+		}
+		if s.IsUndefined() {
+			return otto.Value{}, fmt.Errorf("item %d can't be represented as JSON", ii)
+		}
+		buf.WriteString(s.String())
+		buf.WriteByte('\n')
+	}
+	return c.vm.ToValue(buf.String())
+}
+
+func (c *Context) loadNDJSON(obj *otto.Object) {
+	ndjsonObj := c.newMacacoObject("ndjson")
+	reader := c.throwingFunc("TypeError", c.ndjsonReader)
+	ndjsonObj.Set("parse", c.throwingFunc("SyntaxError", c.ndjsonParse))
+	ndjsonObj.Set("stringify", c.throwingFunc("TypeError", c.ndjsonStringify))
+	ndjsonObj.Set("reader", reader)
+	ndjsonObj.Set("each", c.eachFunc(reader))
+}
@@ -0,0 +1,53 @@
+package macaco
+
+import (
+	"testing"
+)
+
+func TestNDJSON(t *testing.T) {
+	ctx := newTestingContext(t)
+	cases := []jsCase{
+		{`JSON.stringify(M.ndjson.parse('{"a": 1}\n\n[2, 3]\r\n"x"'))`, `[{"a":1},[2,3],"x"]`},
+		{`M.ndjson.stringify([{b: 1, a: 'x'}, [1], null])`, "{\"b\":1,\"a\":\"x\"}\n[1]\nnull\n"},
+		{`var s = 0; M.ndjson.each('1\n2\n3\n4', function(v, ii) { s += v; return ii < 1; }); s`, `3`},
+		{`try { M.ndjson.parse('1\n{') } catch (e) { e.name + ' ' + e.message }`, `SyntaxError line 2: unexpected end of JSON input`},
+		{`var r = M.ndjson.reader('1\n2'); [r.next(), r.next(), r.next()].join()`, `1,2,`},
+	}
+	runJSCases(t, ctx, cases)
+}
+
+func TestJSONTokenizer(t *testing.T) {
+	ctx := newTestingContext(t)
+	val, err := ctx.Run(`
+	var t = M.json.tokenizer('{"total": 3, "items": [{"id": 1}, {"id": 2}, {"id": 3}], "done": true}');
+	var tokens = [];
+	var ids = 0;
+	for (var tok = t.next(); tok !== undefined; tok = t.next()) {
+		tokens.push(tok.type + (tok.value !== undefined ? ':' + tok.value : ''));
+		if (tok.type === 'key' && tok.value === 'items') {
+			tokens.push(t.next().type + '@' + t.depth());
+			while (t.more()) {
+				ids += t.value().id;
+			}
+		}
+	}
+	tokens.join(' ') + ' ids=' + ids;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "begin_object key:total value:3 key:items begin_array@2 end_array key:done value:true end_object ids=6"
+	if s := val.String(); s != expected {
+		t.Errorf("expecting %q, got %q", expected, s)
+	}
+	val, err = ctx.Run(`var t = M.json.tokenizer('[1e400, -1e400]'); [t.next().type, t.next().value, t.next().value].join()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := val.String(); s != "begin_array,Infinity,-Infinity" {
+		t.Errorf("expecting out of range numbers to be infinite, got %q", s)
+	}
+	if _, err := ctx.Run(`M.json.tokenizer('[1, }').value()`); err == nil {
+		t.Error("expecting an error from invalid JSON")
+	}
+}
@@ -0,0 +1,161 @@
+package macaco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+// protoBuffer implements the subset of the protocol buffers
+// encoding required for writing pprof profiles
+// (https://github.com/google/pprof/blob/master/proto/profile.proto).
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.WriteByte(byte(v))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	if v != 0 {
+		b.key(field, 0)
+		b.varint(v)
+	}
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.uint64Field(field, uint64(v))
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) packedField(field int, values []uint64) {
+	if len(values) == 0 {
+		return
+	}
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytesField(field, packed.Bytes())
+}
+
+// pprofStrings implements the string table in a pprof profile.
+type pprofStrings struct {
+	strings []string
+	indexes map[string]int
+}
+
+func (s *pprofStrings) index(str string) uint64 {
+	if s.indexes == nil {
+		// Index 0 must always be the empty string
+		s.strings = []string{""}
+		s.indexes = map[string]int{"": 0}
+	}
+	idx, ok := s.indexes[str]
+	if !ok {
+		idx = len(s.strings)
+		s.strings = append(s.strings, str)
+		s.indexes[str] = idx
+	}
+	return uint64(idx)
+}
+
+// WritePprof writes the profile in the gzipped protocol buffers format
+// used by pprof (e.g. go tool pprof). Samples contain 2 values: the
+// number of samples and their wall time in nanoseconds.
+func (p *Profile) WritePprof(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var st pprofStrings
+	var prof protoBuffer
+	valueType := func(typ string, unit string) []byte {
+		var vt protoBuffer
+		vt.uint64Field(1, st.index(typ))
+		vt.uint64Field(2, st.index(unit))
+		return vt.Bytes()
+	}
+	// sample_type
+	prof.bytesField(1, valueType("samples", "count"))
+	prof.bytesField(1, valueType("wall", "nanoseconds"))
+	// Sort the samples, so the output is stable
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Functions and locations use the same ids, one per
+	// function or native operation.
+	ids := make(map[int]uint64)
+	var order []int
+	for _, k := range keys {
+		s := p.samples[k]
+		locations := make([]uint64, len(s.stack))
+		for ii, v := range s.stack {
+			id, ok := ids[v]
+			if !ok {
+				id = uint64(len(ids) + 1)
+				ids[v] = id
+				order = append(order, v)
+			}
+			// Leaf first
+			locations[len(s.stack)-ii-1] = id
+		}
+		var sample protoBuffer
+		sample.packedField(1, locations)
+		sample.packedField(2, []uint64{uint64(s.count), uint64(s.wall)})
+		prof.bytesField(2, sample.Bytes())
+	}
+	for _, v := range order {
+		fp := p.functionProfile(v)
+		id := ids[v]
+		var line protoBuffer
+		line.uint64Field(1, id)
+		line.int64Field(2, int64(fp.Line))
+		var loc protoBuffer
+		loc.uint64Field(1, id)
+		loc.bytesField(4, line.Bytes())
+		prof.bytesField(4, loc.Bytes())
+		var fn protoBuffer
+		fn.uint64Field(1, id)
+		fn.uint64Field(2, st.index(fp.Name))
+		fn.uint64Field(3, st.index(fp.Name))
+		fn.uint64Field(4, st.index(fp.File))
+		fn.int64Field(5, int64(fp.Line))
+		prof.bytesField(5, fn.Bytes())
+	}
+	// period_type and period must be added to the string
+	// table before writing it.
+	periodType := valueType("wall", "nanoseconds")
+	for _, v := range st.strings {
+		prof.bytesField(6, []byte(v))
+	}
+	prof.int64Field(9, p.started.UnixNano())
+	end := p.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	prof.int64Field(10, int64(end.Sub(p.started)))
+	prof.bytesField(11, periodType)
+	prof.int64Field(12, int64(ProfilePeriod))
+	gw := gzip.NewWriter(w)
+	if _, err := gw.Write(prof.Bytes()); err != nil {
+		return err
+	}
+	return gw.Close()
+}
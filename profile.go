@@ -0,0 +1,401 @@
+package macaco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// ProfilePeriod is the minimum interval between
+	// samples of the JS stack when profiling.
+	ProfilePeriod = time.Millisecond
+
+	htmlParseFrame         = "M.html.parse"
+	htmlParseFragmentFrame = "M.html.parse_fragment"
+)
+
+// FunctionProfile contains the time spent in a function, measured by
+// sampling. Flat only includes the time spent in the function itself,
+// while Cumulative also includes the functions it called. Native
+// operations, like HTTP requests and HTML parsing, are also reported
+// as functions named after the operation (e.g. M.http GET example.com).
+type FunctionProfile struct {
+	Name       string
+	File       string
+	Line       int
+	Native     bool
+	Calls      int
+	Samples    int
+	Flat       time.Duration
+	Cumulative time.Duration
+}
+
+// HTTPRequestProfile records an HTTP request made with M.http.
+type HTTPRequestProfile struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Bytes      int
+	Started    time.Time
+	Duration   time.Duration
+	// Cached is true when the response was served from the cache.
+	Cached bool
+	Error  string
+}
+
+// HTMLParseProfile records a call to M.html.parse or
+// M.html.parse_fragment.
+type HTMLParseProfile struct {
+	Fragment bool
+	Bytes    int
+	Started  time.Time
+	Duration time.Duration
+}
+
+type profileSample struct {
+	stack []int
+	count int
+	wall  time.Duration
+}
+
+// Profile records where the time is spent while running scripts: wall
+// time per JS function, HTTP requests and HTML parsing. The JS stack is
+// sampled from the instrumented code at most every ProfilePeriod, so JS
+// functions are only profiled in the scripts loaded after the Context is
+// instrumented, see Context.Instrument. Use Context.StartProfile to
+// start profiling. All the copies of the Context are profiled, but only
+// one of them should be running while profiling, otherwise stacks
+// would be mixed.
+type Profile struct {
+	in       *instrumentation
+	mu       sync.Mutex
+	started  time.Time
+	finished time.Time
+	// stack contains the function indexes being executed, with
+	// native operations represented as -(index in natives + 1).
+	stack    []int
+	natives  []string
+	calls    map[int]int
+	samples  map[string]*profileSample
+	requests []*HTTPRequestProfile
+	parses   []*HTMLParseProfile
+	// last is the time of the last sample
+	last time.Time
+}
+
+// StartProfile starts profiling this Context, instrumenting it if
+// required. Call Stop on the returned Profile to finish profiling.
+// If the Context is already being profiled, its current Profile
+// is returned.
+func (c *Context) StartProfile() *Profile {
+	c.Instrument()
+	c.instr.Lock()
+	defer c.instr.Unlock()
+	if c.instr.profile != nil {
+		return c.instr.profile
+	}
+	p := &Profile{
+		in:      c.instr,
+		started: time.Now(),
+		calls:   make(map[int]int),
+		samples: make(map[string]*profileSample),
+	}
+	p.last = p.started
+	c.instr.profile = p
+	return p
+}
+
+func (c *Context) profile() *Profile {
+	if c.instr == nil {
+		return nil
+	}
+	c.instr.RLock()
+	defer c.instr.RUnlock()
+	return c.instr.profile
+}
+
+// Stop finishes the profile. Calling it multiple times has no
+// effect.
+func (p *Profile) Stop() {
+	p.in.Lock()
+	if p.in.profile == p {
+		p.in.profile = nil
+	}
+	p.in.Unlock()
+	p.mu.Lock()
+	if p.finished.IsZero() {
+		p.tick()
+		p.finished = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// Duration returns the profile duration.
+func (p *Profile) Duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished.IsZero() {
+		return time.Since(p.started)
+	}
+	return p.finished.Sub(p.started)
+}
+
+// tick records a sample for the current stack if at least
+// ProfilePeriod has elapsed since the previous one. It's called
+// from every hook and before changing the stack, so the elapsed
+// time is attributed to the right stack even when no statements
+// are executed in a while (e.g. while waiting for a native
+// operation). p.mu must be held.
+func (p *Profile) tick() {
+	if !p.finished.IsZero() {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(p.last)
+	if elapsed < ProfilePeriod {
+		return
+	}
+	p.last = now
+	if len(p.stack) == 0 {
+		// Not running JS
+		return
+	}
+	var key bytes.Buffer
+	for _, v := range p.stack {
+		key.WriteString(strconv.Itoa(v))
+		key.WriteByte(',')
+	}
+	s := p.samples[key.String()]
+	if s == nil {
+		s = &profileSample{stack: append([]int(nil), p.stack...)}
+		p.samples[key.String()] = s
+	}
+	s.count += int(elapsed / ProfilePeriod)
+	s.wall += elapsed
+}
+
+func (p *Profile) statement(c *Context, id int) bool {
+	p.mu.Lock()
+	p.tick()
+	p.mu.Unlock()
+	return false
+}
+
+func (p *Profile) enter(c *Context, fn int) {
+	p.mu.Lock()
+	p.tick()
+	p.stack = append(p.stack, fn)
+	p.calls[fn]++
+	p.mu.Unlock()
+}
+
+func (p *Profile) exit(c *Context, fn int) {
+	p.mu.Lock()
+	p.tick()
+	if n := len(p.stack); n > 0 {
+		p.stack = p.stack[:n-1]
+	}
+	p.mu.Unlock()
+}
+
+// beginNative pushes a frame for a native operation,
+// which must be popped by calling endNative.
+func (p *Profile) beginNative(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := 0
+	for ii, v := range p.natives {
+		if v == name {
+			id = -(ii + 1)
+			break
+		}
+	}
+	if id == 0 {
+		p.natives = append(p.natives, name)
+		id = -len(p.natives)
+	}
+	p.tick()
+	p.stack = append(p.stack, id)
+	p.calls[id]++
+}
+
+func (p *Profile) endNative() {
+	p.exit(nil, 0)
+}
+
+func (p *Profile) beginHTTPRequest(method string, u string) *HTTPRequestProfile {
+	host := u
+	if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+	p.beginNative("M.http " + method + " " + host)
+	return &HTTPRequestProfile{Method: method, URL: u, Started: time.Now()}
+}
+
+func (p *Profile) endHTTPRequest(r *HTTPRequestProfile) {
+	r.Duration = time.Since(r.Started)
+	p.endNative()
+	p.mu.Lock()
+	p.requests = append(p.requests, r)
+	p.mu.Unlock()
+}
+
+func (p *Profile) beginHTMLParse(size int, fragment bool) *HTMLParseProfile {
+	if fragment {
+		p.beginNative(htmlParseFragmentFrame)
+	} else {
+		p.beginNative(htmlParseFrame)
+	}
+	return &HTMLParseProfile{Fragment: fragment, Bytes: size, Started: time.Now()}
+}
+
+func (p *Profile) endHTMLParse(r *HTMLParseProfile) {
+	r.Duration = time.Since(r.Started)
+	p.endNative()
+	p.mu.Lock()
+	p.parses = append(p.parses, r)
+	p.mu.Unlock()
+}
+
+// HTTPRequests returns the HTTP requests made while profiling.
+func (p *Profile) HTTPRequests() []*HTTPRequestProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*HTTPRequestProfile(nil), p.requests...)
+}
+
+// HTMLParses returns the HTML parsing calls made while profiling.
+func (p *Profile) HTMLParses() []*HTMLParseProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*HTMLParseProfile(nil), p.parses...)
+}
+
+func (p *Profile) functionProfile(id int) *FunctionProfile {
+	if id < 0 {
+		return &FunctionProfile{Name: p.natives[-id-1], Native: true}
+	}
+	fp := &FunctionProfile{Name: "(anonymous)"}
+	if fn := p.in.function(id); fn != nil {
+		if fn.name != "" {
+			fp.Name = fn.name
+		}
+		fp.File = fn.file
+		fp.Line = fn.line
+	}
+	return fp
+}
+
+// Functions returns the functions which have been called or sampled
+// while profiling, sorted by decreasing flat time.
+func (p *Profile) Functions() []*FunctionProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	functions := make(map[int]*FunctionProfile)
+	get := func(id int) *FunctionProfile {
+		fp := functions[id]
+		if fp == nil {
+			fp = p.functionProfile(id)
+			functions[id] = fp
+		}
+		return fp
+	}
+	for id, calls := range p.calls {
+		get(id).Calls = calls
+	}
+	for _, s := range p.samples {
+		leaf := get(s.stack[len(s.stack)-1])
+		leaf.Samples += s.count
+		leaf.Flat += s.wall
+		// Don't count recursive calls multiple times
+		seen := make(map[int]bool)
+		for _, v := range s.stack {
+			if !seen[v] {
+				seen[v] = true
+				get(v).Cumulative += s.wall
+			}
+		}
+	}
+	list := make([]*FunctionProfile, 0, len(functions))
+	for _, v := range functions {
+		list = append(list, v)
+	}
+	sort.Sort(functionProfilesByTime(list))
+	return list
+}
+
+// WriteSummary writes a human readable summary of the profile.
+func (p *Profile) WriteSummary(w io.Writer) error {
+	total := p.Duration()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Profile duration: %s\n\n", total)
+	fmt.Fprintf(tw, "flat\tflat%%\tcum\tcum%%\tcalls\t  function\n")
+	percent := func(d time.Duration) string {
+		if total <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(d)/float64(total))
+	}
+	for _, v := range p.Functions() {
+		name := v.Name
+		if v.File != "" {
+			name = fmt.Sprintf("%s (%s:%d)", v.Name, v.File, v.Line)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t  %s\n", roundDuration(v.Flat), percent(v.Flat),
+			roundDuration(v.Cumulative), percent(v.Cumulative), v.Calls, name)
+	}
+	if requests := p.HTTPRequests(); len(requests) > 0 {
+		fmt.Fprintf(tw, "\nHTTP requests: %d\n", len(requests))
+		fmt.Fprintf(tw, "duration\tstatus\tbytes\tcache\t  request\n")
+		for _, v := range requests {
+			status := strconv.Itoa(v.StatusCode)
+			if v.Error != "" {
+				status = "error"
+			}
+			cache := "miss"
+			if v.Cached {
+				cache = "hit"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t  %s %s\n", roundDuration(v.Duration), status, v.Bytes, cache, v.Method, v.URL)
+		}
+	}
+	if parses := p.HTMLParses(); len(parses) > 0 {
+		var d time.Duration
+		size := 0
+		for _, v := range parses {
+			d += v.Duration
+			size += v.Bytes
+		}
+		fmt.Fprintf(tw, "\nHTML parsing: %d calls, %d bytes, %s\n", len(parses), size, roundDuration(d))
+	}
+	return tw.Flush()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d > time.Millisecond {
+		return d / (10 * time.Microsecond) * (10 * time.Microsecond)
+	}
+	return d
+}
+
+type functionProfilesByTime []*FunctionProfile
+
+func (f functionProfilesByTime) Len() int      { return len(f) }
+func (f functionProfilesByTime) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f functionProfilesByTime) Less(i, j int) bool {
+	if f[i].Flat != f[j].Flat {
+		return f[i].Flat > f[j].Flat
+	}
+	if f[i].Cumulative != f[j].Cumulative {
+		return f[i].Cumulative > f[j].Cumulative
+	}
+	return strings.ToLower(f[i].Name) < strings.ToLower(f[j].Name)
+}
@@ -0,0 +1,63 @@
+package macaco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	ctx := newTestingContext(t)
+	p := ctx.StartProfile()
+	if err := ctx.LoadScript("profile.js", `function busy(ms) {
+    var end = Date.now() + ms;
+    while (Date.now() < end) {}
+    return M.html.parse('<p>hello</p>');
+}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Call("busy", nil, 50); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	var busy *FunctionProfile
+	for _, v := range p.Functions() {
+		if v.Name == "busy" {
+			busy = v
+		}
+	}
+	if busy == nil {
+		t.Fatalf("function busy not found in profile")
+	}
+	if busy.Calls != 1 || busy.Line != 1 || busy.Flat < 10*time.Millisecond {
+		t.Errorf("unexpected profile for busy %+v", busy)
+	}
+	if parses := p.HTMLParses(); len(parses) != 1 || parses[0].Bytes != 12 {
+		t.Errorf("expecting 1 HTML parse of 12 bytes, got %v", parses)
+	}
+	var summary bytes.Buffer
+	if err := p.WriteSummary(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(summary.String(), "busy (profile.js:1)") {
+		t.Errorf("summary does not include busy:\n%s", summary.String())
+	}
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("profile.js")) {
+		t.Error("pprof profile does not include profile.js")
+	}
+}
@@ -0,0 +1,159 @@
+package macaco
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Registry is an http.Handler which implements the program API
+// provided by macaco.io (/upload and /load), storing the programs
+// in a local directory. It can be used to self-host a program registry
+// or to test program uploading and loading without network access.
+// To make Macaco use it, set the MACACO_API environment variable to the
+// URL where the Registry is being served.
+type Registry struct {
+	// Dir is the directory where uploaded programs are stored.
+	Dir string
+	// Tokens maps access tokens to user names. Uploading requires
+	// a valid token, while loading requires it only when the program
+	// name does not include the user.
+	Tokens map[string]string
+	mu     sync.RWMutex
+}
+
+// NewRegistry returns a new Registry which stores its programs in dir and
+// authenticates users with the given tokens (token => user name).
+func NewRegistry(dir string, tokens map[string]string) *Registry {
+	return &Registry{Dir: dir, Tokens: tokens}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch path.Base(req.URL.Path) {
+	case "upload":
+		if req.Method != "POST" && req.Method != "PUT" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.upload(w, req)
+	case "load":
+		r.load(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) user(req *http.Request) string {
+	if tok := req.FormValue("access_token"); tok != "" {
+		return r.Tokens[tok]
+	}
+	return ""
+}
+
+func (r *Registry) programPath(userName string, programName string) string {
+	return filepath.Join(r.Dir, userName, programName+".zip")
+}
+
+func (r *Registry) upload(w http.ResponseWriter, req *http.Request) {
+	userName := r.user(req)
+	if userName == "" {
+		http.Error(w, "invalid access_token", http.StatusUnauthorized)
+		return
+	}
+	name := req.FormValue("name")
+	if !ProgramNameIsValid(name) {
+		http.Error(w, fmt.Sprintf("program name %q is not valid", name), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ValidateProgramZipData(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		http.Error(w, fmt.Sprintf("invalid zip data: %s", err), http.StatusBadRequest)
+		return
+	}
+	p := r.programPath(userName, name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Write to a temporary file and rename it, so programs
+	// being loaded never see a partial upload.
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *Registry) load(w http.ResponseWriter, req *http.Request) {
+	userName, programName, _ := SplitProgramName(req.FormValue("program"))
+	if userName == "" {
+		userName = r.user(req)
+		if userName == "" {
+			http.Error(w, "program has no user and access_token is missing or invalid", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !ProgramNameIsValid(programName) || strings.ContainsAny(userName, "/\\.") {
+		http.Error(w, "invalid program name", http.StatusBadRequest)
+		return
+	}
+	r.mu.RLock()
+	zr, err := zip.OpenReader(r.programPath(userName, programName))
+	r.mu.RUnlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("program %s/%s not found", userName, programName), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer zr.Close()
+	var buf bytes.Buffer
+	for _, f := range zr.File {
+		if strings.ToLower(path.Ext(f.Name)) != ".js" {
+			continue
+		}
+		if err := appendZipFile(&buf, f); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.WriteByte('\n')
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(buf.Bytes())
+}
+
+func appendZipFile(w io.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
@@ -0,0 +1,58 @@
+package macaco
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	const token = "secret"
+	dir, err := ioutil.TempDir("", "macaco-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(NewRegistry(filepath.Join(dir, "registry"), map[string]string{token: "alice"}))
+	defer srv.Close()
+	defer os.Setenv("MACACO_API", os.Getenv("MACACO_API"))
+	os.Setenv("MACACO_API", srv.URL)
+
+	prog := filepath.Join(dir, "prog")
+	if err := os.Mkdir(prog, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(prog, "main.js"), []byte("function answer() { return 42; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(&Options{Bare: true, Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Upload("answer", prog); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := New(&Options{Bare: true, Token: "not-" + token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.Upload("answer", prog); err == nil {
+		t.Error("expecting an error when uploading with an invalid token")
+	}
+	ctx := newTestingContext(t)
+	if err := ctx.Load("alice/answer"); err != nil {
+		t.Fatal(err)
+	}
+	val, err := ctx.Call("answer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := val.ToInteger(); n != 42 {
+		t.Errorf("expecting answer() = 42, got %v", val)
+	}
+	if err := newTestingContext(t).Load("alice/missing"); err == nil {
+		t.Error("expecting an error when loading a missing program")
+	}
+}
@@ -0,0 +1,208 @@
+package macaco
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// resizeFilter is a resampling kernel with the given support,
+// in source pixels when upscaling.
+type resizeFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+var resizeFilters = map[string]*resizeFilter{
+	// nearest has no kernel, it's handled separately
+	"nearest": {0, nil},
+	"linear": {1, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}},
+	// Catmull-Rom
+	"cubic": {2, func(x float64) float64 {
+		const a = -0.5
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return (a+2)*x*x*x - (a+3)*x*x + 1
+		case x < 2:
+			return a*x*x*x - 5*a*x*x + 8*a*x - 4*a
+		}
+		return 0
+	}},
+	// Lanczos with 3 lobes
+	"lanczos": {3, func(x float64) float64 {
+		if x > -3 && x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+		return 0
+	}},
+}
+
+// defaultResizeFilter is the filter used by the Resize method of
+// the images returned by M.image.decode when none is specified.
+const defaultResizeFilter = "linear"
+
+// toRGBA returns im as an *image.RGBA with its origin at (0, 0).
+func toRGBA(im image.Image) *image.RGBA {
+	b := im.Bounds()
+	if rgba, ok := im.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), im, b.Min, draw.Src)
+	return dst
+}
+
+// resizeWeights contains the source pixels and their
+// weights for every destination pixel along one axis.
+type resizeWeights struct {
+	first   []int
+	weights [][]float64
+}
+
+func newResizeWeights(dstSize int, srcSize int, f *resizeFilter) *resizeWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	// Widen the filter when downscaling, so all the
+	// source pixels contribute to the result
+	filterScale := math.Max(scale, 1)
+	radius := f.support * filterScale
+	rw := &resizeWeights{
+		first:   make([]int, dstSize),
+		weights: make([][]float64, dstSize),
+	}
+	for ii := 0; ii < dstSize; ii++ {
+		center := (float64(ii)+0.5)*scale - 0.5
+		left := int(math.Ceil(center - radius))
+		right := int(math.Floor(center + radius))
+		weights := make([]float64, 0, right-left+1)
+		var sum float64
+		for jj := left; jj <= right; jj++ {
+			w := f.kernel((float64(jj) - center) / filterScale)
+			weights = append(weights, w)
+			sum += w
+		}
+		if sum != 0 {
+			for jj := range weights {
+				weights[jj] /= sum
+			}
+		}
+		rw.first[ii] = left
+		rw.weights[ii] = weights
+	}
+	return rw
+}
+
+func clampIndex(idx int, size int) int {
+	if idx < 0 {
+		return 0
+	}
+	if idx >= size {
+		return size - 1
+	}
+	return idx
+}
+
+func clampByte(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// resizeImage returns im resized to width x height, using the given
+// filter. Pixels are filtered with premultiplied alpha.
+func resizeImage(im image.Image, width int, height int, filter string) (*image.RGBA, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid size %dx%d", width, height)
+	}
+	if err := checkImageSize(width, height); err != nil {
+		return nil, err
+	}
+	if filter == "" {
+		filter = defaultResizeFilter
+	}
+	f := resizeFilters[filter]
+	if f == nil {
+		return nil, fmt.Errorf("invalid resize filter %q", filter)
+	}
+	src := toRGBA(im)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if f.kernel != nil {
+		// The horizontal pass uses width x srcH pixels too
+		if err := checkImageSize(width, srcH); err != nil {
+			return nil, err
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if srcW == 0 || srcH == 0 {
+		return dst, nil
+	}
+	if f.kernel == nil {
+		for y := 0; y < height; y++ {
+			sy := (2*y + 1) * srcH / (2 * height)
+			for x := 0; x < width; x++ {
+				sx := (2*x + 1) * srcW / (2 * width)
+				copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+			}
+		}
+		return dst, nil
+	}
+	// Horizontal pass into tmp, with width x srcH
+	// pixels, then vertical pass into dst.
+	tmp := make([]float64, width*srcH*4)
+	hw := newResizeWeights(width, srcW, f)
+	for y := 0; y < srcH; y++ {
+		for x := 0; x < width; x++ {
+			var px [4]float64
+			for ii, w := range hw.weights[x] {
+				off := src.PixOffset(clampIndex(hw.first[x]+ii, srcW), y)
+				for c := range px {
+					px[c] += w * float64(src.Pix[off+c])
+				}
+			}
+			copy(tmp[(y*width+x)*4:], px[:])
+		}
+	}
+	vw := newResizeWeights(height, srcH, f)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var px [4]float64
+			for ii, w := range vw.weights[y] {
+				off := (clampIndex(vw.first[y]+ii, srcH)*width + x) * 4
+				for c := range px {
+					px[c] += w * tmp[off+c]
+				}
+			}
+			off := dst.PixOffset(x, y)
+			alpha := clampByte(px[3])
+			dst.Pix[off+3] = alpha
+			for c := 0; c < 3; c++ {
+				// Keep the result premultiplied
+				if v := clampByte(px[c]); v < alpha {
+					dst.Pix[off+c] = v
+				} else {
+					dst.Pix[off+c] = alpha
+				}
+			}
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,333 @@
+package macaco
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sourceMappingURLRe = regexp.MustCompile(`(?m)^[ \t]*//[#@][ \t]*sourceMappingURL=(\S+)[ \t]*$`)
+)
+
+const base64VLQChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// mapping is a segment in a source map, all fields are 0-based.
+type mapping struct {
+	genColumn int
+	source    int
+	line      int
+	column    int
+}
+
+// sourceMap implements the decoding of version 3 source maps
+// (https://sourcemaps.info/spec.html).
+type sourceMap struct {
+	sources []string
+	// lines contains the mappings for each generated line,
+	// sorted by generated column.
+	lines [][]mapping
+}
+
+type sourceMapJSON struct {
+	Version    int      `json:"version"`
+	SourceRoot string   `json:"sourceRoot"`
+	Sources    []string `json:"sources"`
+	Mappings   string   `json:"mappings"`
+}
+
+func decodeVLQ(s string) (int, string, error) {
+	result := 0
+	shift := uint(0)
+	for ii := 0; ii < len(s); ii++ {
+		digit := strings.IndexByte(base64VLQChars, s[ii])
+		if digit < 0 {
+			return 0, "", fmt.Errorf("invalid VLQ character %q", s[ii])
+		}
+		result += (digit & 31) << shift
+		if digit&32 == 0 {
+			if result&1 != 0 {
+				return -(result >> 1), s[ii+1:], nil
+			}
+			return result >> 1, s[ii+1:], nil
+		}
+		shift += 5
+	}
+	return 0, "", errors.New("truncated VLQ value")
+}
+
+func parseSourceMap(data []byte) (*sourceMap, error) {
+	// Source maps might start with )]}' to prevent XSSI
+	if s := string(data); strings.HasPrefix(s, ")]}'") {
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+			data = data[nl+1:]
+		}
+	}
+	var js sourceMapJSON
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, err
+	}
+	if js.Version != 3 {
+		return nil, fmt.Errorf("unsupported source map version %d", js.Version)
+	}
+	sm := new(sourceMap)
+	for _, v := range js.Sources {
+		if js.SourceRoot != "" && !looksLikeURL(v) && !path.IsAbs(v) {
+			v = strings.TrimSuffix(js.SourceRoot, "/") + "/" + v
+		}
+		sm.sources = append(sm.sources, v)
+	}
+	var prev mapping
+	for _, line := range strings.Split(js.Mappings, ";") {
+		var segments []mapping
+		prev.genColumn = 0
+		for _, seg := range strings.Split(line, ",") {
+			if seg == "" {
+				continue
+			}
+			var fields [5]int
+			n := 0
+			for rem := seg; rem != ""; n++ {
+				if n == len(fields) {
+					return nil, fmt.Errorf("too many fields in segment %q", seg)
+				}
+				var err error
+				if fields[n], rem, err = decodeVLQ(rem); err != nil {
+					return nil, err
+				}
+			}
+			prev.genColumn += fields[0]
+			if n < 4 {
+				// Segment without source
+				continue
+			}
+			prev.source += fields[1]
+			prev.line += fields[2]
+			prev.column += fields[3]
+			// fields[4] is the name index, which is not used
+			segments = append(segments, prev)
+		}
+		sm.lines = append(sm.lines, segments)
+	}
+	return sm, nil
+}
+
+// lookup returns the original position for the given generated
+// line and column, both 1-based. Returned line and column are
+// also 1-based.
+func (sm *sourceMap) lookup(line int, column int) (source string, origLine int, origColumn int, ok bool) {
+	if line < 1 || line > len(sm.lines) {
+		return "", 0, 0, false
+	}
+	segments := sm.lines[line-1]
+	// Find the last segment starting at or before column
+	idx := sort.Search(len(segments), func(i int) bool { return segments[i].genColumn > column-1 }) - 1
+	if idx < 0 {
+		if len(segments) == 0 {
+			return "", 0, 0, false
+		}
+		idx = 0
+	}
+	m := segments[idx]
+	if m.source < 0 || m.source >= len(sm.sources) {
+		return "", 0, 0, false
+	}
+	return sm.sources[m.source], m.line + 1, m.column + 1, true
+}
+
+// sourceMaps stores the source maps by the file name used to
+// compile the script. Scripts compiled with names which are
+// not meant to be displayed, like the full URL of a remote script,
+// might also have a display name, used when their positions
+// aren't mapped. It's shared by all the copies of a Context.
+type sourceMaps struct {
+	sync.RWMutex
+	maps  map[string]*sourceMap
+	names map[string]string
+}
+
+func newSourceMaps() *sourceMaps {
+	return &sourceMaps{maps: make(map[string]*sourceMap), names: make(map[string]string)}
+}
+
+func (s *sourceMaps) set(filename string, sm *sourceMap) {
+	s.Lock()
+	if sm == nil {
+		delete(s.maps, filename)
+	} else {
+		s.maps[filename] = sm
+	}
+	s.Unlock()
+}
+
+func (s *sourceMaps) get(filename string) *sourceMap {
+	s.RLock()
+	sm := s.maps[filename]
+	s.RUnlock()
+	return sm
+}
+
+// setName sets the name displayed in errors for the
+// script compiled with the given filename.
+func (s *sourceMaps) setName(filename string, name string) {
+	s.Lock()
+	s.names[filename] = name
+	s.Unlock()
+}
+
+// position returns the original position for the given one,
+// or the same position with the display name of the file
+// if there's no source map for it.
+func (s *sourceMaps) position(file string, line int, column int) (string, int, int) {
+	if sm := s.get(file); sm != nil {
+		if src, l, c, ok := sm.lookup(line, column); ok {
+			return src, l, c
+		}
+	}
+	s.RLock()
+	name := s.names[file]
+	s.RUnlock()
+	if name != "" {
+		file = name
+	}
+	return file, line, column
+}
+
+// apply maps the positions in the error and its stack
+// frames back to the original sources.
+func (s *sourceMaps) apply(se *ScriptError) {
+	s.RLock()
+	empty := len(s.maps) == 0 && len(s.names) == 0
+	s.RUnlock()
+	if empty {
+		return
+	}
+	if se.File != "" {
+		se.File, se.Line, se.Column = s.position(se.File, se.Line, se.Column)
+	}
+	for _, v := range se.Stack {
+		if v.Native || v.File == "" {
+			continue
+		}
+		v.File, v.Line, v.Column = s.position(v.File, v.Line, v.Column)
+	}
+}
+
+// scriptError converts an error returned by otto into a *ScriptError,
+// mapping its positions using the loaded source maps.
+func (c *Context) scriptError(err error) *ScriptError {
+	se := newScriptError(err)
+	if c.instr != nil {
+		c.instr.apply(se)
+	}
+	c.sourceMaps.apply(se)
+	return se
+}
+
+func decodeDataURL(u string) ([]byte, error) {
+	comma := strings.IndexByte(u, ',')
+	if comma < 0 {
+		return nil, errors.New("invalid data URL")
+	}
+	meta, payload := u[len("data:"):comma], u[comma+1:]
+	if strings.HasSuffix(meta, ";base64") {
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			// Some tools omit the padding
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+		return data, err
+	}
+	s, err := url.QueryUnescape(payload)
+	return []byte(s), err
+}
+
+func (c *Context) fetchSourceMap(u string) ([]byte, error) {
+	if entry, err := c.cache.cachedEntry(u); err == nil && time.Now().Before(entry.Expires) {
+		return entry.Data, nil
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.Debugf("GET %s\n", u)
+	resp, err := c.doHTTPRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := validateHTTPResponse(resp); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cache.cacheData(u, data, resp); err != nil {
+		c.Debugf("error caching source map %s: %s\n", u, err)
+	}
+	return data, nil
+}
+
+// readSourceMap returns the source map referenced by the sourceMappingURL
+// comment in data, if any. Relative URLs are resolved against base, which
+// might be either a URL or a file path. If base is empty, only inline
+// source maps are supported.
+func (c *Context) readSourceMap(base string, data []byte) ([]byte, error) {
+	matches := sourceMappingURLRe.FindAllSubmatch(data, -1)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	ref := string(matches[len(matches)-1][1])
+	switch {
+	case strings.HasPrefix(ref, "data:"):
+		return decodeDataURL(ref)
+	case base == "":
+		return nil, fmt.Errorf("can't resolve source map %s without a base", ref)
+	case looksLikeURL(base) || looksLikeURL(ref):
+		b, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		r, err := url.Parse(ref)
+		if err != nil {
+			return nil, err
+		}
+		return c.fetchSourceMap(b.ResolveReference(r).String())
+	}
+	p := filepath.FromSlash(ref)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(base), p)
+	}
+	return ioutil.ReadFile(p)
+}
+
+// loadSourceMap registers the source map for the script compiled with
+// the given filename. Errors are not fatal, since the script can still
+// run without its source map.
+func (c *Context) loadSourceMap(filename string, base string, data []byte) {
+	smData, err := c.readSourceMap(base, data)
+	if err == nil && smData != nil {
+		var sm *sourceMap
+		if sm, err = parseSourceMap(smData); err == nil {
+			c.sourceMaps.set(filename, sm)
+			return
+		}
+	}
+	if err != nil {
+		c.Debugf("error loading source map for %s: %s\n", filename, err)
+	}
+	// Remove stale maps from previous versions of the script
+	c.sourceMaps.set(filename, nil)
+}
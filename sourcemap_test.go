@@ -0,0 +1,74 @@
+package macaco
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSourceMap(t *testing.T) {
+	// Maps generated column 0 to src.js:10:1 and column
+	// 10 to src.js:10:3
+	const sm = `{"version":3,"sources":["src.js"],"names":[],"mappings":"AASA,UAAE"}`
+	script := "function a() { throw new Error('x'); }\n//# sourceMappingURL=data:application/json;base64," +
+		base64.StdEncoding.EncodeToString([]byte(sm))
+	ctx := newTestingContext(t)
+	if err := ctx.LoadScript("min.js", script); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ctx.Call("a", nil)
+	se, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+	}
+	if se.File != "src.js" || se.Line != 10 || se.Column != 3 {
+		t.Errorf("expecting error at src.js:10:3, got %s:%d:%d", se.File, se.Line, se.Column)
+	}
+	if len(se.Stack) == 0 || se.Stack[0].File != "src.js" {
+		t.Errorf("expecting mapped stack frame, got %s", se.String())
+	}
+}
+
+func TestSourceMapSameBaseName(t *testing.T) {
+	ctx := newTestingContext(t)
+	// Both scripts are named index.js, but map to different sources
+	for _, v := range []string{"a", "b"} {
+		sm := `{"version":3,"sources":["` + v + `.js"],"names":[],"mappings":"AASA,UAAE"}`
+		script := "function " + v + "() { throw new Error('x'); }\n//# sourceMappingURL=data:application/json;base64," +
+			base64.StdEncoding.EncodeToString([]byte(sm))
+		if err := ctx.loadData("http://example.com/"+v+"/index.js", []byte(script), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctx.loadData("http://example.com/c/index.js", []byte("function c() { throw new Error('x'); }"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := ctx.Call(v, nil)
+		se, ok := err.(*ScriptError)
+		if !ok {
+			t.Fatalf("expecting *ScriptError, got %T (%v)", err, err)
+		}
+		expected := v + ".js"
+		if v == "c" {
+			// No source map, the base name is displayed
+			expected = "index.js"
+		}
+		if se.File != expected {
+			t.Errorf("expecting error in %s, got %s", expected, se.File)
+		}
+	}
+}
+
+func TestDecodeVLQ(t *testing.T) {
+	cases := map[string]int{"A": 0, "C": 1, "D": -1, "S": 9, "gB": 16, "hB": -16, "2H": 123}
+	for k, v := range cases {
+		n, rem, err := decodeVLQ(k)
+		if err != nil {
+			t.Errorf("error decoding %q: %s", k, err)
+			continue
+		}
+		if n != v || rem != "" {
+			t.Errorf("expecting %q = %d, got %d (remaining %q)", k, v, n, rem)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package macaco
+
+import (
+	"github.com/rainycape/otto"
+)
+
+const (
+	eachHelperFile = "<each>"
+	// eachHelperSrc returns a function which creates a reader by calling
+	// the given function with all its arguments but the last one, which
+	// must be a callback. The callback is then called with every value
+	// returned by the reader next() method and its index until it returns
+	// undefined or the callback returns false.
+	eachHelperSrc = `(function(reader) {
+	return function() {
+		var args = Array.prototype.slice.call(arguments);
+		var fn = args.pop();
+		if (typeof fn !== 'function') {
+			throw __macaco_error('M.Error', 'the last argument must be a function', 0, 'TypeError');
+		}
+		var r = reader.apply(this, args);
+		for (var ii = 0, v; (v = r.next()) !== undefined; ii++) {
+			if (fn(v, ii) === false) {
+				break;
+			}
+		}
+	};
+})`
+)
+
+// newReader returns a JS object with a next() method which calls
+// next. When next returns an error, a SyntaxError is thrown. Readers
+// must return undefined when there are no more values.
+func (c *Context) newReader(next func() (otto.Value, error)) otto.Value {
+	obj, err := c.vm.Object("({})")
+	if err != nil {
+		panic(err)
+	}
+	obj.Set("next", c.throwingFunc("SyntaxError", func(call otto.FunctionCall) (otto.Value, error) {
+		return next()
+	}))
+	return obj.Value()
+}
+
+// eachFunc returns a function which iterates over the values of the
+// readers returned by reader, see eachHelperSrc.
+func (c *Context) eachFunc(reader otto.Value) otto.Value {
+	script, err := c.vm.Compile(eachHelperFile, eachHelperSrc)
+	if err != nil {
+		panic(err)
+	}
+	fn, err := c.vm.Run(script)
+	if err != nil {
+		panic(err)
+	}
+	each, err := fn.Call(otto.UndefinedValue(), reader)
+	if err != nil {
+		panic(err)
+	}
+	return each
+}
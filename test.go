@@ -2,6 +2,7 @@ package macaco
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -30,10 +31,24 @@ func (t *testStderrWriter) String() string {
 }
 
 type TestError struct {
-	Message   string
+	Message string
+	// File, Line and Column indicate where the error was thrown.
+	// They're empty for errors written to stderr.
+	File      string
+	Line      int
+	Column    int
 	Timestamp time.Time
 }
 
+// Location returns the position where the error was thrown
+// as file:line:column, or an empty string if it's unknown.
+func (e *TestError) Location() string {
+	if e.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+}
+
 type Test struct {
 	Name     string
 	Started  time.Time
@@ -0,0 +1,191 @@
+package macaco
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	// TokenEnvVar is the environment variable which is used
+	// as the token when none is provided in Options.
+	TokenEnvVar = "MACACO_TOKEN"
+	// defaultTokenKey is the reserved entry in the tokens file
+	// which names the token used by default.
+	defaultTokenKey = "default"
+)
+
+// Tokens represents the named tokens stored in ~/.macaco/tokens. Each
+// line in the file has the form name=token. Empty lines and lines starting
+// with # are ignored. The special entry default=name indicates the
+// token which is used when no token is specified.
+type Tokens struct {
+	// Default is the name of the default token.
+	Default string
+	tokens  map[string]string
+}
+
+func tokensPath() (string, error) {
+	dir, err := macacoDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tokens"), nil
+}
+
+// LoadTokens reads the tokens file. If the file does not exist, an empty
+// Tokens is returned. Since the file contains credentials, an error is
+// returned if it's readable or writable by other users.
+func LoadTokens() (*Tokens, error) {
+	t := &Tokens{tokens: make(map[string]string)}
+	p, err := tokensPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if runtime.GOOS != "windows" {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if perm := st.Mode().Perm(); perm&0077 != 0 {
+			return nil, fmt.Errorf("tokens file %s has insecure permissions %#o, run chmod 600 %s", p, perm, p)
+		}
+	}
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		sep := strings.IndexByte(line, '=')
+		if sep < 0 {
+			// Skip malformed lines rather than ignoring
+			// the rest of the file.
+			continue
+		}
+		name := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+		if name == defaultTokenKey {
+			t.Default = value
+		} else {
+			t.tokens[name] = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Get returns the token with the given name.
+func (t *Tokens) Get(name string) (string, bool) {
+	tok, ok := t.tokens[name]
+	return tok, ok
+}
+
+// Set adds or replaces the token with the given name.
+func (t *Tokens) Set(name string, token string) error {
+	if name == "" || name == defaultTokenKey || strings.ContainsAny(name, "=#\n") || strings.TrimSpace(name) != name {
+		return fmt.Errorf("invalid token name %q", name)
+	}
+	if token == "" || strings.ContainsAny(token, "\r\n") {
+		return fmt.Errorf("invalid token %q", token)
+	}
+	t.tokens[name] = token
+	return nil
+}
+
+// Remove removes the token with the given name, returning
+// whether it existed. If the token was the default one, the
+// default is cleared.
+func (t *Tokens) Remove(name string) bool {
+	if _, ok := t.tokens[name]; !ok {
+		return false
+	}
+	delete(t.tokens, name)
+	if t.Default == name {
+		t.Default = ""
+	}
+	return true
+}
+
+// Names returns the sorted token names.
+func (t *Tokens) Names() []string {
+	names := make([]string, 0, len(t.tokens))
+	for k := range t.tokens {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand returns the token named by tok. If tok is empty, the
+// MACACO_TOKEN environment variable is used and, if that's empty too,
+// the default token. Values which don't name a token are returned
+// as is, since they're assumed to be tokens themselves.
+func (t *Tokens) Expand(tok string) string {
+	if tok == "" {
+		tok = os.Getenv(TokenEnvVar)
+	}
+	if tok == "" {
+		tok = t.Default
+	}
+	if v, ok := t.tokens[tok]; ok {
+		return v
+	}
+	return tok
+}
+
+// Save writes the tokens to the tokens file, making it
+// readable only by the current user.
+func (t *Tokens) Save() error {
+	p, err := tokensPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if t.Default != "" {
+		fmt.Fprintf(&buf, "%s=%s\n", defaultTokenKey, t.Default)
+	}
+	for _, k := range t.Names() {
+		fmt.Fprintf(&buf, "%s=%s\n", k, t.tokens[k])
+	}
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the permissions of existing files
+	return os.Chmod(p, 0600)
+}
+
+// expandToken returns the token to use for tok, see Tokens.Expand.
+// Unlike the tokens commands, which report any problems with the
+// tokens file, errors loading it are only logged and tok is used as
+// is, since programs embedding macaco might not use the file at all.
+func expandToken(c *Context, tok string) string {
+	tokens, err := LoadTokens()
+	if err != nil {
+		if tok == "" {
+			tok = os.Getenv(TokenEnvVar)
+		}
+		c.Debugf("error loading tokens, using the token as is: %s\n", err)
+		return tok
+	}
+	return tokens.Expand(tok)
+}
@@ -0,0 +1,41 @@
+package macaco
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTokensExpand(t *testing.T) {
+	defer os.Setenv(TokenEnvVar, os.Getenv(TokenEnvVar))
+	os.Setenv(TokenEnvVar, "")
+	tokens := &Tokens{tokens: make(map[string]string)}
+	if err := tokens.Set("work", "w0rk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Set("home", "h0me"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Set(defaultTokenKey, "x"); err == nil {
+		t.Errorf("expecting an error when setting a token named %q", defaultTokenKey)
+	}
+	tokens.Default = "home"
+	cases := []struct {
+		env, tok, expect string
+	}{
+		{"", "", "h0me"},
+		{"", "work", "w0rk"},
+		{"", "raw-token", "raw-token"},
+		{"work", "", "w0rk"},
+		{"from-env", "", "from-env"},
+		{"from-env", "home", "h0me"},
+	}
+	for _, v := range cases {
+		os.Setenv(TokenEnvVar, v.env)
+		if res := tokens.Expand(v.tok); res != v.expect {
+			t.Errorf("expecting Expand(%q) with %s=%q = %q, got %q", v.tok, TokenEnvVar, v.env, v.expect, res)
+		}
+	}
+	if !tokens.Remove("home") || tokens.Default != "" {
+		t.Error("removing the default token should clear the default")
+	}
+}
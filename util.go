@@ -2,6 +2,7 @@ package macaco
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"os/user"
 	"path"
@@ -32,12 +33,81 @@ func SplitProgramName(fullName string) (userName string, programName string, ver
 	return
 }
 
-func ListProgramFiles(path string) ([]string, error) {
+// IgnoreFile is the name of the file which lists, one per line, the
+// patterns (as in filepath.Match) for files and directories which should
+// be ignored by ListProgramFiles. Patterns are matched against both the
+// path relative to the program root and the file name. Patterns ending
+// with / only match directories. Lines starting with # are ignored.
+const IgnoreFile = ".macacoignore"
+
+func readIgnorePatterns(root string) ([]string, error) {
+	f, err := os.Open(filepath.Join(root, IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %s", line, IgnoreFile, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, s.Err()
+}
+
+func isIgnored(patterns []string, rel string, isDir bool) bool {
+	base := path.Base(rel)
+	for _, v := range patterns {
+		if strings.HasSuffix(v, "/") {
+			if !isDir {
+				continue
+			}
+			v = v[:len(v)-1]
+		}
+		if m, _ := path.Match(v, rel); m {
+			return true
+		}
+		if m, _ := path.Match(v, base); m {
+			return true
+		}
+	}
+	return false
+}
+
+func ListProgramFiles(root string) ([]string, error) {
 	var names []string
-	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	// Single file programs have no ignore file
+	if st.IsDir() {
+		if patterns, err = readIgnorePatterns(root); err != nil {
+			return nil, err
+		}
+	}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if len(patterns) > 0 && p != root {
+			if rel, err := filepath.Rel(root, p); err == nil && isIgnored(patterns, filepath.ToSlash(rel), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 		if !info.IsDir() && strings.ToLower(filepath.Ext(p)) == ".js" {
 			names = append(names, p)
 		}
@@ -61,30 +131,3 @@ func macacoDir() (string, error) {
 	}
 	return filepath.Join(usr.HomeDir, ".macaco"), nil
 }
-
-func expandToken(tok string) string {
-	if tok != "" {
-		if dir, _ := macacoDir(); dir != "" {
-			tokensFile := filepath.Join(dir, "tokens")
-			if f, err := os.Open(tokensFile); err == nil {
-				defer f.Close()
-				r := bufio.NewReader(f)
-				for {
-					line, err := r.ReadString('\n')
-					if err != nil {
-						break
-					}
-					fields := strings.Split(line, "=")
-					if len(fields) < 2 {
-						break
-					}
-					if strings.TrimSpace(fields[0]) == tok {
-						tok = strings.TrimSpace(fields[1])
-						break
-					}
-				}
-			}
-		}
-	}
-	return tok
-}
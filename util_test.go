@@ -0,0 +1,68 @@
+package macaco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListProgramFilesIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macaco-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		IgnoreFile:                "# comment\nvendor/\n*.min.js\n",
+		"main.js":                 "",
+		"lib.min.js":              "",
+		"lib/util.js":             "",
+		"lib/util.min.js":         "",
+		"vendor/jquery.js":        "",
+		"lib/vendor.js/nested.js": "",
+	}
+	for k, v := range files {
+		p := filepath.Join(dir, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := ListProgramFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii, v := range names {
+		names[ii], _ = filepath.Rel(dir, v)
+		names[ii] = filepath.ToSlash(names[ii])
+	}
+	expect := []string{"lib/util.js", "lib/vendor.js/nested.js", "main.js"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("expecting files %v, got %v", expect, names)
+	}
+}
+
+func TestListProgramFilesSingle(t *testing.T) {
+	f, err := ioutil.TempFile("", "macaco-single")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	p := f.Name() + ".js"
+	if err := os.Rename(f.Name(), p); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(p)
+	names, err := ListProgramFiles(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{p}; !reflect.DeepEqual(names, expect) {
+		t.Errorf("expecting files %v, got %v", expect, names)
+	}
+}
@@ -2,16 +2,20 @@ package macaco
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rainycape/otto"
 )
 
 type Value struct {
 	val otto.Value
-	vm  *otto.Otto
+	ctx *Context
 }
 
 func (v *Value) IsBoolean() bool {
@@ -127,28 +131,32 @@ func (v *Value) Get(name string) (*Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &Value{val, v.vm}, nil
+		return &Value{val, v.ctx}, nil
 	}
 	return nil, fmt.Errorf("value %v is not an object", v)
 }
 
 func (v *Value) Set(name string, value interface{}) error {
 	if v.IsObject() {
-		return v.val.Object().Set(name, value)
+		val, err := v.ctx.ottoValue(value)
+		if err != nil {
+			return err
+		}
+		return v.val.Object().Set(name, val)
 	}
 	return fmt.Errorf("value %v is not an object", v)
 }
 
 func (v *Value) prepareArguments(this interface{}, args []interface{}) (otto.Value, []interface{}, error) {
-	thisValue, err := v.vm.ToValue(this)
+	thisValue, err := v.ctx.ottoValue(this)
 	if err != nil {
 		return otto.Value{}, nil, err
 	}
 	var argValues []interface{}
 	if len(args) > 0 {
-		argValues := make([]interface{}, len(args))
+		argValues = make([]interface{}, len(args))
 		for ii, item := range args {
-			v, err := v.vm.ToValue(item)
+			v, err := v.ctx.ottoValue(item)
 			if err != nil {
 				return otto.Value{}, nil, err
 			}
@@ -164,11 +172,11 @@ func (v *Value) Call(this interface{}, args ...interface{}) (*Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		val, err := v.val.Call(thisValue, argValues...)
+		val, err := v.ctx.callFunction(v.val, thisValue, argValues)
 		if err != nil {
 			return nil, err
 		}
-		return &Value{val, v.vm}, nil
+		return &Value{val, v.ctx}, nil
 	}
 	return nil, fmt.Errorf("value %v is not a function", v)
 }
@@ -179,11 +187,18 @@ func (v *Value) Method(name string, args ...interface{}) (*Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		val, err := v.val.Object().Call(name, argValues...)
+		fn, err := v.val.Object().Get(name)
 		if err != nil {
 			return nil, err
 		}
-		return &Value{val, v.vm}, nil
+		if !fn.IsFunction() {
+			return nil, fmt.Errorf("method %s is not a function", name)
+		}
+		val, err := v.ctx.callFunction(fn, v.val, argValues)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{val, v.ctx}, nil
 	}
 	return nil, fmt.Errorf("value %v is not an object", v)
 }
@@ -200,7 +215,210 @@ type valueSetter interface {
 	SetMacacoValue(*Value)
 }
 
+var timeType = reflect.TypeOf(time.Time{})
+
+// structField is an exported struct field, including the ones
+// promoted from embedded structs.
+type structField struct {
+	name string
+	// tagged is true when name was set by a macaco or json tag.
+	// Otherwise, the lowercased name is also accepted.
+	tagged    bool
+	omitEmpty bool
+	index     []int
+}
+
+var structFieldsCache struct {
+	sync.RWMutex
+	fields map[reflect.Type][]*structField
+}
+
+// parseFieldTag returns the name and the options from the macaco
+// struct tag, falling back to the json one. A name of "-" indicates
+// that the field should be ignored.
+func parseFieldTag(tag reflect.StructTag) (string, []string) {
+	value := tag.Get("macaco")
+	if value == "" {
+		value = tag.Get("json")
+	}
+	if value == "" {
+		return "", nil
+	}
+	parts := strings.Split(value, ",")
+	return parts[0], parts[1:]
+}
+
+func isEmbeddedStruct(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.Kind() == reflect.Struct && typ != timeType
+}
+
+// structFields returns the fields of the given struct type. Fields of
+// embedded structs without a tag name are promoted, unless they're
+// shadowed by a field with the same name in the outer struct.
+func structFields(typ reflect.Type) []*structField {
+	structFieldsCache.RLock()
+	fields, ok := structFieldsCache.fields[typ]
+	structFieldsCache.RUnlock()
+	if ok {
+		return fields
+	}
+	seen := make(map[string]bool)
+	var embedded []int
+	for ii := 0; ii < typ.NumField(); ii++ {
+		sf := typ.Field(ii)
+		name, opts := parseFieldTag(sf.Tag)
+		if name == "-" && len(opts) == 0 {
+			continue
+		}
+		if sf.Anonymous && name == "" && isEmbeddedStruct(sf.Type) {
+			// Pointers to unexported types can't be allocated
+			if sf.PkgPath == "" || sf.Type.Kind() != reflect.Ptr {
+				embedded = append(embedded, ii)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		f := &structField{name: name, tagged: name != "", index: []int{ii}}
+		if !f.tagged {
+			f.name = sf.Name
+		}
+		for _, v := range opts {
+			if v == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		fields = append(fields, f)
+		seen[f.name] = true
+	}
+	for _, ii := range embedded {
+		ftyp := typ.Field(ii).Type
+		if ftyp.Kind() == reflect.Ptr {
+			ftyp = ftyp.Elem()
+		}
+		for _, v := range structFields(ftyp) {
+			if seen[v.name] {
+				continue
+			}
+			f := *v
+			f.index = append([]int{ii}, v.index...)
+			fields = append(fields, &f)
+			seen[f.name] = true
+		}
+	}
+	// Keep the declaration order, with the promoted
+	// fields in the position of their embedded struct
+	sort.Sort(byFieldIndex(fields))
+	structFieldsCache.Lock()
+	if structFieldsCache.fields == nil {
+		structFieldsCache.fields = make(map[reflect.Type][]*structField)
+	}
+	structFieldsCache.fields[typ] = fields
+	structFieldsCache.Unlock()
+	return fields
+}
+
+type byFieldIndex []*structField
+
+func (b byFieldIndex) Len() int      { return len(b) }
+func (b byFieldIndex) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byFieldIndex) Less(i, j int) bool {
+	x, y := b[i].index, b[j].index
+	for ii := 0; ii < len(x) && ii < len(y); ii++ {
+		if x[ii] != y[ii] {
+			return x[ii] < y[ii]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but it allocates
+// the nil pointers to embedded structs.
+func fieldByIndex(val reflect.Value, index []int) reflect.Value {
+	for ii, idx := range index {
+		if ii > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		val = val.Field(idx)
+	}
+	return val
+}
+
+// exportNumber returns jsVal as a number, failing if it's not a valid one.
+func exportNumber(jsVal otto.Value, typ reflect.Type) (float64, error) {
+	f, err := jsVal.ToFloat()
+	if err != nil {
+		return 0, fmt.Errorf("error converting to %s: %s", typ, err)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("can't convert %s to %s", jsVal, typ)
+	}
+	return f, nil
+}
+
+// exportInteger returns jsVal as an integer, failing if it has a
+// fractional part or it can't be represented by typ.
+func exportInteger(jsVal otto.Value, typ reflect.Type) (float64, error) {
+	f, err := exportNumber(jsVal, typ)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("can't convert non-integer %s to %s", jsVal, typ)
+	}
+	return f, nil
+}
+
+// exportTime converts a JS Date, a number of milliseconds since
+// the epoch or an RFC 3339 string to a time.Time. Since Dates have
+// no time zone, they're returned in UTC.
+func exportTime(jsVal otto.Value) (time.Time, error) {
+	switch {
+	case jsVal.IsObject() && jsVal.Class() == "Date":
+		ms, err := jsVal.Object().Call("getTime")
+		if err != nil {
+			return time.Time{}, err
+		}
+		jsVal = ms
+	case jsVal.IsString():
+		t, err := time.Parse(time.RFC3339Nano, jsVal.String())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("can't convert %q to time: %s", jsVal.String(), err)
+		}
+		return t, nil
+	case !jsVal.IsNumber():
+		return time.Time{}, fmt.Errorf("can't convert %s to time", jsVal)
+	}
+	ms, err := exportNumber(jsVal, timeType)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(ms*float64(time.Millisecond))).UTC(), nil
+}
+
+// exportInto sets val to jsVal. Undefined values leave val untouched,
+// while null values set pointers, slices, maps and interfaces to nil.
 func (v *Value) exportInto(val reflect.Value, jsVal otto.Value) error {
+	if jsVal.IsUndefined() {
+		return nil
+	}
+	if jsVal.IsNull() {
+		switch val.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			if val.CanSet() {
+				val.Set(reflect.Zero(val.Type()))
+			}
+		}
+		return nil
+	}
+	typ := val.Type()
 	switch val.Kind() {
 	case reflect.Bool:
 		vv, err := jsVal.ToBoolean()
@@ -209,61 +427,122 @@ func (v *Value) exportInto(val reflect.Value, jsVal otto.Value) error {
 		}
 		val.SetBool(vv)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		vv, err := jsVal.ToInteger()
+		f, err := exportInteger(jsVal, typ)
 		if err != nil {
-			return fmt.Errorf("error converting to integer: %s", err)
+			return err
+		}
+		// float64(math.MaxInt64) rounds up to 1<<63
+		if f < math.MinInt64 || f >= math.MaxInt64 || val.OverflowInt(int64(f)) {
+			return fmt.Errorf("%s overflows %s", jsVal, typ)
 		}
-		val.SetInt(vv)
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		vv, err := jsVal.ToInteger()
+		val.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f, err := exportInteger(jsVal, typ)
 		if err != nil {
-			return fmt.Errorf("error converting to integer: %s", err)
+			return err
 		}
-		val.SetUint(uint64(vv))
+		if f < 0 || f >= math.MaxUint64 || val.OverflowUint(uint64(f)) {
+			return fmt.Errorf("%s overflows %s", jsVal, typ)
+		}
+		val.SetUint(uint64(f))
 	case reflect.Float32, reflect.Float64:
 		vv, err := jsVal.ToFloat()
 		if err != nil {
 			return fmt.Errorf("error converting to float: %s", err)
 		}
+		if !math.IsInf(vv, 0) && val.OverflowFloat(vv) {
+			return fmt.Errorf("%s overflows %s", jsVal, typ)
+		}
 		val.SetFloat(vv)
 	case reflect.String:
-		if !jsVal.IsUndefined() && !jsVal.IsNull() {
-			vv, err := jsVal.ToString()
+		vv, err := jsVal.ToString()
+		if err != nil {
+			return fmt.Errorf("error converting to string: %s", err)
+		}
+		val.SetString(vv)
+	case reflect.Interface:
+		iface, err := jsVal.Export()
+		if err != nil {
+			return err
+		}
+		ival := reflect.ValueOf(iface)
+		if !ival.IsValid() {
+			val.Set(reflect.Zero(typ))
+			break
+		}
+		if !ival.Type().AssignableTo(typ) {
+			return fmt.Errorf("can't export %s into %s", ival.Type(), typ)
+		}
+		val.Set(ival)
+	case reflect.Struct:
+		if typ == timeType {
+			t, err := exportTime(jsVal)
 			if err != nil {
-				return fmt.Errorf("error converting to string: %s", err)
+				return err
 			}
-			val.SetString(vv)
-		} else {
-			val.SetString("")
+			val.Set(reflect.ValueOf(t))
+			break
 		}
-	case reflect.Struct:
 		if !jsVal.IsObject() {
 			return fmt.Errorf("can't export struct %T into non-object %+v", val.Interface(), jsVal)
 		}
 		obj := jsVal.Object()
-		typ := val.Type()
-		n := typ.NumField()
-		for ii := 0; ii < n; ii++ {
-			structField := typ.Field(ii)
-			if structField.PkgPath != "" {
+		for _, f := range structFields(typ) {
+			field, err := obj.Get(f.name)
+			if err == nil && field.IsUndefined() && !f.tagged {
+				field, err = obj.Get(strings.ToLower(f.name))
+			}
+			if err != nil {
+				return err
+			}
+			if field.IsUndefined() {
 				continue
 			}
-			field, err := obj.Get(structField.Name)
-			if err != nil || field.IsUndefined() {
-				field, err = obj.Get(strings.ToLower(structField.Name))
+			if err := v.exportInto(fieldByIndex(val, f.index), field); err != nil {
+				return fmt.Errorf("field %s: %s", f.name, err)
 			}
-			fieldVal := val.Field(ii)
-			if err := v.exportInto(fieldVal, field); err != nil {
+		}
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return fmt.Errorf("can't export into %s, map keys must be strings", typ)
+		}
+		if !jsVal.IsObject() {
+			return fmt.Errorf("can't export %+v into map", jsVal)
+		}
+		obj := jsVal.Object()
+		if val.IsNil() {
+			val.Set(reflect.MakeMap(typ))
+		}
+		for _, k := range obj.Keys() {
+			elem, err := obj.Get(k)
+			if err != nil {
 				return err
 			}
+			elemVal := reflect.New(typ.Elem()).Elem()
+			if err := v.exportInto(elemVal, elem); err != nil {
+				return fmt.Errorf("key %s: %s", k, err)
+			}
+			val.SetMapIndex(reflect.ValueOf(k).Convert(typ.Key()), elemVal)
+		}
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 && jsVal.IsString() {
+			// Binary string, as returned by ToValue
+			val.SetBytes([]byte(jsVal.String()))
+			break
 		}
-	case reflect.Slice:
 		if !jsVal.IsArray() {
-			return fmt.Errorf("can't export %+v into slice", jsVal)
+			return fmt.Errorf("can't export %+v into %s", jsVal, typ)
 		}
 		obj := jsVal.Object()
 		length := jsVal.Length()
-		val.Set(reflect.MakeSlice(val.Type(), length, length))
+		if val.Kind() == reflect.Slice {
+			val.Set(reflect.MakeSlice(typ, length, length))
+		} else {
+			if length > val.Len() {
+				return fmt.Errorf("can't export array of length %d into %s", length, typ)
+			}
+			val.Set(reflect.Zero(typ))
+		}
 		for ii := 0; ii < length; ii++ {
 			elemVal := val.Index(ii)
 			if elemVal.Kind() == reflect.Ptr && elemVal.IsNil() {
@@ -274,17 +553,17 @@ func (v *Value) exportInto(val reflect.Value, jsVal otto.Value) error {
 				return err
 			}
 			if err := v.exportInto(elemVal, elem); err != nil {
-				return err
+				return fmt.Errorf("index %d: %s", ii, err)
 			}
 		}
 	case reflect.Ptr:
 		if val.IsNil() {
-			val.Set(reflect.New(val.Type().Elem()))
+			val.Set(reflect.New(typ.Elem()))
 		}
 		err := v.exportInto(val.Elem(), jsVal)
 		if err == nil {
 			if setter, ok := val.Interface().(valueSetter); ok {
-				setter.SetMacacoValue(&Value{jsVal, v.vm})
+				setter.SetMacacoValue(&Value{jsVal, v.ctx})
 			}
 		}
 		return err
@@ -294,6 +573,14 @@ func (v *Value) exportInto(val reflect.Value, jsVal otto.Value) error {
 	return nil
 }
 
+// Export stores the value in the Go value pointed by out. Struct fields
+// are matched by their macaco tag, falling back to the json one, or by
+// their name, either as is or lowercased. Fields promoted from embedded
+// structs are also set. Maps must have string keys, time.Time accepts
+// JS Dates, milliseconds since the epoch and RFC 3339 strings, []byte
+// accepts both arrays of numbers and binary strings, and numbers which
+// can't be represented by the destination type (e.g. 1.5 for an int)
+// return an error.
 func (v *Value) Export(out interface{}) error {
 	if v != nil {
 		val := reflect.ValueOf(out)
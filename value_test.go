@@ -0,0 +1,161 @@
+package macaco
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type exportBase struct {
+	ID   int
+	Kind string `json:"type"`
+}
+
+type exportTarget struct {
+	exportBase
+	Name     string `macaco:"full_name"`
+	Age      uint8  `json:"age,omitempty"`
+	Ignored  string `macaco:"-"`
+	Score    float64
+	Tags     [2]string
+	Attrs    map[string]int
+	Extra    interface{}
+	Created  time.Time
+	Modified time.Time
+	Parent   *exportTarget
+}
+
+func TestExport(t *testing.T) {
+	ctx := newTestingContext(t)
+	val, err := ctx.Run(`({
+		id: 7,
+		type: 'user',
+		full_name: 'Ann',
+		age: 42,
+		Ignored: 'no',
+		score: 1.5,
+		tags: ['a'],
+		attrs: {x: 1, y: 2},
+		extra: {a: 'b'},
+		created: new Date(Date.UTC(2014, 0, 2, 3, 4, 5)),
+		modified: '2014-01-02T03:04:05Z',
+		parent: {full_name: 'Bob', parent: null}
+	})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out exportTarget
+	if err := val.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	expected := exportTarget{
+		exportBase: exportBase{ID: 7, Kind: "user"},
+		Name:       "Ann",
+		Age:        42,
+		Score:      1.5,
+		Tags:       [2]string{"a", ""},
+		Attrs:      map[string]int{"x": 1, "y": 2},
+		Extra:      map[string]interface{}{"a": "b"},
+		Parent:     &exportTarget{Name: "Bob"},
+	}
+	if !out.Created.Equal(when) || !out.Modified.Equal(when) {
+		t.Errorf("expecting times %v, got %v and %v", when, out.Created, out.Modified)
+	}
+	out.Created, out.Modified = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expecting %+v, got %+v", expected, out)
+	}
+	errors := []struct {
+		src string
+		out interface{}
+	}{
+		{`1.5`, new(int)},
+		{`256`, new(uint8)},
+		{`-1`, new(uint)},
+		{`NaN`, new(int)},
+		{`1e40`, new(float32)},
+		{`[1, 2, 3]`, new([2]int)},
+		{`({a: 1})`, new(map[int]int)},
+		{`({age: 1.5})`, new(exportTarget)},
+		{`'yesterday'`, new(time.Time)},
+	}
+	for _, v := range errors {
+		val, err := ctx.Run(v.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := val.Export(v.out); err == nil {
+			t.Errorf("expecting an error exporting %s into %T", v.src, v.out)
+		} else {
+			t.Logf("exporting %s into %T: %s", v.src, v.out, err)
+		}
+	}
+}
+
+type marshalTarget struct {
+	exportBase
+	Name    string `macaco:"name"`
+	Email   string `json:"email,omitempty"`
+	Hidden  string `json:"-"`
+	Data    []byte `macaco:"data"`
+	Created time.Time
+	Attrs   map[string]int `macaco:"attrs,omitempty"`
+	Parent  *marshalTarget `macaco:"parent"`
+}
+
+func (m *marshalTarget) Secret() string {
+	return "secret"
+}
+
+func TestToValue(t *testing.T) {
+	ctx := newTestingContext(t)
+	target := &marshalTarget{
+		exportBase: exportBase{ID: 1, Kind: "user"},
+		Name:       "Ann",
+		Hidden:     "hidden",
+		Data:       []byte{0, 255},
+		Created:    time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	val, err := ctx.ToValue(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.Call("(function(v) { var noData = function(k, x) { return k === 'data' ? undefined : x; }; return [JSON.stringify(v, noData), v.Created instanceof Date, typeof v.Secret, typeof v.data, v.data.length].join(' ') })", nil, val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ID":1,"type":"user","name":"Ann","Created":"2014-01-02T03:04:05.000Z","parent":null} true undefined string 2`
+	if s := res.String(); s != expected {
+		t.Errorf("expecting %q, got %q", expected, s)
+	}
+	var back marshalTarget
+	if err := val.Export(&back); err != nil {
+		t.Fatal(err)
+	}
+	target.Hidden = ""
+	if !reflect.DeepEqual(&back, target) {
+		t.Errorf("expecting %+v after round trip, got %+v", target, &back)
+	}
+	target.Parent = target
+	if _, err := ctx.ToValue(target); err == nil {
+		t.Error("expecting an error converting a cycle")
+	}
+	self := map[string]interface{}{}
+	self["self"] = self
+	if _, err := ctx.ToValue(self); err == nil {
+		t.Error("expecting an error converting a map cycle")
+	}
+	list := []interface{}{nil}
+	list[0] = list
+	if _, err := ctx.ToValue(list); err == nil {
+		t.Error("expecting an error converting a slice cycle")
+	}
+	shared := []int{1}
+	if _, err := ctx.ToValue([][]int{shared, shared}); err != nil {
+		t.Errorf("error converting shared slices: %s", err)
+	}
+	if _, err := ctx.ToValue(map[int]string{1: "a"}); err == nil {
+		t.Error("expecting an error converting a map with int keys")
+	}
+}
@@ -0,0 +1,452 @@
+package macaco
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/rainycape/otto"
+)
+
+const (
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+	xmlnsNamespace = "http://www.w3.org/2000/xmlns/"
+)
+
+type xmlAttr struct {
+	prefix string
+	local  string
+	space  string
+	value  string
+}
+
+// name returns the qualified attribute name.
+func (a *xmlAttr) name() string {
+	if a.prefix != "" {
+		return a.prefix + ":" + a.local
+	}
+	return a.local
+}
+
+// xmlNode is an XML node, exposed to JS with the same navigation API
+// as the HTML nodes, see node. Element names are case sensitive and
+// they might be specified in Find, Matches and Attr as a local name
+// (e.g. link), a qualified name (e.g. atom:link) or a local name with
+// its namespace URI in braces (e.g. {http://www.w3.org/2005/Atom}link).
+type xmlNode struct {
+	typ        int
+	prefix     string
+	local      string
+	space      string
+	data       string
+	attrs      []*xmlAttr
+	parent     *xmlNode
+	firstChild *xmlNode
+	lastChild  *xmlNode
+	prev       *xmlNode
+	next       *xmlNode
+	ctx        *Context
+}
+
+func (n *xmlNode) appendChild(c *xmlNode) {
+	c.parent = n
+	if n.lastChild != nil {
+		n.lastChild.next = c
+		c.prev = n.lastChild
+	} else {
+		n.firstChild = c
+	}
+	n.lastChild = c
+}
+
+func (n *xmlNode) values(nodes []*xmlNode) otto.Value {
+	val, err := n.ctx.vm.ToValue(nodes)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func (n *xmlNode) String() string {
+	var buf bytes.Buffer
+	n.render(&buf)
+	return buf.String()
+}
+
+func (n *xmlNode) render(buf *bytes.Buffer) {
+	switch n.typ {
+	case nodeTypeText:
+		xml.EscapeText(buf, []byte(n.data))
+	case nodeTypeComment:
+		buf.WriteString("<!--")
+		buf.WriteString(n.data)
+		buf.WriteString("-->")
+	case nodeTypeElement:
+		name := n.Name()
+		buf.WriteByte('<')
+		buf.WriteString(name)
+		for _, a := range n.attrs {
+			buf.WriteByte(' ')
+			buf.WriteString(a.name())
+			buf.WriteString(`="`)
+			xml.EscapeText(buf, []byte(a.value))
+			buf.WriteByte('"')
+		}
+		if n.firstChild == nil {
+			buf.WriteString("/>")
+			return
+		}
+		buf.WriteByte('>')
+		n.renderChildren(buf)
+		buf.WriteString("</")
+		buf.WriteString(name)
+		buf.WriteByte('>')
+	default:
+		n.renderChildren(buf)
+	}
+}
+
+func (n *xmlNode) renderChildren(buf *bytes.Buffer) {
+	for c := n.firstChild; c != nil; c = c.next {
+		c.render(buf)
+	}
+}
+
+// Inner returns the XML of the node children.
+func (n *xmlNode) Inner() string {
+	var buf bytes.Buffer
+	n.renderChildren(&buf)
+	return buf.String()
+}
+
+func (n *xmlNode) Parent() *xmlNode {
+	return n.parent
+}
+
+func (n *xmlNode) Next() *xmlNode {
+	return n.next
+}
+
+func (n *xmlNode) Prev() *xmlNode {
+	return n.prev
+}
+
+func (n *xmlNode) FirstChild() *xmlNode {
+	return n.firstChild
+}
+
+func (n *xmlNode) LastChild() *xmlNode {
+	return n.lastChild
+}
+
+func (n *xmlNode) Children() otto.Value {
+	var children []*xmlNode
+	for c := n.firstChild; c != nil; c = c.next {
+		children = append(children, c)
+	}
+	return n.values(children)
+}
+
+func (n *xmlNode) Type() int {
+	return n.typ
+}
+
+// Data returns the local name for elements and
+// the contents for text and comment nodes.
+func (n *xmlNode) Data() string {
+	if n.typ == nodeTypeElement {
+		return n.local
+	}
+	return n.data
+}
+
+// Name returns the qualified element name, including its prefix.
+func (n *xmlNode) Name() string {
+	if n.prefix != "" {
+		return n.prefix + ":" + n.local
+	}
+	return n.local
+}
+
+// Namespace returns the element namespace URI.
+func (n *xmlNode) Namespace() string {
+	return n.space
+}
+
+// Attr returns the value of the given attribute, or an empty
+// string if there's no such attribute.
+func (n *xmlNode) Attr(name string) string {
+	for _, a := range n.attrs {
+		if xmlNameMatches(name, a.prefix, a.local, a.space) {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// Attrs returns the attributes as an object with the
+// qualified names as keys.
+func (n *xmlNode) Attrs() map[string]string {
+	attrs := make(map[string]string, len(n.attrs))
+	for _, a := range n.attrs {
+		attrs[a.name()] = a.value
+	}
+	return attrs
+}
+
+// xmlNameMatches returns true if name, in any of the forms
+// accepted by xmlNode, matches the given qualified name.
+func xmlNameMatches(name string, prefix string, local string, space string) bool {
+	if strings.HasPrefix(name, "{") {
+		if end := strings.IndexByte(name, '}'); end > 0 {
+			return name[1:end] == space && name[end+1:] == local
+		}
+	}
+	if sep := strings.IndexByte(name, ':'); sep >= 0 {
+		return name[:sep] == prefix && name[sep+1:] == local
+	}
+	return name == local
+}
+
+func (n *xmlNode) matches(name string, attrs map[string]string) bool {
+	if n.typ != nodeTypeElement {
+		return false
+	}
+	if name != "" && !xmlNameMatches(name, n.prefix, n.local, n.space) {
+		return false
+	}
+	for k, v := range attrs {
+		if !matchAttr(n.Attr(k), v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *xmlNode) Matches(call otto.FunctionCall) bool {
+	name, attrs, err := matchArguments(call)
+	if err != nil {
+		throwError(n.ctx.vm, "TypeError", err)
+	}
+	return n.matches(name, attrs)
+}
+
+func (n *xmlNode) visit(f func(*xmlNode) bool) bool {
+	if f(n) {
+		return true
+	}
+	for c := n.firstChild; c != nil; c = c.next {
+		if c.visit(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *xmlNode) find(name string, attrs map[string]string) []*xmlNode {
+	var nodes []*xmlNode
+	n.visit(func(nn *xmlNode) bool {
+		if nn.matches(name, attrs) {
+			nodes = append(nodes, nn)
+		}
+		return false
+	})
+	return nodes
+}
+
+func (n *xmlNode) Find(call otto.FunctionCall) otto.Value {
+	name, attrs, err := matchArguments(call)
+	if err != nil {
+		throwError(n.ctx.vm, "TypeError", err)
+	}
+	return n.values(n.find(name, attrs))
+}
+
+// child returns the first child element with the given name.
+func (n *xmlNode) child(name string) *xmlNode {
+	for c := n.firstChild; c != nil; c = c.next {
+		if c.matches(name, nil) {
+			return c
+		}
+	}
+	return nil
+}
+
+// childText returns the trimmed text of the first child element
+// with any of the given names, or an empty string if there's none.
+func (n *xmlNode) childText(names ...string) string {
+	for _, v := range names {
+		if c := n.child(v); c != nil {
+			return strings.TrimSpace(c.Text())
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) Text() string {
+	var buf bytes.Buffer
+	n.visit(func(nn *xmlNode) bool {
+		if nn.typ == nodeTypeText {
+			buf.WriteString(nn.data)
+		}
+		return false
+	})
+	return buf.String()
+}
+
+func (n *xmlNode) Visit(call otto.FunctionCall) otto.Value {
+	fn := call.Argument(0)
+	if fn.IsFunction() {
+		n.visit(func(nn *xmlNode) bool {
+			res, err := n.ctx.callFunction(fn, otto.NullValue(), []interface{}{nn})
+			if err != nil {
+				throwError(n.ctx.vm, "Error", err)
+			}
+			b, _ := res.ToBoolean()
+			return b
+		})
+	}
+	return otto.Value{}
+}
+
+// xmlNamespaces resolves the prefixes declared in the open elements.
+type xmlNamespaces []map[string]string
+
+func (ns xmlNamespaces) resolve(prefix string) string {
+	switch prefix {
+	case "xml":
+		return xmlNamespace
+	case "xmlns":
+		return xmlnsNamespace
+	}
+	for ii := len(ns) - 1; ii >= 0; ii-- {
+		if uri, ok := ns[ii][prefix]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+// xmlCharsetReader supports documents which declare their
+// encoding as UTF-8, ASCII or ISO-8859-1.
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		data, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, b := range data {
+			buf.WriteRune(rune(b))
+		}
+		return &buf, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// parseXML parses an XML document, resolving the namespaces. CDATA
+// sections are returned as text nodes, while processing instructions
+// and directives are ignored.
+func parseXML(r io.Reader, ctx *Context) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = xmlCharsetReader
+	doc := &xmlNode{typ: nodeTypeDocument, ctx: ctx}
+	cur := doc
+	var ns xmlNamespaces
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch x := tok.(type) {
+		case xml.StartElement:
+			decls := make(map[string]string)
+			for _, a := range x.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					decls[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					decls[""] = a.Value
+				}
+			}
+			ns = append(ns, decls)
+			el := &xmlNode{
+				typ:    nodeTypeElement,
+				prefix: x.Name.Space,
+				local:  x.Name.Local,
+				space:  ns.resolve(x.Name.Space),
+				ctx:    ctx,
+			}
+			for _, a := range x.Attr {
+				attr := &xmlAttr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value}
+				// Unprefixed attributes have no namespace
+				if attr.prefix != "" {
+					attr.space = ns.resolve(attr.prefix)
+				}
+				el.attrs = append(el.attrs, attr)
+			}
+			cur.appendChild(el)
+			cur = el
+		case xml.EndElement:
+			if cur.typ != nodeTypeElement || cur.prefix != x.Name.Space || cur.local != x.Name.Local {
+				return nil, fmt.Errorf("unexpected end element </%s> at line %d", xmlName(x.Name), xmlLine(dec))
+			}
+			ns = ns[:len(ns)-1]
+			cur = cur.parent
+		case xml.CharData:
+			if last := cur.lastChild; last != nil && last.typ == nodeTypeText {
+				// Merge adjacent text and CDATA sections
+				last.data += string(x)
+			} else {
+				cur.appendChild(&xmlNode{typ: nodeTypeText, data: string(x), ctx: ctx})
+			}
+		case xml.Comment:
+			cur.appendChild(&xmlNode{typ: nodeTypeComment, data: string(x), ctx: ctx})
+		}
+	}
+	if cur != doc {
+		return nil, fmt.Errorf("unclosed element <%s>", cur.Name())
+	}
+	return doc, nil
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func xmlLine(dec *xml.Decoder) int {
+	line, _ := dec.InputPos()
+	return line
+}
+
+func (c *Context) xmlParse(call otto.FunctionCall) (otto.Value, error) {
+	doc, err := parseXML(strings.NewReader(call.Argument(0).String()), c)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	return c.vm.ToValue(doc)
+}
+
+func (c *Context) loadXML(obj *otto.Object) {
+	xmlObj := c.newMacacoObject("xml")
+	xmlObj.Set("parse", c.throwingFunc("SyntaxError", c.xmlParse))
+	xmlObj.Set("escape", func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	})
+}
@@ -0,0 +1,35 @@
+package macaco
+
+import (
+	"strconv"
+	"testing"
+)
+
+const testXML = `<?xml version="1.0" encoding="UTF-8"?>
+<root xmlns="http://example.com/a" xmlns:b="http://example.com/b">
+  <Item id="1" b:kind="x">First</Item>
+  <b:Item id="2"><![CDATA[<Second> & more]]></b:Item>
+  <!-- comment -->
+</root>`
+
+func TestXML(t *testing.T) {
+	ctx := newTestingContext(t)
+	if _, err := ctx.Run("var src = " + strconv.Quote(testXML)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []jsCase{
+		{`M.xml.parse(src).Find('Item').length`, `2`},
+		{`M.xml.parse(src).Find('item').length`, `0`},
+		{`M.xml.parse(src).Find('b:Item')[0].Text()`, `<Second> & more`},
+		{`M.xml.parse(src).Find('{http://example.com/a}Item')[0].Text()`, `First`},
+		{`M.xml.parse(src).Find('Item', {id: '2'})[0].Namespace()`, `http://example.com/b`},
+		{`M.xml.parse(src).Find('Item')[0].Attr('b:kind')`, `x`},
+		{`M.xml.parse(src).Find('Item')[0].Attr('{http://example.com/b}kind')`, `x`},
+		{`var n = M.xml.parse(src).Find('Item')[1]; n.Name() + ' ' + n.Data() + ' ' + n.Parent().Name()`, `b:Item Item root`},
+		{`M.xml.parse(src).Find('b:Item')[0].String()`, `<b:Item id="2">&lt;Second&gt; &amp; more</b:Item>`},
+		{`M.xml.parse('<a><b/>text</a>').FirstChild().Children().length`, `2`},
+		{`var names = []; M.xml.parse('<a><b/><c/></a>').Visit(function(n) { if (n.Type() == 2) names.push(n.Name()); }); names.join()`, `a,b,c`},
+		{`try { M.xml.parse('<a><b></a>') } catch (e) { e.name }`, `SyntaxError`},
+	}
+	runJSCases(t, ctx, cases)
+}